@@ -42,6 +42,31 @@ func NewBroker(cfg Config) (*Broker, error) {
 	return b, nil
 }
 
+// Stats statistics of broker
+type Stats struct {
+	Session         session.ManagerStats `json:"session"`
+	Rejected        uint64               `json:"rejected"`        // connections rejected by listeners
+	HandshakeFailed uint64               `json:"handshakeFailed"` // tls connections closed by listeners with handshake timeout since the handshakes failed or timed out, the failures of the other listeners are counted in Session.ConnectFailures.TLS
+}
+
+// Stats returns the statistics of broker
+func (b *Broker) Stats() Stats {
+	var res Stats
+	if b.ses != nil {
+		res.Session = b.ses.Stats()
+	}
+	if b.lis != nil {
+		res.Rejected = b.lis.Rejected()
+		res.HandshakeFailed = b.lis.HandshakeFailed()
+	}
+	return res
+}
+
+// ReloadPrincipals replaces the principals of sessions
+func (b *Broker) ReloadPrincipals(principals []session.Principal) error {
+	return b.ses.ReloadPrincipals(principals)
+}
+
 // Close closes broker
 func (b *Broker) Close() {
 	if b.lis != nil {
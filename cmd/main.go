@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 	_ "net/http/pprof"
 
@@ -39,6 +40,8 @@ func main() {
 			return err
 		}
 		defer b.Close()
+		// curl http://localhost:8005/debug/vars
+		expvar.Publish("broker", expvar.Func(func() interface{} { return b.Stats() }))
 		ctx.Wait()
 		return nil
 	})
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var clock atomic.Value
+
+func init() {
+	clock.Store(time.Now)
+}
+
+// Now returns the current wall clock time used to stamp messages, the monotonic clock reading is stripped
+// so that comparisons and calculations use the wall clock
+func Now() time.Time {
+	return clock.Load().(func() time.Time)().Round(0)
+}
+
+// SetClock replaces the wall clock, it is used to simulate clock jumps, and returns a function to restore the previous one
+func SetClock(now func() time.Time) func() {
+	prev := clock.Load()
+	clock.Store(now)
+	return func() {
+		clock.Store(prev)
+	}
+}
+
+// Elapsed returns the duration elapsed since the wall clock timestamp in nanoseconds,
+// it is clamped to zero if the timestamp is in the future, which means the timestamp is written by a skewed clock
+func Elapsed(ts uint64) time.Duration {
+	d := Now().Sub(time.Unix(0, int64(ts)))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -48,7 +48,14 @@ func (a *acknowledge) _wait(timeout <-chan time.Time, cancel <-chan struct{}) er
 // Event event with message and acknowledge
 type Event struct {
 	*mqtt.Message
-	ack *acknowledge
+	ack  *acknowledge
+	born time.Time // monotonic time when the message is stamped
+}
+
+// Age returns the duration elapsed since the message is stamped, it is measured by the monotonic clock
+// since the event is created, so it is not affected by the wall clock jumps afterwards
+func (e *Event) Age() time.Duration {
+	return time.Since(e.born)
 }
 
 // Done the event is acknowledged
@@ -65,11 +72,16 @@ func (e *Event) Wait(timeout <-chan time.Time, cancel <-chan struct{}) error {
 
 // NewEvent creates a new event
 func NewEvent(msg *mqtt.Message, count int32, call func(uint64)) *Event {
+	born := time.Now()
+	if msg.Context.TS != 0 {
+		born = born.Add(-Elapsed(msg.Context.TS))
+	}
 	if count == 0 || call == nil {
-		return &Event{Message: msg}
+		return &Event{Message: msg, born: born}
 	}
 	return &Event{
 		Message: msg,
+		born:    born,
 		ack: &acknowledge{
 			count: count,
 			call:  call,
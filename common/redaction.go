@@ -0,0 +1,115 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+)
+
+// Redaction redacts the messages in logs, only the metadata such as size and QoS is kept,
+// the payload is omitted or hashed by the mode, disabled if the mode is empty
+type Redaction struct {
+	Mode  string `yaml:"mode,omitempty" json:"mode,omitempty" validate:"regexp=^(omit|hash)?$"`
+	Topic bool   `yaml:"topic,omitempty" json:"topic,omitempty"` // redacts the topic by the same mode
+}
+
+// FormatMessage formats the message for logs
+func (r Redaction) FormatMessage(m *mqtt.Message) string {
+	if r.Mode == "" {
+		return m.String()
+	}
+	return fmt.Sprintf("<Message ID=%d TS=%d QOS=%d Flags=%d Topic=%s Size=%d Payload=%s>",
+		m.Context.ID, m.Context.TS, m.Context.QOS, m.Context.Flags, r.topic(m.Context.Topic), len(m.Content), r.redact(m.Content))
+}
+
+// FormatTopic formats the topic or topic filter for logs
+func (r Redaction) FormatTopic(topic string) string {
+	if r.Mode == "" || !r.Topic {
+		return topic
+	}
+	return r.redact([]byte(topic))
+}
+
+// FormatTopics formats the topics or topic filters for logs
+func (r Redaction) FormatTopics(topics []string) []string {
+	if r.Mode == "" || !r.Topic {
+		return topics
+	}
+	res := make([]string, len(topics))
+	for i, topic := range topics {
+		res[i] = r.redact([]byte(topic))
+	}
+	return res
+}
+
+// LogMessage wraps the message to be formatted lazily by FormatMessage in logs
+type LogMessage struct {
+	*mqtt.Message
+	Redaction Redaction
+}
+
+func (m LogMessage) String() string {
+	return m.Redaction.FormatMessage(m.Message)
+}
+
+// FormatPacket formats the packet for logs, the messages of publish and will, and the password of connect are redacted,
+// so are the topic filters of subscribe and unsubscribe if the topic is redacted
+func (r Redaction) FormatPacket(pkt mqtt.Packet) string {
+	if r.Mode == "" {
+		return pkt.String()
+	}
+	switch p := pkt.(type) {
+	case *mqtt.Publish:
+		return fmt.Sprintf("<Publish ID=%d Message=%s Dup=%t>", p.ID, r.message(p.Message.Topic, p.Message.QOS, p.Message.Retain, p.Message.Payload), p.Dup)
+	case *mqtt.Connect:
+		will := "nil"
+		if p.Will != nil {
+			will = r.message(p.Will.Topic, p.Will.QOS, p.Will.Retain, p.Will.Payload)
+		}
+		return fmt.Sprintf("<Connect ClientID=%q KeepAlive=%d Username=%q Password=%s CleanSession=%t Will=%s Version=%d>",
+			p.ClientID, p.KeepAlive, p.Username, r.redact([]byte(p.Password)), p.CleanSession, will, p.Version)
+	case *mqtt.Subscribe:
+		if !r.Topic {
+			return pkt.String()
+		}
+		subs := make([]string, len(p.Subscriptions))
+		for i, sub := range p.Subscriptions {
+			subs[i] = fmt.Sprintf("%s=>%d", r.topic(sub.Topic), sub.QOS)
+		}
+		return fmt.Sprintf("<Subscribe ID=%d Subscriptions=[%s]>", p.ID, strings.Join(subs, ", "))
+	case *mqtt.Unsubscribe:
+		if !r.Topic {
+			return pkt.String()
+		}
+		topics := make([]string, len(p.Topics))
+		for i, topic := range p.Topics {
+			topics[i] = r.topic(topic)
+		}
+		return fmt.Sprintf("<Unsubscribe Topics=[%s]>", strings.Join(topics, ", "))
+	default:
+		return pkt.String()
+	}
+}
+
+func (r Redaction) message(topic string, qos mqtt.QOS, retain bool, payload []byte) string {
+	return fmt.Sprintf("<Message Topic=%s QOS=%d Retain=%t Size=%d Payload=%s>",
+		r.topic(topic), qos, retain, len(payload), r.redact(payload))
+}
+
+func (r Redaction) topic(topic string) string {
+	if !r.Topic {
+		return fmt.Sprintf("%q", topic)
+	}
+	return r.redact([]byte(topic))
+}
+
+func (r Redaction) redact(data []byte) string {
+	if r.Mode == "hash" {
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	return "<omitted>"
+}
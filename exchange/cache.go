@@ -0,0 +1,54 @@
+package exchange
+
+import "sync"
+
+// routeCache caches the queues matched by the topics recently routed, so that the publishes of a hot topic
+// reuse the result instead of walking the trie again, all the entries are dropped when any binding changes
+type routeCache struct {
+	size    int
+	gen     uint64 // increased when the bindings change
+	entries map[string][]interface{}
+	mut     sync.RWMutex
+}
+
+func newRouteCache(size int) *routeCache {
+	return &routeCache{
+		size:    size,
+		entries: make(map[string][]interface{}),
+	}
+}
+
+// get returns the queues cached for the topic, and the generation to put the queues matched if not cached
+func (c *routeCache) get(topic string) ([]interface{}, uint64, bool) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	sss, ok := c.entries[topic]
+	return sss, c.gen, ok
+}
+
+// put caches the queues matched at the generation, they are discarded if the bindings changed since,
+// the cache is reset when full, since the topics routed frequently are cached again soon
+func (c *routeCache) put(topic string, sss []interface{}, gen uint64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if len(c.entries) >= c.size {
+		c.entries = make(map[string][]interface{})
+	}
+	c.entries[topic] = sss
+}
+
+// invalidate drops all the entries, it is called after the bindings changed
+func (c *routeCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.gen++
+	if len(c.entries) > 0 {
+		c.entries = make(map[string][]interface{})
+	}
+}
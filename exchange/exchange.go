@@ -1,7 +1,10 @@
 package exchange
 
 import (
+	"hash/fnv"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
@@ -12,81 +15,212 @@ import (
 // Exchange the message exchange
 type Exchange struct {
 	bindings map[string]*mqtt.Trie
+	shards   []*mqtt.Trie            // the bindings of common topics partitioned by the hash of the first level
+	groups   map[string]*sharedGroup // the groups of shared subscriptions
+	mut      sync.Mutex              // guards the groups
+	cache    *routeCache             // the queues matched by the topics recently routed, nil if disabled
 	log      *log.Logger
 }
 
 // NewExchange creates a new exchange
 func NewExchange(sysTopics []string) *Exchange {
+	return NewShardedExchange(sysTopics, 1)
+}
+
+// NewShardedExchange creates a new exchange whose common topics are partitioned into shards
+// by the hash of the first level, so that the topics of different prefixes don't contend on the same trie,
+// the topic filters starting with a wildcard are bound to all shards
+func NewShardedExchange(sysTopics []string, shards int) *Exchange {
+	if shards < 1 {
+		shards = 1
+	}
 	ex := &Exchange{
 		bindings: make(map[string]*mqtt.Trie),
+		shards:   make([]*mqtt.Trie, shards),
+		groups:   make(map[string]*sharedGroup),
 		log:      log.With(log.Any("broker", "exchange")),
 	}
 	for _, v := range sysTopics {
 		ex.bindings[v] = mqtt.NewTrie()
 	}
 	// common
-	ex.bindings["/"] = mqtt.NewTrie()
+	for i := range ex.shards {
+		ex.shards[i] = mqtt.NewTrie()
+	}
+	ex.bindings["/"] = ex.shards[0]
+	for i := 1; i < shards; i++ {
+		ex.bindings["/"+strconv.Itoa(i)] = ex.shards[i]
+	}
 	return ex
 }
 
-// Bindings gets bindings
+// EnableRouteCache caches the queues matched by at most size topics recently routed, so that the rapid publishes
+// to a hot topic don't walk the trie each time, the cache is invalidated on any binding change,
+// it should be called before the exchange is used
+func (b *Exchange) EnableRouteCache(size int) {
+	if size > 0 {
+		b.cache = newRouteCache(size)
+	}
+}
+
+// Bindings gets bindings, the shards of common topics are keyed by "/" and "/<index>"
 func (b *Exchange) Bindings() map[string]*mqtt.Trie {
 	return b.bindings
 }
 
-// Bind binds a new queue with a specify topic
+// Bind binds a new queue with a specify topic, the queue joins the group if the topic is a shared subscription
 func (b *Exchange) Bind(topic string, queue common.Queue) {
+	if _, filter, ok := SplitShared(topic); ok {
+		b.bindShared(topic, filter, queue)
+		return
+	}
+	b.bind(topic, queue)
+}
+
+// Unbind unbinds a queue from a specify topic, the queue leaves the group if the topic is a shared subscription
+func (b *Exchange) Unbind(topic string, queue common.Queue) {
+	if _, filter, ok := SplitShared(topic); ok {
+		b.unbindShared(topic, filter, queue)
+		return
+	}
+	b.unbind(topic, queue)
+}
+
+// UnbindAll unbinds queues from all topics, including the groups of shared subscriptions
+func (b *Exchange) UnbindAll(queue common.Queue) {
+	for _, bind := range b.bindings {
+		bind.Clear(queue)
+	}
+	b.cache.invalidate()
+	b.mut.Lock()
+	var topics []string
+	for topic, g := range b.groups {
+		if g.contains(queue) {
+			topics = append(topics, topic)
+		}
+	}
+	b.mut.Unlock()
+	for _, topic := range topics {
+		b.Unbind(topic, queue)
+	}
+}
+
+func (b *Exchange) bind(topic string, v interface{}) {
+	defer b.cache.invalidate()
 	parts := strings.SplitN(topic, "/", 2)
 	if bind, ok := b.bindings[parts[0]]; ok {
-		bind.Add(parts[1], queue)
+		bind.Add(parts[1], v)
 		return
 	}
 	// common
-	b.bindings["/"].Add(topic, queue)
+	for _, bind := range b.shard(parts[0], true) {
+		bind.Add(topic, v)
+	}
 }
 
-// Unbind unbinds a queue from a specify topic
-func (b *Exchange) Unbind(topic string, queue common.Queue) {
+func (b *Exchange) unbind(topic string, v interface{}) {
+	defer b.cache.invalidate()
 	parts := strings.SplitN(topic, "/", 2)
 	if bind, ok := b.bindings[parts[0]]; ok {
-		bind.Remove(parts[1], queue)
+		bind.Remove(parts[1], v)
 		return
 	}
 	// common
-	b.bindings["/"].Remove(topic, queue)
+	for _, bind := range b.shard(parts[0], true) {
+		bind.Remove(topic, v)
+	}
 }
 
-// UnbindAll unbinds queues from all topics
-func (b *Exchange) UnbindAll(queue common.Queue) {
-	for _, bind := range b.bindings {
-		bind.Clear(queue)
+// Bound checks whether the queue is bound with the topic filter or is a member of the shared subscription,
+// the topic filter starting with a wildcard is bound only if it is bound to all shards
+func (b *Exchange) Bound(topic string, queue common.Queue) bool {
+	if _, _, ok := SplitShared(topic); ok {
+		b.mut.Lock()
+		g, ok := b.groups[topic]
+		b.mut.Unlock()
+		return ok && g.contains(queue)
+	}
+	parts := strings.SplitN(topic, "/", 2)
+	if bind, ok := b.bindings[parts[0]]; ok {
+		return contains(bind.Get(parts[1]), queue)
+	}
+	// common
+	for _, bind := range b.shard(parts[0], true) {
+		if !contains(bind.Get(topic), queue) {
+			return false
+		}
 	}
+	return true
 }
 
-// Route routes message to binding queues
-func (b *Exchange) Route(msg *mqtt.Message, cb func(uint64)) {
-	var sss []interface{}
-	parts := strings.SplitN(msg.Context.Topic, "/", 2)
-	if bind, ok := b.bindings[parts[0]]; ok {
-		sss = bind.Match(parts[1])
-	} else {
-		sss = b.bindings["/"].Match(msg.Context.Topic)
+func contains(queues []interface{}, queue common.Queue) bool {
+	for _, q := range queues {
+		if q == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// shard returns the shards of common topics for the first level of a topic or topic filter,
+// all the shards are returned for the wildcard of topic filter
+func (b *Exchange) shard(level string, filter bool) []*mqtt.Trie {
+	if len(b.shards) == 1 || (filter && (level == "+" || level == "#")) {
+		return b.shards
 	}
+	h := fnv.New32a()
+	h.Write([]byte(level))
+	i := h.Sum32() % uint32(len(b.shards))
+	return b.shards[i : i+1]
+}
+
+// Route routes message to binding queues, returns the first error of the queues failed to push,
+// the callback is never called if any queue fails, since the message is not acknowledged by all queues
+func (b *Exchange) Route(msg *mqtt.Message, cb func(uint64)) error {
+	sss := b.match(msg.Context.Topic)
 	length := len(sss)
 	b.log.Debug("exchange routes a message to queues", log.Any("count", length))
 	if length == 0 {
 		if cb != nil {
 			cb(msg.Context.ID)
 		}
-		return
+		return nil
 	}
-	var err error
+	var res error
+	// one event is shared by all the queues, and the queues matched may be cached, so nothing is allocated per queue
 	event := common.NewEvent(msg, int32(length), cb)
 	for _, s := range sss {
 		queue := s.(common.Queue)
-		err = queue.Push(event)
+		err := queue.Push(event)
 		if err != nil {
 			b.log.Error("failed to push message into queue", log.Any("id", queue.ID()), log.Error(err))
+			if res == nil {
+				res = err
+			}
+		}
+	}
+	return res
+}
+
+// match returns the queues bound with the topic filters matching the topic, the result is read only since it may be cached
+func (b *Exchange) match(topic string) []interface{} {
+	var gen uint64
+	if b.cache != nil {
+		sss, g, ok := b.cache.get(topic)
+		if ok {
+			return sss
 		}
+		gen = g
+	}
+	var sss []interface{}
+	parts := strings.SplitN(topic, "/", 2)
+	if bind, ok := b.bindings[parts[0]]; ok {
+		sss = bind.Match(parts[1])
+	} else {
+		sss = b.shard(parts[0], false)[0].Match(topic)
+	}
+	if b.cache != nil {
+		b.cache.put(topic, sss, gen)
 	}
+	return sss
 }
@@ -0,0 +1,216 @@
+package exchange
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+type mockQueue struct {
+	id    string
+	count int32
+}
+
+func (q *mockQueue) Push(e *common.Event) error {
+	atomic.AddInt32(&q.count, 1)
+	e.Done()
+	return nil
+}
+
+func (q *mockQueue) ID() string {
+	return q.id
+}
+
+func route(t *testing.T, ex *Exchange, topic string) {
+	msg := &mqtt.Message{}
+	msg.Context.Topic = topic
+	assert.NoError(t, ex.Route(msg, nil))
+}
+
+func TestShardedExchange(t *testing.T) {
+	for _, shards := range []int{0, 1, 8} {
+		ex := NewShardedExchange([]string{"$link"}, shards)
+		a, wild, all, sys := &mockQueue{id: "a"}, &mockQueue{id: "wild"}, &mockQueue{id: "all"}, &mockQueue{id: "sys"}
+		ex.Bind("a/b", a)
+		ex.Bind("+/b", wild)
+		ex.Bind("#", all)
+		ex.Bind("$link/b", sys)
+		assert.True(t, ex.Bound("a/b", a))
+		assert.True(t, ex.Bound("+/b", wild))
+		assert.True(t, ex.Bound("$link/b", sys))
+		assert.False(t, ex.Bound("a/b", wild))
+		assert.False(t, ex.Bound("$link/b", a))
+
+		for i := 0; i < 10; i++ {
+			route(t, ex, strconv.Itoa(i)+"/b")
+		}
+		route(t, ex, "a/b")
+		route(t, ex, "$link/b")
+		assert.Equal(t, int32(1), atomic.LoadInt32(&a.count))
+		assert.Equal(t, int32(11), atomic.LoadInt32(&wild.count))
+		assert.Equal(t, int32(11), atomic.LoadInt32(&all.count))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&sys.count))
+
+		// the wildcard subscriptions are unbound from all shards
+		ex.Unbind("+/b", wild)
+		ex.UnbindAll(all)
+		route(t, ex, "c/b")
+		assert.False(t, ex.Bound("+/b", wild))
+		assert.Equal(t, int32(11), atomic.LoadInt32(&wild.count))
+		assert.Equal(t, int32(11), atomic.LoadInt32(&all.count))
+
+		count := 0
+		for _, bind := range ex.Bindings() {
+			count += bind.Count()
+		}
+		assert.Equal(t, 2, count)
+	}
+}
+
+func TestSharedExchange(t *testing.T) {
+	for _, shards := range []int{1, 8} {
+		ex := NewShardedExchange([]string{"$link"}, shards)
+		a, b, normal := &mockQueue{id: "a"}, &mockQueue{id: "b"}, &mockQueue{id: "normal"}
+		// a holds both the normal and the shared subscriptions of the same topic filter
+		ex.Bind("t/+", a)
+		ex.Bind("$share/g/t/+", a)
+		ex.Bind("$share/g/t/+", b)
+		ex.Bind("t/+", normal)
+		assert.True(t, ex.Bound("$share/g/t/+", a))
+		assert.True(t, ex.Bound("$share/g/t/+", b))
+		assert.False(t, ex.Bound("$share/g/t/+", normal))
+		assert.False(t, ex.Bound("$share/h/t/+", a))
+
+		// the group is delivered to one of its members in turn besides the normal subscriptions
+		for i := 0; i < 4; i++ {
+			route(t, ex, "t/"+strconv.Itoa(i))
+		}
+		assert.Equal(t, int32(6), atomic.LoadInt32(&a.count))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&b.count))
+		assert.Equal(t, int32(4), atomic.LoadInt32(&normal.count))
+
+		// the group is left after unbinding all
+		ex.UnbindAll(a)
+		assert.False(t, ex.Bound("$share/g/t/+", a))
+		for i := 0; i < 2; i++ {
+			route(t, ex, "t/"+strconv.Itoa(i))
+		}
+		assert.Equal(t, int32(6), atomic.LoadInt32(&a.count))
+		assert.Equal(t, int32(4), atomic.LoadInt32(&b.count))
+		assert.Equal(t, int32(6), atomic.LoadInt32(&normal.count))
+
+		// the group is unbound when the last member leaves
+		ex.Unbind("$share/g/t/+", b)
+		ex.Unbind("t/+", normal)
+		route(t, ex, "t/0")
+		assert.Equal(t, int32(4), atomic.LoadInt32(&b.count))
+		count := 0
+		for _, bind := range ex.Bindings() {
+			count += bind.Count()
+		}
+		assert.Equal(t, 0, count)
+	}
+}
+
+func TestExchangeRouteCache(t *testing.T) {
+	ex := NewShardedExchange([]string{"$link"}, 4)
+	ex.EnableRouteCache(2)
+	a, b, sys := &mockQueue{id: "a"}, &mockQueue{id: "b"}, &mockQueue{id: "sys"}
+	ex.Bind("t/+", a)
+	ex.Bind("$link/t", sys)
+	route(t, ex, "t/0")
+	route(t, ex, "t/0")
+	route(t, ex, "$link/t")
+	assert.Len(t, ex.cache.entries, 2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&a.count))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&sys.count))
+
+	// the cache is reset when full
+	route(t, ex, "t/1")
+	assert.Len(t, ex.cache.entries, 1)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&a.count))
+
+	// the cache is invalidated on binding changes, including the shared subscriptions
+	route(t, ex, "t/0")
+	ex.Bind("t/0", b)
+	assert.Len(t, ex.cache.entries, 0)
+	route(t, ex, "t/0")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&a.count))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&b.count))
+	ex.Bind("$share/g/t/0", b)
+	route(t, ex, "t/0")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&b.count))
+	ex.Unbind("t/0", b)
+	route(t, ex, "t/0")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&b.count))
+	ex.UnbindAll(b)
+	route(t, ex, "t/0")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&b.count))
+	assert.Equal(t, int32(8), atomic.LoadInt32(&a.count))
+
+	// the result matched before a binding change is not cached
+	_, gen, ok := ex.cache.get("t/2")
+	assert.False(t, ok)
+	ex.Unbind("t/+", a)
+	ex.cache.put("t/2", []interface{}{a}, gen)
+	route(t, ex, "t/2")
+	assert.Equal(t, int32(8), atomic.LoadInt32(&a.count))
+}
+
+// BenchmarkShardedExchangeRoute routes messages by concurrent publishers on different prefixes,
+// while the subscriptions of the prefixes keep changing
+func BenchmarkShardedExchangeRoute(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			ex := NewShardedExchange(nil, shards)
+			for i := 0; i < 64; i++ {
+				ex.Bind("prefix"+strconv.Itoa(i)+"/+/data", &mockQueue{id: strconv.Itoa(i)})
+			}
+			var next int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				prefix := "prefix" + strconv.Itoa(int(atomic.AddInt64(&next, 1)%64))
+				q := &mockQueue{id: prefix}
+				msg := &mqtt.Message{}
+				msg.Context.Topic = prefix + "/device/data"
+				for i := 0; pb.Next(); i++ {
+					if i%10 == 0 {
+						ex.Bind(prefix+"/device/#", q)
+						ex.Unbind(prefix+"/device/#", q)
+					}
+					ex.Route(msg, nil)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkExchangeRouteFanIn routes messages by many concurrent publishers to the same topic with a few subscribers
+func BenchmarkExchangeRouteFanIn(b *testing.B) {
+	for _, size := range []int{0, 1024} {
+		b.Run("cache="+strconv.Itoa(size), func(b *testing.B) {
+			ex := NewExchange(nil)
+			ex.EnableRouteCache(size)
+			for i := 0; i < 4; i++ {
+				ex.Bind("site/+/device/#", &mockQueue{id: strconv.Itoa(i)})
+			}
+			ex.Bind("site/1/device/+/data", &mockQueue{id: "data"})
+			ex.Bind("#", &mockQueue{id: "all"})
+			b.SetParallelism(64)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				msg := &mqtt.Message{}
+				msg.Context.Topic = "site/1/device/2/data"
+				for pb.Next() {
+					ex.Route(msg, nil)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package exchange
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// SharedPrefix the prefix of shared subscriptions, such as "$share/{group}/{filter}"
+const SharedPrefix = "$share/"
+
+// SharedQueue the queue receiving the messages routed by shared subscriptions,
+// the topic is the shared subscription such as "$share/{group}/{filter}"
+type SharedQueue interface {
+	PushShared(topic string, e *common.Event) error
+}
+
+// SplitShared splits the shared subscription into the group and the topic filter, ok is false if not shared
+func SplitShared(topic string) (group, filter string, ok bool) {
+	if !strings.HasPrefix(topic, SharedPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(topic[len(SharedPrefix):], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// sharedGroup the members of a shared subscription, it is bound by the topic filter in the trie as a queue,
+// so the message is delivered to one of the members besides the normal subscriptions of the same topic filter
+type sharedGroup struct {
+	topic   string // the shared subscription
+	members []common.Queue
+	next    uint32
+	mut     sync.RWMutex
+}
+
+// ID returns the shared subscription
+func (g *sharedGroup) ID() string {
+	return g.topic
+}
+
+// Push pushes the message to one of the members in turn
+func (g *sharedGroup) Push(e *common.Event) error {
+	g.mut.RLock()
+	if len(g.members) == 0 {
+		g.mut.RUnlock()
+		e.Done()
+		return nil
+	}
+	q := g.members[int(atomic.AddUint32(&g.next, 1)-1)%len(g.members)]
+	g.mut.RUnlock()
+	if sq, ok := q.(SharedQueue); ok {
+		return sq.PushShared(g.topic, e)
+	}
+	return q.Push(e)
+}
+
+func (g *sharedGroup) add(queue common.Queue) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	for _, q := range g.members {
+		if q == queue {
+			return
+		}
+	}
+	g.members = append(g.members, queue)
+}
+
+// remove removes the member and returns the count of the members left
+func (g *sharedGroup) remove(queue common.Queue) int {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	for i, q := range g.members {
+		if q == queue {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	return len(g.members)
+}
+
+func (g *sharedGroup) contains(queue common.Queue) bool {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	for _, q := range g.members {
+		if q == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// bindShared adds the queue to the group of the shared subscription, the group is bound when the first member joins
+func (b *Exchange) bindShared(topic, filter string, queue common.Queue) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	g, ok := b.groups[topic]
+	if !ok {
+		g = &sharedGroup{topic: topic}
+		b.groups[topic] = g
+		b.bind(filter, g)
+	}
+	g.add(queue)
+}
+
+// unbindShared removes the queue from the group of the shared subscription, the group is unbound when the last member leaves
+func (b *Exchange) unbindShared(topic, filter string, queue common.Queue) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	g, ok := b.groups[topic]
+	if !ok {
+		return
+	}
+	if g.remove(queue) == 0 {
+		delete(b.groups, topic)
+		b.unbind(filter, g)
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
@@ -18,22 +22,41 @@ type Config struct {
 
 // Listener listener config
 type Listener struct {
-	Address              string     `yaml:"address" json:"address"`
-	MaxMessageSize       utils.Size `yaml:"maxMessageSize" json:"maxMessageSize"`
-	MaxConcurrentStreams uint32     `yaml:"maxConcurrentStreams" json:"maxConcurrentStreams"`
-	Anonymous            bool       `yaml:"anonymous" json:"anonymous"`
+	Address              string        `yaml:"address" json:"address"`
+	MaxMessageSize       utils.Size    `yaml:"maxMessageSize" json:"maxMessageSize"`
+	MaxConcurrentStreams uint32        `yaml:"maxConcurrentStreams" json:"maxConcurrentStreams"`
+	Anonymous            bool          `yaml:"anonymous" json:"anonymous"`
+	Allow                []string      `yaml:"allow" json:"allow"`
+	Deny                 []string      `yaml:"deny" json:"deny"`
+	HandshakeTimeout     time.Duration `yaml:"handshakeTimeout,omitempty" json:"handshakeTimeout,omitempty"` // closes the tls connection whose handshake is not completed in time before handled, 0 means the handshake is done lazily by the first read
+	Features             Features      `yaml:"features,omitempty" json:"features,omitempty"`
 	utils.Certificate    `yaml:",inline" json:",inline"`
 }
 
+// Features the features enabled on listener, all features supported by broker are enabled by default
+type Features struct {
+	MaxQOS                    *uint32 `yaml:"maxQos,omitempty" json:"maxQos,omitempty"` // max QoS of publish and subscribe, no more limit than broker if not set
+	DisableRetain             bool    `yaml:"disableRetain,omitempty" json:"disableRetain,omitempty"`
+	DisableWildcard           bool    `yaml:"disableWildcard,omitempty" json:"disableWildcard,omitempty"`
+	DisableSharedSubscription bool    `yaml:"disableSharedSubscription,omitempty" json:"disableSharedSubscription,omitempty"`
+}
+
 // Handler listener handler
 type Handler interface {
 	Handle(conn mqtt.Connection, anonymous bool)
 }
 
+// FeatureHandler the listener handler which applies the features of listener
+type FeatureHandler interface {
+	HandleWithFeatures(conn mqtt.Connection, anonymous bool, features Features)
+}
+
 // Manager listener manager
 type Manager struct {
-	mqtts []mqtt.Server
-	log   *log.Logger
+	mqtts           []mqtt.Server
+	rejected        uint64
+	handshakeFailed uint64
+	log             *log.Logger
 }
 
 // NewManager creates a new listener manager
@@ -62,7 +85,15 @@ func NewManager(cfg []Listener, handler Handler) (*Manager, error) {
 			}
 		}
 
-		svr, err := m.launchMQTTServer(c.Address, tlsconfig, c.Anonymous, handler)
+		filter, err := newAddrFilter(c.Allow, c.Deny)
+		if err != nil {
+			_err := m.Close()
+			if _err != nil {
+				m.log.Error("failed to close manager", log.Any("address", c.Address), log.Error(err))
+			}
+			return nil, errors.Trace(err)
+		}
+		svr, err := m.launchMQTTServer(c, tlsconfig, filter, handler)
 		if err != nil {
 			_err := m.Close()
 			if _err != nil {
@@ -76,8 +107,8 @@ func NewManager(cfg []Listener, handler Handler) (*Manager, error) {
 	return m, nil
 }
 
-func (m *Manager) launchMQTTServer(address string, tlsconfig *tls.Config, anonymous bool, handler Handler) (mqtt.Server, error) {
-	svr, err := mqtt.NewLauncher(tlsconfig).Launch(address)
+func (m *Manager) launchMQTTServer(c Listener, tlsconfig *tls.Config, filter *addrFilter, handler Handler) (mqtt.Server, error) {
+	svr, err := mqtt.NewLauncher(tlsconfig).Launch(c.Address)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -92,12 +123,79 @@ func (m *Manager) launchMQTTServer(address string, tlsconfig *tls.Config, anonym
 				}
 				return
 			}
-			handler.Handle(conn, anonymous)
+			if !filter.permit(conn.RemoteAddr()) {
+				atomic.AddUint64(&m.rejected, 1)
+				m.log.Warn("connection is rejected by address filter", log.Any("listener", c.Address), log.Any("remote", conn.RemoteAddr()))
+				if err := conn.Close(); err != nil {
+					m.log.Debug("failed to close rejected connection", log.Error(err))
+				}
+				continue
+			}
+			if tlsconfig != nil && c.HandshakeTimeout > 0 {
+				// handshakes without blocking the accepting of other connections
+				go func(conn mqtt.Connection) {
+					if m.handshake(c, conn) {
+						handle(c, conn, handler)
+					}
+				}(conn)
+				continue
+			}
+			handle(c, conn, handler)
 		}
 	}()
 	return svr, nil
 }
 
+func handle(c Listener, conn mqtt.Connection, handler Handler) {
+	if fh, ok := handler.(FeatureHandler); ok {
+		fh.HandleWithFeatures(conn, c.Anonymous, c.Features)
+		return
+	}
+	handler.Handle(conn, c.Anonymous)
+}
+
+// handshake completes the tls handshake of the connection within the timeout of listener,
+// the connection is closed and false is returned if failed, the websocket connection is handshaken by http server
+func (m *Manager) handshake(c Listener, conn mqtt.Connection) bool {
+	nc, ok := conn.(interface{ UnderlyingConn() net.Conn })
+	if !ok {
+		return true
+	}
+	tc, ok := nc.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return true
+	}
+	err := tc.SetDeadline(time.Now().Add(c.HandshakeTimeout))
+	if err == nil {
+		err = tc.Handshake()
+	}
+	if err == nil {
+		// the read timeout is set by the handler later
+		err = tc.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		atomic.AddUint64(&m.handshakeFailed, 1)
+		m.log.Warn("connection is closed since tls handshake failed", log.Any("listener", c.Address), log.Any("remote", conn.RemoteAddr()), log.Error(err))
+		if err := conn.Close(); err != nil {
+			m.log.Debug("failed to close connection", log.Error(err))
+		}
+		return false
+	}
+	return true
+}
+
+// Rejected returns the number of connections rejected by the address filters
+func (m *Manager) Rejected() uint64 {
+	return atomic.LoadUint64(&m.rejected)
+}
+
+// HandshakeFailed returns the number of connections closed since the tls handshakes failed or timed out,
+// only the listeners with handshake timeout are counted, the handshakes of the other listeners are done by sessions
+// and counted in the tls connect failures of sessions instead, so the two counts never overlap
+func (m *Manager) HandshakeFailed() uint64 {
+	return atomic.LoadUint64(&m.handshakeFailed)
+}
+
 // Close closes listener
 func (m *Manager) Close() error {
 	m.log.Info("listener manager is closing")
@@ -112,3 +210,87 @@ func (m *Manager) Close() error {
 	}
 	return nil
 }
+
+// addrFilter permits or rejects connections by source ip, the deny list is checked first,
+// then the source ip must match the allow list if it is not empty
+type addrFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newAddrFilter(allow, deny []string) (*addrFilter, error) {
+	f := &addrFilter{}
+	var err error
+	f.allow, err = parseCIDRs(allow)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	f.deny, err = parseCIDRs(deny)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return f, nil
+}
+
+func (f *addrFilter) permit(addr net.Addr) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses CIDRs, a single ip is also supported
+func parseCIDRs(items []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.Errorf("invalid ip (%s)", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -3,6 +3,8 @@ package listener
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -328,6 +330,152 @@ func TestServerException(t *testing.T) {
 // 	return port
 // }
 
+func TestMqttTcpTlsHandshakeTimeout(t *testing.T) {
+	count := int32(0)
+	handler := newMockHandler(t)
+	handler.handle = func(conn mqtt.Connection) {
+		atomic.AddInt32(&count, 1)
+	}
+	cfg := []Listener{
+		{
+			Address:          "ssl://127.0.0.1:0",
+			HandshakeTimeout: time.Millisecond * 200,
+			Certificate: utils.Certificate{
+				CA:   "../example/var/lib/baetyl/testcert/ca.crt",
+				Key:  "../example/var/lib/baetyl/testcert/server.key",
+				Cert: "../example/var/lib/baetyl/testcert/server.crt",
+			},
+		},
+	}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	// the stalled handshakes are closed after the timeout without blocking each other
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", m.mqtts[0].Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	start := time.Now()
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	}
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, uint64(2), m.HandshakeFailed())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&count))
+}
+
+func TestMqttTcpAddrFilter(t *testing.T) {
+	count := int32(0)
+	handler := newMockHandler(t)
+	handler.handle = func(conn mqtt.Connection) {
+		atomic.AddInt32(&count, 1)
+		p, err := conn.Receive()
+		assert.NoError(t, err)
+		err = conn.Send(p, false)
+		assert.NoError(t, err)
+	}
+	cfg := []Listener{
+		{Address: "tcp://127.0.0.1:0", Allow: []string{"127.0.0.1"}},
+		{Address: "tcp://127.0.0.1:0", Deny: []string{"127.0.0.0/8"}},
+	}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(m.mqtts))
+	defer m.Close()
+
+	dailer := mqtt.NewDialer(nil, time.Duration(0))
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = t.Name()
+
+	// allowed
+	conn, err := dailer.Dial(getURL(m.mqtts[0], "tcp"))
+	assert.NoError(t, err)
+	err = conn.Send(pkt, false)
+	assert.NoError(t, err)
+	res, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, pkt.String(), res.String())
+	conn.Close()
+
+	// denied, the connection is closed before any packet is handled
+	conn, err = dailer.Dial(getURL(m.mqtts[1], "tcp"))
+	assert.NoError(t, err)
+	conn.Send(pkt, false)
+	res, err = conn.Receive()
+	assert.Error(t, err)
+	assert.Nil(t, res)
+	conn.Close()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	assert.Equal(t, uint64(1), m.Rejected())
+
+	_, err = NewManager([]Listener{{Address: "tcp://127.0.0.1:0", Deny: []string{"10.0.0.0/33"}}}, handler)
+	assert.EqualError(t, err, "invalid CIDR address: 10.0.0.0/33")
+	_, err = NewManager([]Listener{{Address: "tcp://127.0.0.1:0", Allow: []string{"10.0.0.x"}}}, handler)
+	assert.EqualError(t, err, "invalid ip (10.0.0.x)")
+}
+
+type mockFeatureHandler struct {
+	mockHandler
+	features chan Features
+}
+
+func (m *mockFeatureHandler) HandleWithFeatures(conn mqtt.Connection, anonymous bool, features Features) {
+	m.features <- features
+	m.Handle(conn, anonymous)
+}
+
+func TestMqttTcpFeatures(t *testing.T) {
+	handler := &mockFeatureHandler{mockHandler: *newMockHandler(t), features: make(chan Features, 1)}
+	maxQOS := uint32(0)
+	cfg := []Listener{
+		{Address: "tcp://127.0.0.1:0"},
+		{Address: "tcp://127.0.0.1:0", Features: Features{MaxQOS: &maxQOS, DisableRetain: true, DisableWildcard: true, DisableSharedSubscription: true}},
+	}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	dailer := mqtt.NewDialer(nil, time.Duration(0))
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = t.Name()
+	for i, c := range cfg {
+		conn, err := dailer.Dial(getURL(m.mqtts[i], "tcp"))
+		assert.NoError(t, err)
+		err = conn.Send(pkt, false)
+		assert.NoError(t, err)
+		_, err = conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, c.Features, <-handler.features)
+		conn.Close()
+	}
+}
+
+func TestAddrFilter(t *testing.T) {
+	f, err := newAddrFilter(nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, f.permit(&net.TCPAddr{IP: net.ParseIP("10.1.1.1")}))
+
+	f, err = newAddrFilter([]string{"10.0.0.0/8", "::1"}, []string{"10.1.0.0/16"})
+	assert.NoError(t, err)
+	assert.True(t, f.permit(&net.TCPAddr{IP: net.ParseIP("10.2.1.1")}))
+	assert.True(t, f.permit(&net.TCPAddr{IP: net.ParseIP("::1")}))
+	assert.False(t, f.permit(&net.TCPAddr{IP: net.ParseIP("10.1.1.1")}))
+	assert.False(t, f.permit(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}))
+	assert.False(t, f.permit(nil))
+
+	f, err = newAddrFilter(nil, []string{"192.168.1.1"})
+	assert.NoError(t, err)
+	assert.True(t, f.permit(&net.TCPAddr{IP: net.ParseIP("192.168.1.2")}))
+	assert.False(t, f.permit(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}))
+}
+
 func getURL(s mqtt.Server, protocol string) string {
 	return fmt.Sprintf("%s://%s", protocol, s.Addr().String())
 }
@@ -0,0 +1,136 @@
+package queue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// all errors of encoder
+var (
+	ErrEncryptionKeyNotFound = errors.New("encryption key not found")
+	ErrEncryptionKeyInvalid  = errors.New("encryption key should be base64 encoded 16, 24 or 32 bytes")
+	ErrEncryptedDataInvalid  = errors.New("encrypted data is invalid")
+)
+
+// the first byte of encrypted data, it never starts a message encoded by protobuf,
+// since it is the key of field 28 in fixed64 type, which must not be used by the fields added to messages
+const encryptedVersion = 0xe1
+
+// Encryption the config of payload encryption at rest, messages are encrypted by AES-GCM with the key of the id,
+// the other keys are kept to decrypt messages encrypted before key rotation, disabled if the id is empty
+type Encryption struct {
+	Key  string `yaml:"key,omitempty" json:"key,omitempty"`
+	Keys []Key  `yaml:"keys,omitempty" json:"keys,omitempty"`
+}
+
+// Key the encryption key
+type Key struct {
+	ID     string `yaml:"id" json:"id" validate:"nonzero"`
+	Secret string `yaml:"secret" json:"secret" validate:"nonzero"` // base64 encoded 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256
+}
+
+// Encoder encodes messages before storage and decodes messages read from storage, messages are encoded by protobuf,
+// so the fields added to messages by newer versions are skipped by the decoder of older versions, the core fields survive
+type Encoder interface {
+	Encode(*mqtt.Message) ([]byte, error)
+	Decode([]byte, *mqtt.Message) error
+}
+
+// NewEncoder creates a new encoder, messages are only encoded by protobuf if encryption is disabled
+func NewEncoder(cfg Encryption) (Encoder, error) {
+	if cfg.Key == "" {
+		return protoEncoder{}, nil
+	}
+	e := &aesEncoder{id: cfg.Key, keys: map[string]cipher.AEAD{}}
+	for _, k := range cfg.Keys {
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return nil, errors.Trace(ErrEncryptionKeyInvalid)
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, errors.Trace(ErrEncryptionKeyInvalid)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		e.keys[k.ID] = aead
+	}
+	if len(cfg.Key) > 255 || e.keys[cfg.Key] == nil {
+		return nil, errors.Trace(ErrEncryptionKeyNotFound)
+	}
+	return e, nil
+}
+
+type protoEncoder struct{}
+
+func (protoEncoder) Encode(m *mqtt.Message) ([]byte, error) {
+	data, err := proto.Marshal(m)
+	return data, errors.Trace(err)
+}
+
+func (protoEncoder) Decode(data []byte, m *mqtt.Message) error {
+	if len(data) > 0 && data[0] == encryptedVersion {
+		return errors.Trace(ErrEncryptionKeyNotFound)
+	}
+	return errors.Trace(proto.Unmarshal(data, m))
+}
+
+// aesEncoder encrypts messages encoded by protobuf, the encrypted data is
+// version (1 byte) + length of key id (1 byte) + key id + nonce + sealed message
+type aesEncoder struct {
+	id   string
+	keys map[string]cipher.AEAD
+}
+
+func (e *aesEncoder) Encode(m *mqtt.Message) ([]byte, error) {
+	plain, err := proto.Marshal(m)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	aead := e.keys[e.id]
+	header := 2 + len(e.id)
+	data := make([]byte, header+aead.NonceSize(), header+aead.NonceSize()+len(plain)+aead.Overhead())
+	data[0] = encryptedVersion
+	data[1] = byte(len(e.id))
+	copy(data[2:], e.id)
+	nonce := data[header:]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the header is authenticated as additional data
+	return aead.Seal(data, nonce, plain, data[:header]), nil
+}
+
+func (e *aesEncoder) Decode(data []byte, m *mqtt.Message) error {
+	// the messages stored before encryption enabled are not encrypted
+	if len(data) == 0 || data[0] != encryptedVersion {
+		return errors.Trace(proto.Unmarshal(data, m))
+	}
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return errors.Trace(ErrEncryptedDataInvalid)
+	}
+	header := 2 + int(data[1])
+	aead, ok := e.keys[string(data[2:header])]
+	if !ok {
+		return errors.Trace(ErrEncryptionKeyNotFound)
+	}
+	if len(data) < header+aead.NonceSize() {
+		return errors.Trace(ErrEncryptedDataInvalid)
+	}
+	nonce := data[header : header+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[header+aead.NonceSize():], data[:header])
+	if err != nil {
+		return errors.Trace(ErrEncryptedDataInvalid)
+	}
+	return errors.Trace(proto.Unmarshal(plain, m))
+}
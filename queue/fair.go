@@ -0,0 +1,182 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/baetyl/baetyl-go/v2/log"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// Fair is a temporary queue in memory delivering the messages of different topics in round robin,
+// so that a flood of one topic doesn't starve the others, the messages of the same topic are kept in order,
+// if the queue is full, the oldest message of the topic holding the most messages is dropped
+type Fair struct {
+	id       string
+	capacity int
+	count    int
+	topics   map[string][]*common.Event // topic -> messages in order
+	ring     []string                   // topics holding messages in round robin
+	events   chan *common.Event
+	notify   chan struct{}
+	quit     chan struct{}
+	mut      sync.Mutex
+	redact   common.Redaction
+	log      *log.Logger
+	once     sync.Once
+}
+
+// NewFair creates a new fair queue, the messages in logs are redacted by the redaction
+func NewFair(id string, capacity int, redact common.Redaction) Queue {
+	q := &Fair{
+		id:       id,
+		capacity: capacity,
+		topics:   make(map[string][]*common.Event),
+		// the next message is ready in the channel so that the receiver can tell more messages are pending
+		events: make(chan *common.Event, 1),
+		notify: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		redact: redact,
+		log:    log.With(log.Any("queue", "fair"), log.Any("id", id)),
+	}
+	go q.dispatching()
+	return q
+}
+
+// ID return id
+func (q *Fair) ID() string {
+	return q.id
+}
+
+// Chan returns message channel
+func (q *Fair) Chan() <-chan *common.Event {
+	return q.events
+}
+
+// Pop pops a message from queue
+func (q *Fair) Pop() (*common.Event, error) {
+	select {
+	case e := <-q.events:
+		return e, nil
+	case <-q.quit:
+		return nil, ErrQueueClosed
+	}
+}
+
+// Disable disable
+func (q *Fair) Disable() {}
+
+// Push pushes a message to queue
+func (q *Fair) Push(e *common.Event) error {
+	defer e.Done()
+	select {
+	case <-q.quit:
+		return ErrQueueClosed
+	default:
+	}
+
+	q.mut.Lock()
+	if q.count >= q.capacity {
+		q.evict()
+	}
+	topic := e.Context.Topic
+	evts, ok := q.topics[topic]
+	if !ok {
+		q.ring = append(q.ring, topic)
+	}
+	q.topics[topic] = append(evts, e)
+	q.count++
+	q.mut.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	if ent := q.log.Check(log.DebugLevel, "queue pushed a message"); ent != nil {
+		ent.Write(log.Any("message", q.redact.FormatMessage(e.Message)))
+	}
+	return nil
+}
+
+// Close closes this queue
+func (q *Fair) Close(_ bool) error {
+	q.log.Debug("queue is closing")
+	defer q.log.Debug("queue has closed")
+
+	q.once.Do(func() {
+		close(q.quit)
+	})
+	return nil
+}
+
+func (q *Fair) dispatching() {
+	for {
+		e := q.next()
+		if e == nil {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.quit:
+				return
+			}
+		}
+		select {
+		case q.events <- e:
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// next removes the first message of the next topic in round robin, returns nil if empty
+func (q *Fair) next() *common.Event {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if len(q.ring) == 0 {
+		return nil
+	}
+	topic := q.ring[0]
+	q.ring = q.ring[1:]
+	evts := q.topics[topic]
+	e := evts[0]
+	evts[0] = nil
+	if len(evts) == 1 {
+		delete(q.topics, topic)
+	} else {
+		q.topics[topic] = evts[1:]
+		q.ring = append(q.ring, topic)
+	}
+	q.count--
+	return e
+}
+
+// evict drops the oldest message of the topic holding the most messages
+func (q *Fair) evict() {
+	max := ""
+	for topic, evts := range q.topics {
+		if len(evts) > len(q.topics[max]) {
+			max = topic
+		}
+	}
+	evts, ok := q.topics[max]
+	if !ok {
+		return
+	}
+	if ent := q.log.Check(log.DebugLevel, "queue dropped a message"); ent != nil {
+		ent.Write(log.Any("message", q.redact.FormatMessage(evts[0].Message)))
+	}
+	evts[0] = nil
+	if len(evts) == 1 {
+		delete(q.topics, max)
+		for i, topic := range q.ring {
+			if topic == max {
+				q.ring = append(q.ring[:i], q.ring[i+1:]...)
+				break
+			}
+		}
+	} else {
+		q.topics[max] = evts[1:]
+	}
+	q.count--
+}
@@ -11,21 +11,23 @@ import (
 
 	"github.com/baetyl/baetyl-broker/v2/common"
 	"github.com/baetyl/baetyl-broker/v2/store"
-
-	"github.com/gogo/protobuf/proto"
 )
 
 // Config queue config
 type Config struct {
-	Name          string        `yaml:"name" json:"name"`
-	BatchSize     int           `yaml:"batchSize" json:"batchSize" default:"10"`
-	ExpireTime    time.Duration `yaml:"expireTime" json:"expireTime" default:"168h"`
-	CleanInterval time.Duration `yaml:"cleanInterval" json:"cleanInterval" default:"1h"`
-	WriteTimeout  time.Duration `yaml:"writeTimeout" json:"writeTimeout" default:"100ms"`
-	DeleteTimeout time.Duration `yaml:"deleteTimeout" json:"deleteTimeout" default:"500ms"`
+	Name          string           `yaml:"name" json:"name"`
+	BatchSize     int              `yaml:"batchSize" json:"batchSize" default:"10"`
+	ExpireTime    time.Duration    `yaml:"expireTime" json:"expireTime" default:"168h"`
+	CleanInterval time.Duration    `yaml:"cleanInterval" json:"cleanInterval" default:"1h"`
+	WriteTimeout  time.Duration    `yaml:"writeTimeout" json:"writeTimeout" default:"100ms"`
+	DeleteTimeout time.Duration    `yaml:"deleteTimeout" json:"deleteTimeout" default:"500ms"`
+	Encryption    Encryption       `yaml:"encryption,omitempty" json:"encryption,omitempty"`
+	Redaction     common.Redaction `yaml:"-" json:"-"` // redacts the messages in logs, set by the session
 }
 
-// Persistence is a persistent queue
+// Persistence is a persistent queue, popping a message only advances the read position in memory,
+// the message is kept in the bucket until acknowledged, so the one popped but not acknowledged before crash
+// is recovered after restarting, the acknowledgement is the durable commit
 type Persistence struct {
 	id              string
 	cfg             Config
@@ -33,8 +35,12 @@ type Persistence struct {
 	events          chan *common.Event
 	edel            chan uint64 // del events with message id
 	bucket          store.BatchBucket
+	encoder         Encoder
 	recovering      bool
 	recoveredOffset uint64
+	acked           uint64    // offset of the latest acknowledged message
+	expiry          time.Time // the wall clock time before which messages are expired
+	cleaned         time.Time // the monotonic time when the expiry is calculated
 	disable         bool
 	log             *log.Logger
 	utils.Tomb
@@ -57,6 +63,10 @@ func (c *counter) Next() uint64 {
 
 // NewPersistence creates a new persistent queue
 func NewPersistence(cfg Config, bucket store.BatchBucket) (Queue, error) {
+	encoder, err := NewEncoder(cfg.Encryption)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	offset, err := bucket.MaxOffset()
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -64,11 +74,24 @@ func NewPersistence(cfg Config, bucket store.BatchBucket) (Queue, error) {
 	c := &counter{
 		offset: offset,
 	}
+	// the messages before the first one in db are acknowledged
+	acked := offset
+	err = bucket.Get(1, 1, func(_ []byte, first uint64) error {
+		acked = first - 1
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	q := &Persistence{
 		id:         cfg.Name,
 		bucket:     bucket,
+		encoder:    encoder,
 		counter:    c,
+		acked:      acked,
+		expiry:     common.Now().Add(-cfg.ExpireTime),
+		cleaned:    time.Now(),
 		recovering: true,
 		cfg:        cfg,
 		events:     make(chan *common.Event, cfg.BatchSize),
@@ -95,7 +118,7 @@ func (q *Persistence) Pop() (*common.Event, error) {
 	select {
 	case e := <-q.events:
 		if ent := q.log.Check(log.DebugLevel, "queue poped a message"); ent != nil {
-			ent.Write(log.Any("message", e.String()))
+			ent.Write(log.Any("message", q.cfg.Redaction.FormatMessage(e.Message)))
 		}
 		return e, nil
 	case <-q.Dying():
@@ -142,7 +165,7 @@ func (q *Persistence) Push(e *common.Event) (err error) {
 	select {
 	case q.events <- ee:
 		if ent := q.log.Check(log.DebugLevel, "queue pushed a message"); ent != nil {
-			ent.Write(log.Any("message", ee.String()))
+			ent.Write(log.Any("message", q.cfg.Redaction.FormatMessage(ee.Message)))
 		}
 		return nil
 	case <-q.Dying():
@@ -177,7 +200,7 @@ func (q *Persistence) recovery() error {
 			select {
 			case q.events <- e:
 				if ent := q.log.Check(log.DebugLevel, "queue pushed a message"); ent != nil {
-					ent.Write(log.Any("message", e.String()))
+					ent.Write(log.Any("message", q.cfg.Redaction.FormatMessage(e.Message)))
 				}
 			case <-q.Dying():
 				return nil
@@ -219,6 +242,10 @@ func (q *Persistence) deleting() error {
 			//q.log.Info(fmt.Sprintf("queue state: input size %d, events size %d, deletion size %d", len(q.input), len(q.events), len(q.edel)))
 		case <-q.Dying():
 			q.log.Debug("queue deletes message from db during closing")
+			// the acknowledgements already received are deleted too
+			for len(q.edel) > 0 {
+				buf = append(buf, <-q.edel)
+			}
 			buf = q.delete(buf)
 			return nil
 		}
@@ -235,7 +262,7 @@ func (q *Persistence) get(offset uint64, length int) ([]*common.Event, error) {
 			return store.ErrDataNotFound
 		}
 		v := new(mqtt.Message)
-		err := proto.Unmarshal(data, v)
+		err := q.encoder.Decode(data, v)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -261,14 +288,14 @@ func (q *Persistence) get(offset uint64, length int) ([]*common.Event, error) {
 // add all buffered messages to db in batch mode
 func (q *Persistence) add(event *common.Event) error {
 	if ent := q.log.Check(log.DebugLevel, "queue received a message"); ent != nil {
-		ent.Write(log.Any("event", event.String()))
+		ent.Write(log.Any("event", q.cfg.Redaction.FormatMessage(event.Message)))
 	}
 	if event == nil {
 		return nil
 	}
-	defer utils.Trace(q.log.Debug, "queue has written message to db", log.Any("msg", event))()
+	defer utils.Trace(q.log.Debug, "queue has written message to db", log.Any("msg", common.LogMessage{Message: event.Message, Redaction: q.cfg.Redaction}))()
 
-	data, err := proto.Marshal(event.Message)
+	data, err := q.encoder.Encode(event.Message)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -295,14 +322,43 @@ func (q *Persistence) delete(buf []uint64) []uint64 {
 // clean expired messages
 func (q *Persistence) clean() {
 	defer utils.Trace(q.log.Debug, "queue has cleaned expired messages from db")
-	err := q.bucket.DelBeforeTS(uint64(time.Now().Add(-q.cfg.ExpireTime).Unix()))
+	err := q.bucket.DelBeforeTS(uint64(q.nextExpiry().Unix()))
 	if err != nil {
 		q.log.Error("failed to clean expired messages from db", log.Error(err))
 	}
 }
 
+// nextExpiry calculates the time before which messages are expired, it advances at most by the monotonic time
+// elapsed since the last calculation, so that a forward jump of the wall clock won't expire all messages,
+// and it follows the wall clock if jumps backward, so that messages are kept longer rather than expired early
+func (q *Persistence) nextExpiry() time.Time {
+	now := time.Now()
+	expiry := common.Now().Add(-q.cfg.ExpireTime)
+	if max := q.expiry.Add(now.Sub(q.cleaned)); expiry.After(max) {
+		q.log.Debug("the wall clock jumps forward, the expiry of messages is clamped", log.Any("jump", expiry.Sub(max)))
+		expiry = max
+	}
+	q.expiry, q.cleaned = expiry, now
+	return expiry
+}
+
+// Offsets returns the offset of the latest pushed message and the offset of the latest acknowledged message
+func (q *Persistence) Offsets() (uint64, uint64) {
+	q.counter.Lock()
+	latest := q.counter.offset
+	q.counter.Unlock()
+	q.Lock()
+	defer q.Unlock()
+	return latest, q.acked
+}
+
 // acknowledge all acknowledged message from db in batch mode
 func (q *Persistence) acknowledge(id uint64) {
+	q.Lock()
+	if id > q.acked {
+		q.acked = id
+	}
+	q.Unlock()
 	select {
 	case q.edel <- id:
 	case <-q.Dying():
@@ -18,3 +18,9 @@ type Queue interface {
 	Disable()
 	Close(bool) error
 }
+
+// OffsetReporter the queue reporting its offsets
+type OffsetReporter interface {
+	// Offsets returns the offset of the latest pushed message and the offset of the latest acknowledged message
+	Offsets() (latest, acked uint64)
+}
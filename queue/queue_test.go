@@ -8,10 +8,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
 	"github.com/gogo/protobuf/proto"
@@ -24,7 +26,7 @@ import (
 )
 
 func TestTemporaryQueue(t *testing.T) {
-	b := NewTemporary(t.Name(), 100, true)
+	b := NewTemporary(t.Name(), 100, true, common.Redaction{})
 	assert.NotNil(t, b)
 	defer b.Close(true)
 
@@ -53,6 +55,124 @@ func TestTemporaryQueue(t *testing.T) {
 	assert.Equal(t, "Context:<ID:111 TS:123 QOS:1 Topic:\"t\" > Content:\"hi\" ", e.String())
 }
 
+func TestFairQueue(t *testing.T) {
+	b := NewFair(t.Name(), 10, common.Redaction{})
+	assert.NotNil(t, b)
+	defer b.Close(true)
+
+	push := func(topic string, id uint64) {
+		m := new(mqtt.Message)
+		m.Context.ID = id
+		m.Context.Topic = topic
+		assert.NoError(t, b.Push(common.NewEvent(m, 0, nil)))
+	}
+	for i := uint64(1); i <= 20; i++ {
+		push("flood", i)
+	}
+	push("quiet", 100)
+
+	// at most two flood messages are dispatched before the quiet one
+	var ids []uint64
+	quiet := -1
+	for {
+		select {
+		case e := <-b.Chan():
+			if e.Context.Topic == "quiet" {
+				quiet = len(ids)
+			}
+			ids = append(ids, e.Context.ID)
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+	assert.True(t, quiet >= 0 && quiet <= 2, "%v", ids)
+	// the oldest flood messages beyond the capacity are dropped, the rest are in order
+	assert.True(t, len(ids) <= 12, "%v", ids)
+	assert.Equal(t, uint64(20), ids[len(ids)-1])
+	for i := 1; i < len(ids); i++ {
+		if i != quiet && i-1 != quiet {
+			assert.True(t, ids[i-1] < ids[i], "%v", ids)
+		}
+	}
+
+	assert.NoError(t, b.Close(true))
+	_, err := b.Pop()
+	assert.Equal(t, ErrQueueClosed, err)
+	m := new(mqtt.Message)
+	assert.Equal(t, ErrQueueClosed, b.Push(common.NewEvent(m, 0, nil)))
+}
+
+func TestSpillingQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	defer db.Close()
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+
+	b, err := NewSpilling(t.Name(), 2, bucket, protoEncoder{}, 5, common.Redaction{})
+	assert.NoError(t, err)
+	defer b.Close(true)
+
+	push := func(id uint64) {
+		m := new(mqtt.Message)
+		m.Context.ID = id
+		m.Context.Topic = "t"
+		assert.NoError(t, b.Push(common.NewEvent(m, 0, nil)))
+	}
+	pop := func() []uint64 {
+		var ids []uint64
+		for {
+			select {
+			case e := <-b.Chan():
+				ids = append(ids, e.Context.ID)
+				continue
+			case <-time.After(100 * time.Millisecond):
+			}
+			return ids
+		}
+	}
+
+	// 2 messages in memory, 5 messages spilled, the rest are dropped
+	for i := uint64(1); i <= 10; i++ {
+		push(i)
+	}
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7}, pop())
+	offset, err := bucket.MaxOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), offset)
+
+	// the messages are put into memory again after the spilled ones are drained
+	push(11)
+	push(12)
+	assert.Equal(t, []uint64{11, 12}, pop())
+
+	// the messages pushed during draining are spilled after the previous ones to keep the order
+	for i := uint64(13); i <= 17; i++ {
+		push(i)
+	}
+	e, err := b.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(13), e.Context.ID)
+	push(18)
+	assert.Equal(t, []uint64{14, 15, 16, 17, 18}, pop())
+
+	// the spilled messages are cleaned when closed
+	for i := uint64(19); i <= 24; i++ {
+		push(i)
+	}
+	assert.NoError(t, b.Close(true))
+	offset, err = bucket.MaxOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), offset)
+	m := new(mqtt.Message)
+	assert.Equal(t, ErrQueueClosed, b.Push(common.NewEvent(m, 0, nil)))
+}
+
 func TestPersistentQueue(t *testing.T) {
 	dir, err := ioutil.TempDir("", t.Name())
 	assert.NoError(t, err)
@@ -181,6 +301,389 @@ func TestPersistentQueue(t *testing.T) {
 	//assert.NoError(t, err)
 }
 
+func TestPersistentQueueOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+
+	var cfg Config
+	utils.SetDefaults(&cfg)
+	cfg.Name = t.Name()
+	cfg.DeleteTimeout = time.Millisecond * 10
+
+	b, err := NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	latest, acked := b.(OffsetReporter).Offsets()
+	assert.Equal(t, uint64(0), latest)
+	assert.Equal(t, uint64(0), acked)
+
+	for i := 0; i < 3; i++ {
+		m := new(mqtt.Message)
+		m.Context.QOS = 1
+		m.Context.Topic = "t"
+		assert.NoError(t, b.Push(common.NewEvent(m, 0, nil)))
+	}
+	latest, acked = b.(OffsetReporter).Offsets()
+	assert.Equal(t, uint64(3), latest)
+	assert.Equal(t, uint64(0), acked)
+
+	e, err := b.Pop()
+	assert.NoError(t, err)
+	e.Done()
+	latest, acked = b.(OffsetReporter).Offsets()
+	assert.Equal(t, uint64(3), latest)
+	assert.Equal(t, uint64(1), acked)
+
+	// the acknowledged message is deleted from db, offsets are recovered
+	time.Sleep(time.Millisecond * 100)
+	assert.NoError(t, b.Close(false))
+	b, err = NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	defer b.Close(true)
+	latest, acked = b.(OffsetReporter).Offsets()
+	assert.Equal(t, uint64(3), latest)
+	assert.Equal(t, uint64(1), acked)
+}
+
+func TestPersistentQueuePoppedNotAcknowledged(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+
+	var cfg Config
+	utils.SetDefaults(&cfg)
+	cfg.Name = t.Name()
+	cfg.DeleteTimeout = time.Millisecond * 10
+
+	b, err := NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	for i := 1; i <= 3; i++ {
+		m := new(mqtt.Message)
+		m.Context.QOS = 1
+		m.Context.Topic = "t"
+		m.Content = []byte{byte(i)}
+		assert.NoError(t, b.Push(common.NewEvent(m, 0, nil)))
+	}
+
+	// the first message is acknowledged, the second is popped but not acknowledged before crash
+	e, err := b.Pop()
+	assert.NoError(t, err)
+	e.Done()
+	e, err = b.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), e.Context.ID)
+	time.Sleep(time.Millisecond * 100)
+	assert.NoError(t, b.Close(false))
+
+	// the message popped is recovered after restarting
+	b, err = NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	defer b.Close(true)
+	for i := 2; i <= 3; i++ {
+		e, err = b.Pop()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), e.Context.ID)
+		assert.Equal(t, []byte{byte(i)}, e.Content)
+	}
+}
+
+// the messages pushed, delivered and acknowledged during cleaning are neither lost nor read after deleted
+func TestPersistentQueueCleanConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+
+	var cfg Config
+	utils.SetDefaults(&cfg)
+	cfg.Name = t.Name()
+	cfg.BatchSize = 5
+	cfg.DeleteTimeout = time.Millisecond
+	cfg.CleanInterval = time.Millisecond
+
+	b, err := NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+
+	const total, unacked = 1000, 10
+	go func() {
+		for i := 1; i <= total; i++ {
+			m := new(mqtt.Message)
+			m.Context.QOS = 1
+			m.Context.Topic = "t"
+			m.Content = []byte(strconv.Itoa(i))
+			assert.NoError(t, b.Push(common.NewEvent(m, 0, nil)))
+		}
+	}()
+	// the last messages are delivered but not acknowledged
+	for i := 1; i <= total; i++ {
+		e, err := b.Pop()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), e.Context.ID)
+		assert.Equal(t, strconv.Itoa(i), string(e.Content))
+		if i <= total-unacked {
+			e.Done()
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	latest, acked := b.(OffsetReporter).Offsets()
+	assert.Equal(t, uint64(total), latest)
+	assert.Equal(t, uint64(total-unacked), acked)
+	assert.NoError(t, b.Close(false))
+
+	// the messages not acknowledged are kept and recovered in order
+	b, err = NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	defer b.Close(true)
+	latest, acked = b.(OffsetReporter).Offsets()
+	assert.Equal(t, uint64(total), latest)
+	assert.Equal(t, uint64(total-unacked), acked)
+	for i := total - unacked + 1; i <= total; i++ {
+		e, err := b.Pop()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), e.Context.ID)
+		assert.Equal(t, strconv.Itoa(i), string(e.Content))
+	}
+	select {
+	case e := <-b.Chan():
+		assert.Fail(t, "unexpected message", e.String())
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPersistentQueueClockJump(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+
+	var cfg Config
+	utils.SetDefaults(&cfg)
+	cfg.Name = t.Name()
+	cfg.ExpireTime = time.Hour
+
+	b, err := NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	defer b.Close(true)
+	q := b.(*Persistence)
+
+	for i := 0; i < 3; i++ {
+		m := new(mqtt.Message)
+		m.Context.QOS = 1
+		m.Context.Topic = "t"
+		m.Context.TS = uint64(common.Now().UnixNano())
+		assert.NoError(t, b.Push(common.NewEvent(m, 0, nil)))
+	}
+	count := func() int {
+		n := 0
+		assert.NoError(t, bucket.Get(1, 10, func(_ []byte, _ uint64) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+
+	// the wall clock jumps forward, no message is expired
+	restore := common.SetClock(func() time.Time { return time.Now().Add(time.Hour * 2) })
+	q.clean()
+	assert.Equal(t, 3, count())
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), q.expiry, time.Second)
+	restore()
+
+	// the wall clock jumps backward, the expiry follows
+	restore = common.SetClock(func() time.Time { return time.Now().Add(-time.Hour * 2) })
+	q.clean()
+	assert.Equal(t, 3, count())
+	assert.WithinDuration(t, time.Now().Add(-time.Hour*3), q.expiry, time.Second)
+	restore()
+
+	// the wall clock recovers, the expiry advances by the monotonic time since last calculation
+	q.clean()
+	assert.Equal(t, 3, count())
+	assert.WithinDuration(t, time.Now().Add(-time.Hour*3), q.expiry, time.Second)
+
+	// the age of message stamped by a skewed clock is clamped to zero
+	m := new(mqtt.Message)
+	m.Context.TS = uint64(time.Now().Add(time.Hour).UnixNano())
+	assert.Equal(t, time.Duration(0), common.Elapsed(m.Context.TS))
+	e := common.NewEvent(m, 0, nil)
+	assert.True(t, e.Age() < time.Second)
+	m.Context.TS = uint64(time.Now().Add(-time.Hour).UnixNano())
+	e = common.NewEvent(m, 0, nil)
+	assert.True(t, e.Age() >= time.Hour)
+
+	// the age is measured by the monotonic clock after the event is created
+	restore = common.SetClock(func() time.Time { return time.Now().Add(time.Hour * 2) })
+	assert.True(t, e.Age() < time.Hour+time.Second)
+	restore()
+}
+
+func TestEncoder(t *testing.T) {
+	k1 := Key{ID: "k1", Secret: "MDEyMzQ1Njc4OWFiY2RlZg=="}
+	k2 := Key{ID: "k2", Secret: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}
+
+	m := new(mqtt.Message)
+	m.Context.QOS = 1
+	m.Context.Topic = "t"
+	m.Content = []byte("secret payload")
+
+	plain, err := NewEncoder(Encryption{})
+	assert.NoError(t, err)
+	pd, err := plain.Encode(m)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(pd, m.Content))
+
+	e1, err := NewEncoder(Encryption{Key: "k1", Keys: []Key{k1}})
+	assert.NoError(t, err)
+	d1, err := e1.Encode(m)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(d1, m.Content))
+	v := new(mqtt.Message)
+	assert.NoError(t, e1.Decode(d1, v))
+	assert.Equal(t, m.String(), v.String())
+
+	// the messages stored before encryption enabled are decoded
+	v = new(mqtt.Message)
+	assert.NoError(t, e1.Decode(pd, v))
+	assert.Equal(t, m.String(), v.String())
+	// the encrypted messages are not decoded without encryption
+	assert.Equal(t, ErrEncryptionKeyNotFound, errors.Cause(plain.Decode(d1, v)))
+
+	// key rotation
+	e2, err := NewEncoder(Encryption{Key: "k2", Keys: []Key{k1, k2}})
+	assert.NoError(t, err)
+	d2, err := e2.Encode(m)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(d2, m.Content))
+	for _, d := range [][]byte{d1, d2} {
+		v = new(mqtt.Message)
+		assert.NoError(t, e2.Decode(d, v))
+		assert.Equal(t, m.String(), v.String())
+	}
+	assert.Equal(t, ErrEncryptionKeyNotFound, errors.Cause(e1.Decode(d2, v)))
+
+	// the tampered data is rejected
+	d2[len(d2)-1] ^= 0xff
+	assert.Equal(t, ErrEncryptedDataInvalid, errors.Cause(e2.Decode(d2, v)))
+	assert.Equal(t, ErrEncryptedDataInvalid, errors.Cause(e2.Decode(d2[:5], v)))
+
+	_, err = NewEncoder(Encryption{Key: "k3", Keys: []Key{k1, k2}})
+	assert.Equal(t, ErrEncryptionKeyNotFound, errors.Cause(err))
+	_, err = NewEncoder(Encryption{Key: "k1", Keys: []Key{{ID: "k1", Secret: "MDEy"}}})
+	assert.Equal(t, ErrEncryptionKeyInvalid, errors.Cause(err))
+	_, err = NewEncoder(Encryption{Key: "k1", Keys: []Key{{ID: "k1", Secret: "!"}}})
+	assert.Equal(t, ErrEncryptionKeyInvalid, errors.Cause(err))
+}
+
+func TestEncoderUnknownFields(t *testing.T) {
+	m := new(mqtt.Message)
+	m.Context.ID = 7
+	m.Context.QOS = 1
+	m.Context.Topic = "t"
+	m.Content = []byte("payload")
+
+	// the message encoded by a newer version with a field added to the context and two added to the message
+	ctx, err := proto.Marshal(&m.Context)
+	assert.NoError(t, err)
+	ctx = append(ctx, 15<<3, 42)
+	var data []byte
+	data = append(data, 1<<3|2)
+	data = append(data, proto.EncodeVarint(uint64(len(ctx)))...)
+	data = append(data, ctx...)
+	data = append(data, 2<<3|2, byte(len(m.Content)))
+	data = append(data, m.Content...)
+	data = append(data, proto.EncodeVarint(16<<3|2)...)
+	data = append(data, 3, 'n', 'e', 'w')
+	data = append(data, proto.EncodeVarint(17<<3|0)...)
+	data = append(data, 1)
+
+	k1 := Key{ID: "k1", Secret: "MDEyMzQ1Njc4OWFiY2RlZg=="}
+	aes, err := NewEncoder(Encryption{Key: "k1", Keys: []Key{k1}})
+	assert.NoError(t, err)
+	for _, e := range []Encoder{protoEncoder{}, aes} {
+		v := new(mqtt.Message)
+		assert.NoError(t, e.Decode(data, v))
+		assert.Equal(t, m.String(), v.String())
+	}
+}
+
+func TestPersistentQueueEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+
+	k1 := Key{ID: "k1", Secret: "MDEyMzQ1Njc4OWFiY2RlZg=="}
+	k2 := Key{ID: "k2", Secret: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}
+	var cfg Config
+	utils.SetDefaults(&cfg)
+	cfg.Name = t.Name()
+	cfg.Encryption = Encryption{Key: "k1", Keys: []Key{k1}}
+
+	b, err := NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	m := new(mqtt.Message)
+	m.Context.QOS = 1
+	m.Context.Topic = "t"
+	m.Content = []byte("secret payload")
+	assert.NoError(t, b.Push(common.NewEvent(m, 0, nil)))
+
+	// the stored bytes are ciphertext
+	assert.NoError(t, bucket.Get(1, 1, func(data []byte, _ uint64) error {
+		assert.False(t, bytes.Contains(data, m.Content))
+		return nil
+	}))
+	e, err := b.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "Context:<ID:1 QOS:1 Topic:\"t\" > Content:\"secret payload\" ", e.String())
+	assert.NoError(t, b.Close(false))
+
+	// the message encrypted by the old key is decrypted after key rotation
+	cfg.Encryption = Encryption{Key: "k2", Keys: []Key{k1, k2}}
+	b, err = NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	defer b.Close(true)
+	e, err = b.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "Context:<ID:1 QOS:1 Topic:\"t\" > Content:\"secret payload\" ", e.String())
+
+	// the invalid key is rejected
+	cfg.Encryption = Encryption{Key: "k3", Keys: []Key{k1, k2}}
+	_, err = NewPersistence(cfg, bucket)
+	assert.Equal(t, ErrEncryptionKeyNotFound, errors.Cause(err))
+}
+
 func BenchmarkPersistentQueue(b *testing.B) {
 	dir, err := ioutil.TempDir("", b.Name())
 	assert.NoError(b, err)
@@ -272,7 +775,7 @@ func BenchmarkPersistentQueueParallel(b *testing.B) {
 }
 
 func BenchmarkTemporaryQueueParallel(b *testing.B) {
-	q := NewTemporary(b.Name(), 100, true)
+	q := NewTemporary(b.Name(), 100, true, common.Redaction{})
 	assert.NotNil(b, q)
 	defer q.Close(false)
 
@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+	"github.com/baetyl/baetyl-broker/v2/store"
+)
+
+// spill the bounded overflow of the temporary queue on disk, the messages pushed when the queue is full
+// are written to the bucket and read back in order as the queue drains, the messages beyond the max count are dropped,
+// the spilled messages are not kept across the queue, so the bucket is cleaned when created and closed
+type spill struct {
+	bucket  store.BatchBucket
+	encoder Encoder
+	max     uint64
+	head    uint64 // offset of the next message to read
+	tail    uint64 // offset of the last message written
+	notify  chan struct{}
+	done    chan struct{}
+	closed  bool
+	mut     sync.Mutex
+}
+
+// NewSpilling creates a new temporary queue spilling the messages to the bucket instead of dropping them when full,
+// at most max messages are spilled, the messages beyond are dropped
+func NewSpilling(id string, capacity int, bucket store.BatchBucket, encoder Encoder, max int, redact common.Redaction) (Queue, error) {
+	offset, err := bucket.MaxOffset()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the messages left by the previous process are dropped, as if they were in memory
+	err = bucket.DelBeforeID(offset)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	q := NewTemporary(id, capacity, true, redact).(*Temporary)
+	q.spill = &spill{
+		bucket:  bucket,
+		encoder: encoder,
+		max:     uint64(max),
+		head:    offset + 1,
+		tail:    offset,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	q.push = q.putOrSpill
+	go q.draining()
+	return q, nil
+}
+
+// putOrSpill puts the message into the queue if no message is spilled, otherwise spills the message to keep the order
+func (q *Temporary) putOrSpill(e *common.Event) error {
+	s := q.spill
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.closed {
+		return ErrQueueClosed
+	}
+	if s.head > s.tail {
+		select {
+		case q.events <- e:
+			if ent := q.log.Check(log.DebugLevel, "queue pushed a message"); ent != nil {
+				ent.Write(log.Any("message", q.redact.FormatMessage(e.Message)))
+			}
+			return nil
+		default:
+		}
+	}
+	if s.tail-s.head+1 >= s.max {
+		if ent := q.log.Check(log.DebugLevel, "queue dropped a message"); ent != nil {
+			ent.Write(log.Any("message", q.redact.FormatMessage(e.Message)))
+		}
+		return nil
+	}
+	data, err := s.encoder.Encode(e.Message)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = s.bucket.Set(s.tail+1, data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.tail++
+	if ent := q.log.Check(log.DebugLevel, "queue spilled a message"); ent != nil {
+		ent.Write(log.Any("message", q.redact.FormatMessage(e.Message)))
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// draining reads the spilled messages back into the queue in batch as the queue drains
+func (q *Temporary) draining() {
+	s := q.spill
+	defer close(s.done)
+
+	for {
+		msgs, last, err := s.read(cap(q.events))
+		if err != nil {
+			q.log.Error("failed to read spilled messages", log.Error(err))
+		}
+		if len(msgs) == 0 {
+			select {
+			case <-s.notify:
+				continue
+			case <-q.quit:
+				return
+			}
+		}
+		for _, m := range msgs {
+			select {
+			case q.events <- common.NewEvent(m, 0, nil):
+			case <-q.quit:
+				return
+			}
+		}
+		s.mut.Lock()
+		s.head = last + 1
+		err = s.bucket.DelBeforeID(last)
+		s.mut.Unlock()
+		if err != nil {
+			q.log.Error("failed to delete spilled messages", log.Error(err))
+		}
+	}
+}
+
+// read reads at most length spilled messages from the head, and returns the offset of the last one
+func (s *spill) read(length int) ([]*mqtt.Message, uint64, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.closed || s.head > s.tail {
+		return nil, 0, nil
+	}
+	var msgs []*mqtt.Message
+	var last uint64
+	err := s.bucket.Get(s.head, length, func(data []byte, offset uint64) error {
+		v := new(mqtt.Message)
+		if err := s.encoder.Decode(data, v); err != nil {
+			return errors.Trace(err)
+		}
+		msgs = append(msgs, v)
+		last = offset
+		return nil
+	})
+	if err != nil {
+		// the spilled messages are dropped if unreadable
+		s.head = s.tail + 1
+		s.bucket.DelBeforeID(s.tail)
+		return nil, 0, errors.Trace(err)
+	}
+	return msgs, last, nil
+}
+
+// close stops draining and cleans the spilled messages
+func (s *spill) close() error {
+	<-s.done
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.closed = true
+	return errors.Trace(s.bucket.Close(true))
+}
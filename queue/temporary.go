@@ -13,16 +13,19 @@ type Temporary struct {
 	id     string
 	events chan *common.Event
 	push   func(*common.Event) error
+	spill  *spill // the overflow on disk, nil if the messages are dropped or blocked when full
 	quit   chan bool
+	redact common.Redaction
 	log    *log.Logger
 	sync.Once
 }
 
-// NewTemporary creates a new temporary queue
-func NewTemporary(id string, capacity int, dropIfFull bool) Queue {
+// NewTemporary creates a new temporary queue, the messages in logs are redacted by the redaction
+func NewTemporary(id string, capacity int, dropIfFull bool, redact common.Redaction) Queue {
 	q := &Temporary{
 		events: make(chan *common.Event, capacity),
 		quit:   make(chan bool),
+		redact: redact,
 		log:    log.With(log.Any("queue", "temporary"), log.Any("id", id)),
 	}
 	if dropIfFull {
@@ -75,14 +78,14 @@ func (q *Temporary) putOrDrop(e *common.Event) error {
 	select {
 	case q.events <- e:
 		if ent := q.log.Check(log.DebugLevel, "queue pushed a message"); ent != nil {
-			ent.Write(log.Any("message", e.String()))
+			ent.Write(log.Any("message", q.redact.FormatMessage(e.Message)))
 		}
 		return nil
 	case <-q.quit:
 		return ErrQueueClosed
 	default:
 		if ent := q.log.Check(log.DebugLevel, "queue dropped a message"); ent != nil {
-			ent.Write(log.Any("message", e.String()))
+			ent.Write(log.Any("message", q.redact.FormatMessage(e.Message)))
 		}
 		return nil
 	}
@@ -92,5 +95,14 @@ func (q *Temporary) putOrDrop(e *common.Event) error {
 func (q *Temporary) Close(_ bool) error {
 	q.log.Debug("queue is closing")
 	defer q.log.Debug("queue has closed")
-	return nil
+
+	// releases the pushes and pops blocked, the messages left are dropped with the queue
+	var err error
+	q.Do(func() {
+		close(q.quit)
+		if q.spill != nil {
+			err = q.spill.close()
+		}
+	})
+	return err
 }
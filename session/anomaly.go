@@ -0,0 +1,150 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// the rates tracked over the sliding window
+const (
+	RateConnects     = "connects"
+	RateAuthFailures = "authFailures"
+	RateDisconnects  = "disconnects"
+)
+
+// slots of the sliding window, the counts expire by slot
+const anomalySlots = 10
+
+// AnomalyAlert the rate crossing its threshold within the sliding window
+type AnomalyAlert struct {
+	Rate      string        `json:"rate"`
+	Count     uint64        `json:"count"`
+	Threshold int           `json:"threshold"`
+	Window    time.Duration `json:"window"`
+}
+
+// AnomalyHook is called when a rate crosses its threshold, it is called again only after the rate falls back,
+// it is called in the goroutine of the connection, so it should return quickly
+type AnomalyHook func(alert AnomalyAlert)
+
+// ConnectionRates the counts of connection attempts, auth failures and disconnections within the sliding window
+type ConnectionRates struct {
+	Connects     uint64        `json:"connects"`
+	AuthFailures uint64        `json:"authFailures"`
+	Disconnects  uint64        `json:"disconnects"`
+	Window       time.Duration `json:"window"`
+}
+
+// slidingCounter counts the events within the sliding window approximately, the window is divided into slots
+type slidingCounter struct {
+	threshold int
+	counts    [anomalySlots]uint64
+	last      int64 // the index of the latest slot
+	alerting  bool  // the threshold is crossed and the hook is called
+}
+
+type anomalyDetector struct {
+	cfg         Anomaly
+	slot        time.Duration
+	connects    slidingCounter
+	authFails   slidingCounter
+	disconnects slidingCounter
+	hook        AnomalyHook
+	mut         sync.Mutex
+}
+
+func newAnomalyDetector(cfg Anomaly) *anomalyDetector {
+	d := &anomalyDetector{
+		cfg:  cfg,
+		slot: cfg.Window / anomalySlots,
+	}
+	if d.slot <= 0 {
+		d.slot = 1
+	}
+	d.connects.threshold = cfg.Connects
+	d.authFails.threshold = cfg.AuthFailures
+	d.disconnects.threshold = cfg.Disconnects
+	return d
+}
+
+func (d *anomalyDetector) setHook(h AnomalyHook) {
+	d.mut.Lock()
+	d.hook = h
+	d.mut.Unlock()
+}
+
+func (d *anomalyDetector) connect() {
+	d.count(RateConnects, &d.connects)
+}
+
+func (d *anomalyDetector) authFailure() {
+	d.count(RateAuthFailures, &d.authFails)
+}
+
+func (d *anomalyDetector) disconnect() {
+	d.count(RateDisconnects, &d.disconnects)
+}
+
+// count counts the event and calls the hook outside the lock if the threshold is crossed
+func (d *anomalyDetector) count(rate string, c *slidingCounter) {
+	idx := time.Now().UnixNano() / int64(d.slot)
+
+	d.mut.Lock()
+	c.advance(idx)
+	c.counts[idx%anomalySlots]++
+	total := c.total()
+	hook := d.hook
+	fire := false
+	if c.threshold > 0 {
+		if total > uint64(c.threshold) {
+			fire = !c.alerting
+			c.alerting = true
+		} else {
+			c.alerting = false
+		}
+	}
+	d.mut.Unlock()
+
+	if fire && hook != nil {
+		hook(AnomalyAlert{Rate: rate, Count: total, Threshold: c.threshold, Window: d.cfg.Window})
+	}
+}
+
+func (d *anomalyDetector) rates() ConnectionRates {
+	idx := time.Now().UnixNano() / int64(d.slot)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.connects.advance(idx)
+	d.authFails.advance(idx)
+	d.disconnects.advance(idx)
+	return ConnectionRates{
+		Connects:     d.connects.total(),
+		AuthFailures: d.authFails.total(),
+		Disconnects:  d.disconnects.total(),
+		Window:       d.cfg.Window,
+	}
+}
+
+// advance expires the slots older than the window
+func (c *slidingCounter) advance(idx int64) {
+	if idx <= c.last {
+		return
+	}
+	if idx-c.last >= anomalySlots {
+		c.counts = [anomalySlots]uint64{}
+	} else {
+		for i := c.last + 1; i <= idx; i++ {
+			c.counts[i%anomalySlots] = 0
+		}
+	}
+	c.last = idx
+}
+
+func (c *slidingCounter) total() uint64 {
+	var res uint64
+	for _, v := range c.counts {
+		res += v
+	}
+	return res
+}
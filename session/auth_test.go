@@ -2,6 +2,7 @@ package session
 
 import (
 	"fmt"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -462,3 +463,30 @@ func TestPrincipalsValidate(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, fmt.Sprintf("sub topic(test/#/temp) invalid"), err.Error())
 }
+
+// BenchmarkClientAuthorize publishes repeatedly to a few topics by a client with many wildcard permits,
+// the cached decisions skip matching the permits again
+func BenchmarkClientAuthorize(b *testing.B) {
+	var permits []string
+	for i := 0; i < 1000; i++ {
+		permits = append(permits, fmt.Sprintf("device/%d/+/data/#", i))
+	}
+	au := NewAuthenticator([]Principal{{
+		Username:    "u",
+		Password:    "p",
+		Permissions: []Permission{{Action: Publish, Permits: permits}},
+	}})
+	topics := []string{"device/1/a/data", "device/500/b/data/x", "device/999/c/data", "device/1000/d/data"}
+	for _, size := range []int{0, 1024} {
+		b.Run("cache="+strconv.Itoa(size), func(b *testing.B) {
+			c := &Client{auth: au.AuthenticateAccount("u", "p")}
+			if size > 0 {
+				c.authCache = newAuthCache(size)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.authorize(Publish, topics[i%len(topics)])
+			}
+		})
+	}
+}
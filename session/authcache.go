@@ -0,0 +1,72 @@
+package session
+
+import (
+	"container/list"
+	"sync"
+)
+
+type permission struct {
+	action, topic string
+}
+
+type permissionEntry struct {
+	key     permission
+	allowed bool
+}
+
+// authCache caches the recent authorization decisions of a client in LRU,
+// it is reset when the authorizer of client is replaced, such as the principals reloaded
+type authCache struct {
+	size    int
+	entries map[permission]*list.Element
+	lru     *list.List // the most recently used at front
+	mut     sync.Mutex
+}
+
+func newAuthCache(size int) *authCache {
+	return &authCache{
+		size:    size,
+		entries: make(map[permission]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached decision, ok is false if not cached
+func (c *authCache) get(action, topic string) (allowed, ok bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	e, ok := c.entries[permission{action, topic}]
+	if !ok {
+		return false, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*permissionEntry).allowed, true
+}
+
+// put caches the decision and evicts the least recently used one if full
+func (c *authCache) put(action, topic string, allowed bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	key := permission{action, topic}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*permissionEntry).allowed = allowed
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*permissionEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&permissionEntry{key: key, allowed: allowed})
+}
+
+func (c *authCache) reset() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.entries = make(map[permission]*list.Element, c.size)
+	c.lru.Init()
+}
@@ -4,21 +4,43 @@ import (
 	"sync"
 
 	"github.com/baetyl/baetyl-go/v2/mqtt"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
 )
 
+// cache the qos1 messages in flight, acknowledged in the order of packet ids, so the events are committed
+// to the queue in order, and the queue never deletes the messages not acknowledged yet
 type cache struct {
 	data   sync.Map
 	offset mqtt.ID
+	last   *eventWrapper // the latest message stored and not acknowledged, nil if all acknowledged
+	mut    sync.Mutex    // guards last and the follows of messages
 }
 
 func (c *cache) store(m *eventWrapper) error {
 	if prev, ok := c.data.LoadOrStore(m.id, m); ok && prev != m {
-		prev.(*eventWrapper).Done()
+		prev.(*eventWrapper).acknowledge()
 		return ErrSessionClientPacketIDConflict
 	}
+	c.mut.Lock()
+	c.last = m
+	c.mut.Unlock()
 	return nil
 }
 
+// skip commits the event popped but not sent as qos 1, such as the one dropped or delivered as qos 0,
+// after the messages in flight before it are acknowledged
+func (c *cache) skip(e *common.Event) {
+	c.mut.Lock()
+	if c.last != nil {
+		c.last.follows = append(c.last.follows, e)
+		c.mut.Unlock()
+		return
+	}
+	c.mut.Unlock()
+	e.Done()
+}
+
 func (c *cache) delete(id uint64) error {
 	if id != uint64(c.offset) {
 		return nil
@@ -28,7 +50,19 @@ func (c *cache) delete(id uint64) error {
 		return ErrSessionClientPacketNotFound
 	}
 	c.data.Delete(id)
-	m.(*eventWrapper).Done()
 	c.offset = mqtt.NextCounterID(c.offset)
+
+	w := m.(*eventWrapper)
+	c.mut.Lock()
+	if c.last == w {
+		c.last = nil
+	}
+	follows := w.follows
+	w.follows = nil
+	c.mut.Unlock()
+	w.acknowledge()
+	for _, e := range follows {
+		e.Done()
+	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/baetyl/baetyl-go/v2/utils"
 
+	"github.com/baetyl/baetyl-broker/v2/common"
 	"github.com/baetyl/baetyl-broker/v2/queue"
 	"github.com/baetyl/baetyl-broker/v2/store"
 )
@@ -17,16 +18,125 @@ type Config struct {
 
 // SessionConfig session config without principals
 type SessionConfig struct {
-	MaxClients              int           `yaml:"maxClients,omitempty" json:"maxClients,omitempty"`
-	MaxMessagePayloadSize   utils.Size    `yaml:"maxMessagePayloadSize,omitempty" json:"maxMessagePayloadSize,omitempty" default:"32768" validate:"min=1,max=268435455"` // max size of message payload is (256MB - 1)
-	MaxInflightQOS0Messages int           `yaml:"maxInflightQOS0Messages" json:"maxInflightQOS0Messages" default:"100" validate:"min=1"`
-	MaxInflightQOS1Messages int           `yaml:"maxInflightQOS1Messages" json:"maxInflightQOS1Messages" default:"20" validate:"min=1"`
-	ResendInterval          time.Duration `yaml:"resendInterval" json:"resendInterval" default:"20s"`
-	Persistence             Persistence   `yaml:"persistence,omitempty" json:"persistence,omitempty"`
-	SysTopics               []string      `yaml:"sysTopics,omitempty" json:"sysTopics,omitempty" default:"[\"$link\"]"`
+	MaxClients               int                `yaml:"maxClients,omitempty" json:"maxClients,omitempty"`
+	MaxMessagePayloadSize    utils.Size         `yaml:"maxMessagePayloadSize,omitempty" json:"maxMessagePayloadSize,omitempty" default:"32768" validate:"min=1,max=268435455"`       // max size of message payload is (256MB - 1)
+	MaxRetainedPayloadSize   utils.Size         `yaml:"maxRetainedPayloadSize,omitempty" json:"maxRetainedPayloadSize,omitempty"`                                                    // max size of retained message payload, 0 means no limit other than the max message payload size
+	DeliverOversizedRetained bool               `yaml:"deliverOversizedRetained,omitempty" json:"deliverOversizedRetained,omitempty"`                                                // the oversized retained message is delivered as a normal one without being stored instead of rejected
+	MaxWillPayloadSize       utils.Size         `yaml:"maxWillPayloadSize,omitempty" json:"maxWillPayloadSize,omitempty"`                                                            // max size of will message payload, 0 means no limit other than the max message payload size
+	OversizedWillPolicy      string             `yaml:"oversizedWillPolicy,omitempty" json:"oversizedWillPolicy,omitempty" default:"reject" validate:"regexp=^(reject|drop)$"`       // rejects the connect with oversized will message, or accepts the connect and drops the will message
+	UnauthorizedWillPolicy   string             `yaml:"unauthorizedWillPolicy,omitempty" json:"unauthorizedWillPolicy,omitempty" default:"reject" validate:"regexp=^(reject|drop)$"` // rejects the connect with will message whose topic is not permitted to publish, or accepts the connect and drops the will message
+	MaxInflightQOS0Messages  int                `yaml:"maxInflightQOS0Messages" json:"maxInflightQOS0Messages" default:"100" validate:"min=1"`
+	MaxInflightQOS1Messages  int                `yaml:"maxInflightQOS1Messages" json:"maxInflightQOS1Messages" default:"20" validate:"min=1,max=65533"` // the messages in flight are at most 2 more held by the sending and resending routines, so their packet ids never wrap onto each other
+	MaxSpilledQOS0Messages   int                `yaml:"maxSpilledQOS0Messages,omitempty" json:"maxSpilledQOS0Messages,omitempty" validate:"min=0"`      // max count of QOS0 messages of a session spilled to disk instead of dropped when the inflight ones are full, read back in order as the subscriber catches up, 0 means disabled
+	MaxTopicFiltersPerPacket int                `yaml:"maxTopicFiltersPerPacket" json:"maxTopicFiltersPerPacket" default:"1000" validate:"min=1"`       // max count of topic filters in a SUBSCRIBE or UNSUBSCRIBE packet
+	ReceiveMaximum           int                `yaml:"receiveMaximum,omitempty" json:"receiveMaximum,omitempty" validate:"min=0"`                      // max count of inbound QOS1 messages in flight of a client, the connection is not read until their pubacks sent, 0 means no limit
+	ResendInterval           time.Duration      `yaml:"resendInterval" json:"resendInterval" default:"20s"`
+	SendRetry                SendRetry          `yaml:"sendRetry,omitempty" json:"sendRetry,omitempty"`
+	MaxWriteDelay            time.Duration      `yaml:"maxWriteDelay,omitempty" json:"maxWriteDelay,omitempty"`                     // coalesces the messages sent to a connection into fewer writes, the buffer is flushed when full, when no more messages are pending or at most after the delay, 0 means writing each message immediately
+	IdleCleanSessionTimeout  time.Duration      `yaml:"idleCleanSessionTimeout,omitempty" json:"idleCleanSessionTimeout,omitempty"` // reaps the clean session whose connection has no traffic in either direction beyond the timeout, 0 means disabled
+	Persistence              Persistence        `yaml:"persistence,omitempty" json:"persistence,omitempty"`
+	SysTopics                []string           `yaml:"sysTopics,omitempty" json:"sysTopics,omitempty" default:"[\"$link\"]"`
+	ExchangeShards           int                `yaml:"exchangeShards,omitempty" json:"exchangeShards,omitempty"`         // partitions the bindings of common topics by the hash of the first level to reduce lock contention, 0 or 1 means not sharded
+	ExchangeRouteCache       int                `yaml:"exchangeRouteCache,omitempty" json:"exchangeRouteCache,omitempty"` // caches the subscribers matched by at most N topics recently routed to speed up the publishes of hot topics, invalidated on any subscription change, 0 means disabled
+	RetainedHistories        []RetainedHistory  `yaml:"retainedHistories,omitempty" json:"retainedHistories,omitempty"`
+	DeliveryDeadlines        []DeliveryDeadline `yaml:"deliveryDeadlines,omitempty" json:"deliveryDeadlines,omitempty"`
+	DeadLetterTopic          string             `yaml:"deadLetterTopic,omitempty" json:"deadLetterTopic,omitempty"` // the messages dropped at delivery deadline are published to <deadLetterTopic>/<topic> if set
+	Status                   Status             `yaml:"status,omitempty" json:"status,omitempty"`
+	Echo                     Echo               `yaml:"echo,omitempty" json:"echo,omitempty"`
+	PublishRate              PublishRate        `yaml:"publishRate,omitempty" json:"publishRate,omitempty"`
+	SysRetainPolicy          string             `yaml:"sysRetainPolicy,omitempty" json:"sysRetainPolicy,omitempty" default:"reject" validate:"regexp=^(reject|allow)$"` // rejects the retained messages and wills published by clients to $SYS topics, or stores them with the other retained messages
+	Redaction                common.Redaction   `yaml:"redaction,omitempty" json:"redaction,omitempty"`                                                                 // redacts the messages in logs
+	LockStatsSampleRate      int                `yaml:"lockStatsSampleRate,omitempty" json:"lockStatsSampleRate,omitempty"`                                             // samples one of every N session lock acquisitions, 0 means disabled
+	OrderedSessions          []string           `yaml:"orderedSessions,omitempty" json:"orderedSessions,omitempty"`                                                     // client ids of the sessions receiving messages in the order accepted by broker regardless of topics and QoS
+	FairSessions             []string           `yaml:"fairSessions,omitempty" json:"fairSessions,omitempty"`                                                           // client ids of the sessions receiving QoS 0 messages of different topics in round robin, so that a flood of one topic doesn't starve the others
+	UnsubscribeOnRevoke      bool               `yaml:"unsubscribeOnRevoke,omitempty" json:"unsubscribeOnRevoke,omitempty"`                                             // removes the subscriptions of connected clients no longer permitted when principals are reloaded
+	AuthCacheSize            int                `yaml:"authCacheSize,omitempty" json:"authCacheSize,omitempty" validate:"min=0"`                                        // max count of the recent authorization decisions cached per client in LRU, reset when principals are reloaded, 0 means disabled
+	Resubscription           Resubscription     `yaml:"resubscription,omitempty" json:"resubscription,omitempty"`
+	Anomaly                  Anomaly            `yaml:"anomaly,omitempty" json:"anomaly,omitempty"`
+	WillRetainPolicy         string             `yaml:"willRetainPolicy,omitempty" json:"willRetainPolicy,omitempty" default:"keep" validate:"regexp=^(keep|clear|set)$"`                  // keeps the retain flag of will messages set by clients, or clears or sets it for all will messages when published
+	MaxRetainedPerSubscribe  int                `yaml:"maxRetainedPerSubscribe,omitempty" json:"maxRetainedPerSubscribe,omitempty" validate:"min=0"`                                       // max count of retained messages delivered for a subscribe, 0 means no limit
+	RetainedOverflowPolicy   string             `yaml:"retainedOverflowPolicy,omitempty" json:"retainedOverflowPolicy,omitempty" default:"truncate" validate:"regexp=^(truncate|reject)$"` // delivers the first max retained messages matched ordered by topic, or none of them if the subscribe matches more than the max
+	WillOnTakeover           bool               `yaml:"willOnTakeover,omitempty" json:"willOnTakeover,omitempty"`                                                                          // publishes the will message of the connection taken over by a new one with the same client id, not published by default
+	QOS1Commit               string             `yaml:"qos1Commit,omitempty" json:"qos1Commit,omitempty" default:"ack" validate:"regexp=^(ack|written)$"`                                  // deletes the qos1 message from the persistent queue once acknowledged by the client, or once written to the connection, which is not redelivered after restarting even if not received
+	SubscribePolicy          string             `yaml:"subscribePolicy,omitempty" json:"subscribePolicy,omitempty" default:"partial" validate:"regexp=^(partial|atomic)$"`                 // subscribes the topic filters of a subscribe granted and rejects the others, or subscribes none of them and rejects all if any is rejected
+}
+
+// RetainedHistory keeps the last messages published to the topics matching the filter
+type RetainedHistory struct {
+	Topic string `yaml:"topic" json:"topic" validate:"nonzero"`
+	Count int    `yaml:"count" json:"count" validate:"min=1"`
+}
+
+// DeliveryDeadline drops the messages matching the topic filter if they are not sent to subscriber before the deadline,
+// the deadline is counted from the time when the message is accepted by broker
+type DeliveryDeadline struct {
+	Topic    string        `yaml:"topic" json:"topic" validate:"nonzero"`
+	Deadline time.Duration `yaml:"deadline" json:"deadline" validate:"min=1"`
+}
+
+// Status the retained status of broker, the online payload is published when the broker starts,
+// the offline payload is published when the broker closes, disabled if the topic is empty
+type Status struct {
+	Topic   string `yaml:"topic,omitempty" json:"topic,omitempty"`
+	QOS     uint32 `yaml:"qos,omitempty" json:"qos,omitempty" validate:"max=1"`
+	Online  string `yaml:"online,omitempty" json:"online,omitempty" default:"online"`
+	Offline string `yaml:"offline,omitempty" json:"offline,omitempty" default:"offline"`
+}
+
+// Echo publishes the payload of the message published to the request topic to the response topic by broker,
+// to measure the latency of publish-to-deliver without a second client, disabled if the request topic is empty
+type Echo struct {
+	Request  string `yaml:"request,omitempty" json:"request,omitempty"`
+	Response string `yaml:"response,omitempty" json:"response,omitempty"`
+	Rate     int    `yaml:"rate" json:"rate" default:"10" validate:"min=1"` // max count of echoes per second, the requests beyond are acknowledged but not echoed
+}
+
+// PublishRate throttles the messages published by each session with a token bucket, so that a short burst passes at once
+// but a sustained flood is slowed down to the rate, the connection is not read while throttled, disabled if the rate is 0
+type PublishRate struct {
+	Rate  int `yaml:"rate,omitempty" json:"rate,omitempty" validate:"min=0"`   // tokens refilled per second, the sustained rate of publishes
+	Burst int `yaml:"burst,omitempty" json:"burst,omitempty" validate:"min=0"` // capacity of the bucket, the max count of publishes in a burst, the rate if 0
+}
+
+// Resubscription reconciles the stored subscriptions of a resumed persistent session with the ones subscribed
+// within the window after reconnecting, "union" keeps both, "replace" removes the stored subscriptions not subscribed again,
+// "keep" keeps the stored subscriptions and rejects the new ones
+type Resubscription struct {
+	Policy string        `yaml:"policy" json:"policy" default:"union" validate:"regexp=^(union|replace|keep)$"`
+	Window time.Duration `yaml:"window" json:"window" default:"5s"`
+}
+
+// Anomaly tracks the counts of connection attempts, auth failures and disconnections within the sliding window,
+// the anomaly hook is called when any count exceeds its threshold, 0 means the count is not checked
+type Anomaly struct {
+	Window       time.Duration `yaml:"window" json:"window" default:"1m" validate:"min=1"`
+	Connects     int           `yaml:"connects,omitempty" json:"connects,omitempty" validate:"min=0"`
+	AuthFailures int           `yaml:"authFailures,omitempty" json:"authFailures,omitempty" validate:"min=0"`
+	Disconnects  int           `yaml:"disconnects,omitempty" json:"disconnects,omitempty" validate:"min=0"`
+}
+
+// SendRetry retries writing QOS1 message to the connection failed transiently with exponential backoff
+// before closing the connection, disabled if the max count of retries is 0
+type SendRetry struct {
+	Max        int           `yaml:"max,omitempty" json:"max,omitempty" validate:"min=0"`
+	Backoff    time.Duration `yaml:"backoff" json:"backoff" default:"10ms"`
+	MaxBackoff time.Duration `yaml:"maxBackoff" json:"maxBackoff" default:"1s"`
 }
 
 type Persistence struct {
-	Store store.Conf   `yaml:"store,omitempty" json:"store,omitempty"`
-	Queue queue.Config `yaml:"queue,omitempty" json:"queue,omitempty"`
+	Store    store.Conf   `yaml:"store,omitempty" json:"store,omitempty"`
+	Queue    queue.Config `yaml:"queue,omitempty" json:"queue,omitempty"`
+	Snapshot Snapshot     `yaml:"snapshot,omitempty" json:"snapshot,omitempty"`
+	// partitions the queues of sessions across the stores by the hash of client ids, the store at the path keeps the first shard
+	// with the sessions and retained messages, the store of shard i is at "<path>-<i>", the count is kept in the main store
+	// and the manager fails to start if it is changed, the snapshot is not supported if sharded, 0 or 1 means not sharded
+	Shards int `yaml:"shards,omitempty" json:"shards,omitempty" validate:"min=0"`
+}
+
+// Snapshot takes snapshots of the durable state into the directory periodically and keeps the latest ones,
+// disabled if the interval is 0
+type Snapshot struct {
+	Dir      string        `yaml:"dir" json:"dir" default:"var/lib/baetyl/snapshot"`
+	Interval time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Retain   int           `yaml:"retain" json:"retain" default:"3" validate:"min=1"`
 }
@@ -56,4 +56,9 @@ principals:
 	err = utils.UnmarshalYAML([]byte(testConf4), &cfg4)
 	assert.NoError(t, err)
 	assert.Len(t, cfg4.Principals, 2)
+
+	// the packet ids of the messages in flight would collide if the window exceeds the id space
+	var cfg5 Config
+	err = utils.UnmarshalYAML([]byte("session:\n  maxInflightQOS1Messages: 65534\n"), &cfg5)
+	assert.EqualError(t, err, "SessionConfig.MaxInflightQOS1Messages: greater than max")
 }
@@ -0,0 +1,92 @@
+package session
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+)
+
+// SessionDiagnosis the state of a session dumped for support, such as diagnosing the messages not received after reconnecting
+type SessionDiagnosis struct {
+	ID            string                  `json:"id"`
+	Connected     bool                    `json:"connected"`
+	CleanSession  bool                    `json:"cleanSession"`
+	WillMessage   *mqtt.Message           `json:"will,omitempty"`
+	Persisted     *Info                   `json:"persisted,omitempty"` // the info in storage, nil if not persisted such as the clean session
+	Subscriptions []SubscriptionDiagnosis `json:"subscriptions"`
+	TrieCount     int                     `json:"trieCount"` // count of the topic filters in the trie of session, which should be the count of subscriptions
+	Stats         SessionStats            `json:"stats"`
+	NextAck       mqtt.ID                 `json:"nextAck"`           // the packet id of qos1 message expected to be acknowledged next
+	Pending       []mqtt.ID               `json:"pending,omitempty"` // the packet ids of qos1 messages sent but not acknowledged
+}
+
+// SubscriptionDiagnosis the state of a subscription in the info, the trie of session and the exchange
+type SubscriptionDiagnosis struct {
+	Topic  string   `json:"topic"`
+	QOS    mqtt.QOS `json:"qos"`
+	InTrie bool     `json:"inTrie"`
+	Bound  bool     `json:"bound"` // the session is bound with the topic filter in the exchange
+}
+
+// DiagnoseSession dumps the state of the session for support
+func (m *Manager) DiagnoseSession(id string) (SessionDiagnosis, error) {
+	v, ok := m.sessions.load(id)
+	if !ok {
+		return SessionDiagnosis{}, ErrSessionNotFound
+	}
+	s := v.(*Session)
+	res := s.diagnose()
+	_, res.Connected = m.clients.load(id)
+	res.Stats = s.Stats()
+
+	err := m.sessionBucket.GetKV([]byte(id), func(data []byte) error {
+		res.Persisted = new(Info)
+		return errors.Trace(json.Unmarshal(data, res.Persisted))
+	})
+	if err != nil {
+		// the key is not found if not persisted
+		m.log.Debug("failed to get the persisted session", log.Any("id", id), log.Error(err))
+		res.Persisted = nil
+	}
+	return res, nil
+}
+
+func (s *Session) diagnose() SessionDiagnosis {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	res := SessionDiagnosis{
+		ID:           s.info.ID,
+		CleanSession: s.info.CleanSession,
+		WillMessage:  s.info.WillMessage,
+		TrieCount:    s.subs.Count(),
+	}
+	for topic, qos := range s.info.Subscriptions {
+		sub := SubscriptionDiagnosis{
+			Topic: topic,
+			QOS:   qos,
+			Bound: s.manager.exch.Bound(topic, s),
+		}
+		for _, v := range s.subs.Get(topic) {
+			sub.InTrie = sub.InTrie || v.(mqtt.QOS) == qos
+		}
+		res.Subscriptions = append(res.Subscriptions, sub)
+	}
+	sort.Slice(res.Subscriptions, func(i, j int) bool {
+		return res.Subscriptions[i].Topic < res.Subscriptions[j].Topic
+	})
+	s.ackMut.Lock()
+	res.NextAck = s.qos1pkt.offset
+	s.qos1pkt.data.Range(func(k, _ interface{}) bool {
+		res.Pending = append(res.Pending, mqtt.ID(k.(uint64)))
+		return true
+	})
+	s.ackMut.Unlock()
+	sort.Slice(res.Pending, func(i, j int) bool {
+		return res.Pending[i] < res.Pending[j]
+	})
+	return res
+}
@@ -0,0 +1,21 @@
+package session
+
+import (
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+)
+
+// echo publishes the payload of the echo request to the response topic instead of routing the request,
+// the request is neither retained nor kept in history
+func (c *Client) echo(msg *mqtt.Message) error {
+	if !c.manager.echo.allow() {
+		c.log.Warn("dropped an echo request exceeding the rate limit", log.Any("rate", c.manager.cfg.Echo.Rate))
+		if msg.Context.QOS > 0 {
+			return c.send(&mqtt.Puback{ID: mqtt.ID(msg.Context.ID)}, true)
+		}
+		return nil
+	}
+	msg.Context.Topic = c.manager.cfg.Echo.Response
+	msg.Context.Flags &^= 0x1
+	return c.route(msg)
+}
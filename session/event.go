@@ -1,6 +1,7 @@
 package session
 
 import (
+	"sync"
 	"time"
 
 	"github.com/baetyl/baetyl-go/v2/mqtt"
@@ -10,9 +11,12 @@ import (
 
 type eventWrapper struct {
 	*common.Event
-	id  uint64
-	qos mqtt.QOS
-	lst time.Time // last send time
+	id      uint64
+	qos     mqtt.QOS
+	lst     time.Time       // last send time
+	acked   chan struct{}   // closed when acknowledged by client, separated from the commit of event to the queue
+	once    sync.Once       // closes acked once
+	follows []*common.Event // the events popped after it but not sent as qos 1, committed after it to keep the queue in order
 }
 
 func newEventWrapper(id uint64, qos mqtt.QOS, evt *common.Event) *eventWrapper {
@@ -21,6 +25,7 @@ func newEventWrapper(id uint64, qos mqtt.QOS, evt *common.Event) *eventWrapper {
 		id:    id,
 		qos:   qos,
 		lst:   time.Now(),
+		acked: make(chan struct{}),
 	}
 }
 
@@ -31,3 +36,24 @@ func (i *eventWrapper) packet(dup bool) *mqtt.Publish {
 	pkt.Message.QOS = i.qos
 	return pkt
 }
+
+// acknowledge marks the message acknowledged by client and commits the event, the event already committed
+// once written is not committed again
+func (i *eventWrapper) acknowledge() {
+	i.once.Do(func() {
+		close(i.acked)
+	})
+	i.Done()
+}
+
+// wait waits until acknowledged by client, cancelled or timed out
+func (i *eventWrapper) wait(timeout <-chan time.Time, cancel <-chan struct{}) error {
+	select {
+	case <-i.acked:
+		return nil
+	case <-timeout:
+		return common.ErrAcknowledgeTimedOut
+	case <-cancel:
+		return common.ErrAcknowledgeCanceled
+	}
+}
@@ -0,0 +1,92 @@
+package session
+
+import (
+	"crypto/tls"
+	stderrors "errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+)
+
+// ConnectFailures the counts of the connections failed to connect by reason
+type ConnectFailures struct {
+	Auth      uint64 `json:"auth"`      // the credentials or the will topic are not permitted
+	Protocol  uint64 `json:"protocol"`  // the connect packet violates the protocol or the features of the listener
+	Version   uint64 `json:"version"`   // the protocol version is not supported
+	Quota     uint64 `json:"quota"`     // the max clients or the max will payload size is exceeded
+	Malformed uint64 `json:"malformed"` // the first packet can't be decoded
+	TLS       uint64 `json:"tls"`       // the tls handshake failed, excluding the listeners with handshake timeout, whose failures are counted by listeners before the connections are handled
+}
+
+type connectFailures struct {
+	auth, protocol, version, quota, malformed, tls uint64
+}
+
+func (f *connectFailures) stats() ConnectFailures {
+	return ConnectFailures{
+		Auth:      atomic.LoadUint64(&f.auth),
+		Protocol:  atomic.LoadUint64(&f.protocol),
+		Version:   atomic.LoadUint64(&f.version),
+		Quota:     atomic.LoadUint64(&f.quota),
+		Malformed: atomic.LoadUint64(&f.malformed),
+		TLS:       atomic.LoadUint64(&f.tls),
+	}
+}
+
+// count increases the counter of the reason why the client failed to connect, and returns the counter increased
+func (f *connectFailures) count(err error) *uint64 {
+	c := f.counter(err)
+	if c != nil {
+		atomic.AddUint64(c, 1)
+	}
+	return c
+}
+
+// countReceive increases the counter of the reason why the first packet failed to receive,
+// the connections closed by peers or timed out before connecting are not counted
+func (f *connectFailures) countReceive(err error) {
+	var ne net.Error
+	switch {
+	case isTLSError(err):
+		atomic.AddUint64(&f.tls, 1)
+	case stderrors.Is(err, io.EOF) || stderrors.Is(err, io.ErrUnexpectedEOF) || stderrors.As(err, &ne):
+		// closed by peers or timed out
+	default:
+		// the other errors are raised by decoding
+		atomic.AddUint64(&f.malformed, 1)
+	}
+}
+
+// isTLSError checks whether the error is raised by the tls handshake, the alerts received from peers are wrapped
+// by net.OpError of the op only used by tls, since their type is not exported
+func isTLSError(err error) bool {
+	var rhe tls.RecordHeaderError
+	var ae tls.AlertError
+	var cve *tls.CertificateVerificationError
+	if stderrors.As(err, &rhe) || stderrors.As(err, &ae) || stderrors.As(err, &cve) {
+		return true
+	}
+	var oe *net.OpError
+	return stderrors.As(err, &oe) && (oe.Op == "remote error" || oe.Op == "local error")
+}
+
+func (f *connectFailures) counter(err error) *uint64 {
+	switch errors.Cause(err) {
+	case ErrSessionUsernameNotSet, ErrSessionUsernameNotPermitted,
+		ErrSessionCertificateCommonNameNotFound, ErrSessionCertificateCommonNameNotPermitted,
+		ErrSessionWillMessageTopicNotPermitted:
+		return &f.auth
+	case ErrConnectionRefuse, ErrSessionClientIDInvalid, ErrSessionClientPacketUnexpected,
+		ErrSessionWillMessageQosNotSupported, ErrSessionWillMessageRetainNotPermitted, ErrSessionWillMessageTopicInvalid:
+		return &f.protocol
+	case ErrSessionProtocolVersionInvalid:
+		return &f.version
+	case ErrSessionWillMessagePayloadSizeExceedsLimit:
+		return &f.quota
+	default:
+		// the errors of storage or of sending connack are not the faults of clients
+		return nil
+	}
+}
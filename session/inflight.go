@@ -0,0 +1,61 @@
+package session
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/log"
+)
+
+// InflightEvent the inflight window of a session saturated or recovered, the window is saturated when no more qos1 message
+// can be sent until an acknowledgement arrives, so a session saturated for long has a subscriber not acknowledging,
+// while a slow consumer keeps recovering soon
+type InflightEvent struct {
+	Session   string        `json:"session"`
+	Saturated bool          `json:"saturated"`          // true when saturated, false when recovered
+	Capacity  int           `json:"capacity"`           // the max inflight qos1 messages
+	Duration  time.Duration `json:"duration,omitempty"` // how long the window stayed saturated, only set when recovered
+}
+
+// InflightHook is called when the inflight window of a session saturates and when it recovers,
+// it is called in the goroutine sending messages to the client, so it should return quickly
+type InflightHook func(event InflightEvent)
+
+// SetInflightHook sets the hook called when the inflight window of any session saturates or recovers,
+// it should be set before handling connections
+func (m *Manager) SetInflightHook(h InflightHook) {
+	m.inflightHook = h
+}
+
+// saturateInflight marks the inflight window of the session saturated, and returns the time to measure the saturation
+func (c *Client) saturateInflight() time.Time {
+	now := time.Now()
+	atomic.StoreInt64(&c.session.saturated, int64(now.Sub(epoch)))
+	atomic.AddUint64(&c.manager.inflightSaturations, 1)
+	capacity := cap(c.session.qos1ack)
+	c.log.Debug("inflight window of the session is saturated", log.Any("capacity", capacity))
+	if h := c.manager.inflightHook; h != nil {
+		h(InflightEvent{Session: c.session.info.ID, Saturated: true, Capacity: capacity})
+	}
+	return now
+}
+
+// recoverInflight marks the inflight window of the session recovered from the saturation since the time
+func (c *Client) recoverInflight(since time.Time) {
+	d := time.Since(since)
+	atomic.StoreInt64(&c.session.saturated, 0)
+	capacity := cap(c.session.qos1ack)
+	c.log.Debug("inflight window of the session is recovered", log.Any("capacity", capacity), log.Any("duration", d))
+	if h := c.manager.inflightHook; h != nil {
+		h(InflightEvent{Session: c.session.info.ID, Capacity: capacity, Duration: d})
+	}
+}
+
+// saturatedFor returns how long the inflight window of the session has been saturated, 0 if not saturated
+func (s *Session) saturatedFor() time.Duration {
+	v := atomic.LoadInt64(&s.saturated)
+	if v == 0 {
+		return 0
+	}
+	return time.Since(epoch) - time.Duration(v)
+}
@@ -0,0 +1,96 @@
+package session
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockStats the sampled wait and hold times of a session lock
+type LockStats struct {
+	Samples   uint64        `json:"samples"`   // sampled acquisitions of read and write lock
+	WaitTotal time.Duration `json:"waitTotal"` // total wait time of the sampled acquisitions
+	WaitMax   time.Duration `json:"waitMax"`
+	Holds     uint64        `json:"holds"`     // sampled holds of write lock
+	HoldTotal time.Duration `json:"holdTotal"` // total hold time of the sampled write locks
+	HoldMax   time.Duration `json:"holdMax"`
+}
+
+// rwMutex is a read/write mutex which samples one of every rate acquisitions
+// to measure the wait and hold times, the sampling is disabled if rate is 0
+type rwMutex struct {
+	// 64-bit fields are placed first to be aligned for atomic operations on 32-bit platforms
+	count     uint64
+	samples   uint64
+	waitTotal int64
+	waitMax   int64
+	holds     uint64
+	holdTotal int64
+	holdMax   int64
+	since     int64 // start time of the sampled write lock, guarded by write lock
+	rate      uint64
+	sync.RWMutex
+}
+
+func (m *rwMutex) sample() bool {
+	return m.rate > 0 && atomic.AddUint64(&m.count, 1)%m.rate == 0
+}
+
+func (m *rwMutex) Lock() {
+	if !m.sample() {
+		m.RWMutex.Lock()
+		m.since = 0
+		return
+	}
+	start := time.Now().UnixNano()
+	m.RWMutex.Lock()
+	m.since = time.Now().UnixNano()
+	m.addWait(m.since - start)
+}
+
+func (m *rwMutex) Unlock() {
+	if m.since != 0 {
+		d := time.Now().UnixNano() - m.since
+		atomic.AddUint64(&m.holds, 1)
+		atomic.AddInt64(&m.holdTotal, d)
+		storeMax(&m.holdMax, d)
+		m.since = 0
+	}
+	m.RWMutex.Unlock()
+}
+
+func (m *rwMutex) RLock() {
+	if !m.sample() {
+		m.RWMutex.RLock()
+		return
+	}
+	start := time.Now().UnixNano()
+	m.RWMutex.RLock()
+	m.addWait(time.Now().UnixNano() - start)
+}
+
+func (m *rwMutex) addWait(d int64) {
+	atomic.AddUint64(&m.samples, 1)
+	atomic.AddInt64(&m.waitTotal, d)
+	storeMax(&m.waitMax, d)
+}
+
+func (m *rwMutex) stats() LockStats {
+	return LockStats{
+		Samples:   atomic.LoadUint64(&m.samples),
+		WaitTotal: time.Duration(atomic.LoadInt64(&m.waitTotal)),
+		WaitMax:   time.Duration(atomic.LoadInt64(&m.waitMax)),
+		Holds:     atomic.LoadUint64(&m.holds),
+		HoldTotal: time.Duration(atomic.LoadInt64(&m.holdTotal)),
+		HoldMax:   time.Duration(atomic.LoadInt64(&m.holdMax)),
+	}
+}
+
+func storeMax(addr *int64, v int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if v <= old || atomic.CompareAndSwapInt64(addr, old, v) {
+			return
+		}
+	}
+}
@@ -1,17 +1,25 @@
 package session
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
 
+	"github.com/baetyl/baetyl-broker/v2/common"
 	"github.com/baetyl/baetyl-broker/v2/exchange"
+	"github.com/baetyl/baetyl-broker/v2/queue"
 	"github.com/baetyl/baetyl-broker/v2/store"
-
-	"github.com/gogo/protobuf/proto"
 )
 
 // all errors
@@ -19,6 +27,7 @@ var (
 	ErrConnectionRefuse                          = errors.New("connection refuse on server side")
 	ErrSessionClientAlreadyClosed                = errors.New("session client is already closed")
 	ErrSessionClientAlreadyConnecting            = errors.New("session client is already connected")
+	ErrSessionClientIdle                         = errors.New("session client has no traffic beyond the timeout")
 	ErrSessionClientPacketUnexpected             = errors.New("session client received unexpected packet")
 	ErrSessionClientPacketIDConflict             = errors.New("packet id conflict, to acknowledge old packet")
 	ErrSessionClientPacketNotFound               = errors.New("packet id is not found")
@@ -30,46 +39,134 @@ var (
 	ErrSessionCertificateCommonNameNotPermitted  = errors.New("certificate common name is not permitted")
 	ErrSessionMessageQosNotSupported             = errors.New("message QOS is not supported")
 	ErrSessionMessageTopicInvalid                = errors.New("message topic is invalid")
+	ErrSessionMessageTopicEmpty                  = errors.New("message topic is empty")
 	ErrSessionMessageTopicNotPermitted           = errors.New("message topic is not permitted")
 	ErrSessionMessagePayloadSizeExceedsLimit     = errors.New("message payload exceeds the max limit")
+	ErrSessionMessageRetainNotPermitted          = errors.New("retained message is not permitted")
+	ErrSessionMessagePersistFailed               = errors.New("message is not persisted by all the subscribers")
+	ErrSessionRetainedPayloadSizeExceedsLimit    = errors.New("retained message payload exceeds the max limit")
 	ErrSessionWillMessageQosNotSupported         = errors.New("will QoS is not supported")
 	ErrSessionWillMessageTopicInvalid            = errors.New("will topic is invalid")
 	ErrSessionWillMessageTopicNotPermitted       = errors.New("will topic is not permitted")
 	ErrSessionWillMessagePayloadSizeExceedsLimit = errors.New("will message payload exceeds the max limit")
+	ErrSessionWillMessageRetainNotPermitted      = errors.New("retained will message is not permitted")
 	ErrSessionSubscribePayloadEmpty              = errors.New("subscribe payload can't be empty")
+	ErrSessionTopicFiltersExceedsLimit           = errors.New("topic filters of subscribe or unsubscribe exceed the max limit")
+	ErrSessionDeliveryPanicked                   = errors.New("session delivery panicked")
 	ErrSessionManagerClosed                      = errors.New("manager has closed")
+	ErrSessionStatusTopicInvalid                 = errors.New("status topic is invalid")
+	ErrSessionEchoTopicInvalid                   = errors.New("echo topic is invalid")
+	ErrSessionNotFound                           = errors.New("session is not found")
+	ErrSessionSnapshotNotSupported               = errors.New("snapshot is not supported by the store")
+	ErrSessionSnapshotInvalid                    = errors.New("snapshot is invalid")
+	ErrSessionPersistenceShardsChanged           = errors.New("persistence shards are changed since the queues were stored")
 )
 
+// maxHotSessions the max count of sessions reported in stats, ordered by lock wait time or lag
+const maxHotSessions = 10
+
+// RetainedTransformer transforms a retained message delivered to the session by the subscriptions matching its topic,
+// the returned message is delivered instead of the stored one which is never changed, nil means not to deliver
+type RetainedTransformer func(sid string, subs []mqtt.Subscription, msg *mqtt.Message) *mqtt.Message
+
 // Manager the manager of sessions
 type Manager struct {
-	cfg           Config
-	store         store.DB
-	sessions      *syncmap
-	clients       *syncmap
-	checker       *mqtt.TopicChecker
-	exch          *exchange.Exchange
-	auth          *Authenticator
-	sessionBucket store.KVBucket
-	retainBucket  store.KVBucket
-	log           *log.Logger
-	quit          int32 // if quit != 0, it means manager is closed
+	retainedOverflows   uint64 // count of the subscribes matching more retained messages than the limit, the first field to be aligned for atomic operations
+	inflightSaturations uint64 // count of the inflight windows of sessions saturated, aligned next to the field above
+	cfg                 Config
+	store               store.DB
+	stores              []store.DB // the stores of the session queues sharded by the hash of client ids, the first one is the main store
+	sessions            *syncmap
+	clients             *syncmap
+	adding              [syncMapShards]sync.Mutex // serializes the connects of the same client id by its hash, so a takeover never closes the client being added
+	checker             *mqtt.TopicChecker
+	exch                *exchange.Exchange
+	auth                *Authenticator
+	authMut             sync.RWMutex
+	sessionBucket       store.KVBucket
+	retainBucket        store.KVBucket
+	sysBucket           store.KVBucket // the retained messages generated by broker on $SYS topics, separated from the ones of clients
+	encoder             queue.Encoder  // encodes retained messages
+	historyBucket       store.KVBucket
+	histories           *mqtt.Trie // topic filter -> count of retained history
+	history             sync.Map   // topic -> *retainedHistory
+	deadlines           *mqtt.Trie // topic filter -> delivery deadline
+	transformer         RetainedTransformer
+	inflightHook        InflightHook
+	echo                *tokenBucket // limits the rate of echoes whose capacity is the rate per second, nil if echo is disabled
+	failures            *connectFailures
+	anomaly             *anomalyDetector
+	tomb                utils.Tomb // runs the snapshot and reaping routines
+	log                 *log.Logger
+	quit                int32 // if quit != 0, it means manager is closed
 }
 
 // NewManager create a new session manager
 func NewManager(cfg Config) (m *Manager, err error) {
 	m = &Manager{
-		cfg:      cfg,
-		sessions: newSyncMap(),
-		clients:  newSyncMap(),
-		checker:  mqtt.NewTopicChecker(cfg.SysTopics),
-		exch:     exchange.NewExchange(cfg.SysTopics),
-		auth:     NewAuthenticator(cfg.Principals),
-		log:      log.With(log.Any("session", "manager")),
+		cfg:       cfg,
+		sessions:  newSyncMap(),
+		clients:   newSyncMap(),
+		checker:   mqtt.NewTopicChecker(cfg.SysTopics),
+		exch:      exchange.NewShardedExchange(cfg.SysTopics, cfg.ExchangeShards),
+		auth:      NewAuthenticator(cfg.Principals),
+		histories: mqtt.NewTrie(),
+		deadlines: mqtt.NewTrie(),
+		failures:  new(connectFailures),
+		anomaly:   newAnomalyDetector(cfg.Anomaly),
+		log:       log.With(log.Any("session", "manager")),
+	}
+	m.exch.EnableRouteCache(cfg.ExchangeRouteCache)
+	for _, h := range cfg.RetainedHistories {
+		m.histories.Add(h.Topic, h.Count)
+	}
+	for _, d := range cfg.DeliveryDeadlines {
+		m.deadlines.Add(d.Topic, d.Deadline)
+	}
+	if cfg.Status.Topic != "" && !m.checker.CheckTopic(cfg.Status.Topic, false) {
+		return nil, ErrSessionStatusTopicInvalid
+	}
+	if cfg.Echo.Request != "" {
+		if !m.checker.CheckTopic(cfg.Echo.Request, false) || !m.checker.CheckTopic(cfg.Echo.Response, false) {
+			return nil, ErrSessionEchoTopicInvalid
+		}
+		m.echo = newTokenBucket(PublishRate{Rate: cfg.Echo.Rate})
+	}
+	// the queues in the other shards can't be exported with the main store
+	if cfg.Persistence.Snapshot.Interval > 0 && cfg.Persistence.Shards > 1 {
+		return nil, ErrSessionSnapshotNotSupported
+	}
+	m.encoder, err = queue.NewEncoder(cfg.Persistence.Queue.Encryption)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 	m.store, err = store.New(cfg.Persistence.Store)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	m.stores = []store.DB{m.store}
+	for i := 1; i < cfg.Persistence.Shards; i++ {
+		sc := cfg.Persistence.Store
+		sc.Path = fmt.Sprintf("%s-%d", sc.Path, i)
+		var db store.DB
+		db, err = store.New(sc)
+		if err != nil {
+			_err := m.Close()
+			if _err != nil {
+				m.log.Error("failed to close manager", log.Error(_err))
+			}
+			return nil, errors.Trace(err)
+		}
+		m.stores = append(m.stores, db)
+	}
+	err = m.checkShards()
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
 	m.sessionBucket, err = m.store.NewKVBucket("#session")
 	if err != nil {
 		_err := m.Close()
@@ -86,6 +183,30 @@ func NewManager(cfg Config) (m *Manager, err error) {
 		}
 		return
 	}
+	m.historyBucket, err = m.store.NewKVBucket("#history")
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	m.sysBucket, err = m.store.NewKVBucket("#sys")
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	err = m.loadHistoryMessages()
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
 	var ss []Info
 	// load stored sessions from backend database
 	err = m.sessionBucket.ListKV(func(data []byte) error {
@@ -122,15 +243,64 @@ func NewManager(cfg Config) (m *Manager, err error) {
 
 		m.sessions.store(si.ID, s)
 	}
+	err = m.publishStatus(cfg.Status.Online)
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	if cfg.Persistence.Snapshot.Interval > 0 {
+		m.tomb.Go(m.snapshotting)
+	}
+	if cfg.IdleCleanSessionTimeout > 0 {
+		m.tomb.Go(m.reaping)
+	}
 	m.log.Info("session manager has initialized")
 	return m, nil
 }
 
+// checkShards checks the count of persistence shards against the one stored in the main store, since the queue of each
+// session is kept in the shard picked by the count, the queued messages are orphaned if it is changed
+func (m *Manager) checkShards() error {
+	bucket, err := m.store.NewKVBucket("#shards")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	shards := m.cfg.Persistence.Shards
+	if shards < 1 {
+		shards = 1
+	}
+	// listed instead of got, since the key not found is reported differently by the drivers
+	stored := 0
+	err = bucket.ListKV(func(data []byte) error {
+		var _err error
+		stored, _err = strconv.Atoi(string(data))
+		return errors.Trace(_err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if stored == 0 {
+		return errors.Trace(bucket.SetKV([]byte("shards"), []byte(strconv.Itoa(shards))))
+	}
+	if stored != shards {
+		m.log.Error(ErrSessionPersistenceShardsChanged.Error(), log.Any("stored", stored), log.Any("shards", shards))
+		return ErrSessionPersistenceShardsChanged
+	}
+	return nil
+}
+
 func (m *Manager) addClient(si Info, c *Client) (s *Session, exists bool, err error) {
 	if err = m.checkQuitState(); err != nil {
 		return s, exists, errors.Trace(err)
 	}
 
+	mut := &m.adding[hashKey(si.ID)%syncMapShards]
+	mut.Lock()
+	defer mut.Unlock()
+
 	defer func() {
 		if err != nil {
 			m.clients.delete(si.ID)
@@ -140,6 +310,10 @@ func (m *Manager) addClient(si Info, c *Client) (s *Session, exists bool, err er
 	}()
 
 	if v, loaded := m.clients.store(si.ID, c); loaded {
+		// the takeover is not a disconnection, so the will message of the old client is not published unless configured
+		if m.cfg.WillOnTakeover && v.(*Client).tomb.Alive() {
+			v.(*Client).sendWillMessage()
+		}
 		err := v.(*Client).close()
 		if err != nil {
 			m.log.Error("failed to close old client", log.Any("id", v.(*Client).id), log.Error(err))
@@ -149,16 +323,25 @@ func (m *Manager) addClient(si Info, c *Client) (s *Session, exists bool, err er
 
 	if v, loaded := m.sessions.load(si.ID); loaded {
 		s = v.(*Session)
-		if !s.info.CleanSession {
-			exists = true
-			err := s.update(si, c.authorize)
+		if !s.cleanSession() {
+			if !si.CleanSession {
+				exists = true
+				err := s.update(si, c.authorize)
+				if err != nil {
+					return nil, false, errors.Trace(err)
+				}
+				return s, exists, errors.Trace(err)
+			}
+			// the stored info and queued messages of the persistent session are discarded too
+			err = s.discard()
 			if err != nil {
 				return nil, false, errors.Trace(err)
 			}
-			return s, exists, errors.Trace(err)
 		}
 
 		// If CleanSession is set to 1, the Client and Server MUST discard any previous Session and start a new one. [MQTT-3.1.2-6]
+		// the clean session is discarded too when the client reconnects with a persistent one, the messages queued by it
+		// are deleted with its queues instead of being stored retroactively, the new session persists the qos1 messages from now on
 		m.cleanSession(s)
 	}
 
@@ -215,13 +398,79 @@ func (m *Manager) checkSubscriptions(si *Info) {
 			continue
 		}
 		if !m.checker.CheckTopic(topic, true) {
-			m.log.Warn(ErrSessionMessageTopicInvalid.Error(), log.Any("topic", topic))
+			m.log.Warn(ErrSessionMessageTopicInvalid.Error(), log.Any("topic", m.cfg.Redaction.FormatTopic(topic)))
 			delete(si.Subscriptions, topic)
 			continue
 		}
 	}
 }
 
+// ManagerStats statistics of session manager
+type ManagerStats struct {
+	Sessions            int             `json:"sessions"`
+	Clients             int             `json:"clients"`
+	ConnectFailures     ConnectFailures `json:"connectFailures"`
+	RetainedOverflows   uint64          `json:"retainedOverflows"`         // count of the subscribes matching more retained messages than the limit
+	InflightSaturations uint64          `json:"inflightSaturations"`       // count of the inflight windows of sessions saturated
+	Rates               ConnectionRates `json:"rates"`                     // the counts of connections within the sliding window of anomaly detection
+	HotSessions         []SessionStats  `json:"hotSessions,omitempty"`     // sessions waiting longest for locks
+	LaggingSessions     []SessionStats  `json:"laggingSessions,omitempty"` // sessions with the most unacknowledged qos1 messages
+}
+
+// Stats returns the statistics of session manager, the sessions lagging most are reported,
+// and the sessions waiting longest for locks are reported if the lock stats sampling is enabled
+func (m *Manager) Stats() ManagerStats {
+	res := ManagerStats{
+		Sessions:            m.sessions.count(),
+		Clients:             m.clients.count(),
+		ConnectFailures:     m.failures.stats(),
+		RetainedOverflows:   atomic.LoadUint64(&m.retainedOverflows),
+		InflightSaturations: atomic.LoadUint64(&m.inflightSaturations),
+		Rates:               m.anomaly.rates(),
+	}
+	var all []SessionStats
+	for _, v := range m.sessions.values() {
+		all = append(all, v.(*Session).Stats())
+	}
+	res.LaggingSessions = topSessions(all, func(i, j SessionStats) bool {
+		return i.Lag > j.Lag
+	}, func(s SessionStats) bool {
+		return s.Lag > 0
+	})
+	if m.cfg.LockStatsSampleRate > 0 {
+		res.HotSessions = topSessions(all, func(i, j SessionStats) bool {
+			return i.Lock.WaitTotal > j.Lock.WaitTotal
+		}, nil)
+	}
+	return res
+}
+
+// SessionStats returns the statistics of the session
+func (m *Manager) SessionStats(id string) (SessionStats, error) {
+	v, ok := m.sessions.load(id)
+	if !ok {
+		return SessionStats{}, ErrSessionNotFound
+	}
+	return v.(*Session).Stats(), nil
+}
+
+// topSessions returns at most maxHotSessions sessions ordered by less and filtered by keep
+func topSessions(all []SessionStats, less func(i, j SessionStats) bool, keep func(SessionStats) bool) []SessionStats {
+	var res []SessionStats
+	for _, s := range all {
+		if keep == nil || keep(s) {
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return less(res[i], res[j])
+	})
+	if len(res) > maxHotSessions {
+		res = res[:maxHotSessions]
+	}
+	return res
+}
+
 // Close close
 func (m *Manager) Close() error {
 	if err := m.checkQuitState(); err != nil {
@@ -233,10 +482,20 @@ func (m *Manager) Close() error {
 
 	atomic.AddInt32(&m.quit, -1)
 
-	for _, s := range m.sessions.empty() {
-		s.(*Session).close()
+	m.tomb.Kill(nil)
+	err := m.tomb.Wait()
+	if err != nil {
+		m.log.Error("failed to stop background routines", log.Error(err))
+	}
+
+	if m.sysBucket != nil {
+		err := m.publishStatus(m.cfg.Status.Offline)
+		if err != nil {
+			m.log.Error("failed to publish offline status", log.Error(err))
+		}
 	}
 
+	// the clients are closed first to stop delivering messages from the sessions
 	for _, c := range m.clients.empty() {
 		err := c.(*Client).close()
 		if err != nil {
@@ -244,6 +503,17 @@ func (m *Manager) Close() error {
 		}
 	}
 
+	for _, s := range m.sessions.empty() {
+		s.(*Session).close()
+	}
+
+	// the main store is closed last
+	for i := len(m.stores) - 1; i > 0; i-- {
+		err := m.stores[i].Close()
+		if err != nil {
+			m.log.Error("failed to close store", log.Any("shard", i), log.Error(err))
+		}
+	}
 	if m.store != nil {
 		err := m.store.Close()
 		if err != nil {
@@ -253,6 +523,89 @@ func (m *Manager) Close() error {
 	return nil
 }
 
+// sessionStore returns the store of the session queues by the hash of client id
+func (m *Manager) sessionStore(id string) store.DB {
+	if len(m.stores) < 2 {
+		return m.store
+	}
+	return m.stores[hashKey(id)%uint32(len(m.stores))]
+}
+
+// reaping closes the clients of clean sessions which have no traffic beyond the timeout, it is a safety net
+// for the dead connections not detected since keep alive is disabled
+func (m *Manager) reaping() error {
+	timeout := m.cfg.IdleCleanSessionTimeout
+	m.log.Info("manager starts to reap idle clean sessions", log.Any("timeout", timeout))
+	defer m.log.Info("manager has stopped reaping idle clean sessions")
+
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for id, v := range m.clients.items() {
+				s, ok := m.sessions.load(id)
+				if !ok || !s.(*Session).cleanSession() {
+					continue
+				}
+				c := v.(*Client)
+				if idle := c.idle(); idle > timeout {
+					c.log.Warn("client is reaped since it has no traffic beyond the timeout", log.Any("idle", idle))
+					c.die(ErrSessionClientIdle.Error(), ErrSessionClientIdle)
+				}
+			}
+		case <-m.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// ReloadPrincipals replaces the principals, the connected clients are authenticated again by the new ones,
+// the client not permitted anymore is closed, and its subscriptions no longer permitted are removed if configured
+func (m *Manager) ReloadPrincipals(principals []Principal) error {
+	if err := m.checkQuitState(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := principalsValidate(principals, ""); err != nil {
+		return errors.Trace(err)
+	}
+	auth := NewAuthenticator(principals)
+	m.authMut.Lock()
+	m.auth = auth
+	m.authMut.Unlock()
+
+	for id, v := range m.clients.items() {
+		c := v.(*Client)
+		if !c.reauthenticate(auth) {
+			c.log.Warn("client is closed since it is not permitted by the reloaded principals")
+			if err := c.close(); err != nil {
+				c.log.Error("failed to close client", log.Error(err))
+			}
+			continue
+		}
+		if !m.cfg.UnsubscribeOnRevoke {
+			continue
+		}
+		s, ok := m.sessions.load(id)
+		if !ok {
+			continue
+		}
+		topics, err := s.(*Session).revoke(c.authorize)
+		if err != nil {
+			c.log.Error("failed to remove the subscriptions no longer permitted", log.Any("topics", m.cfg.Redaction.FormatTopics(topics)), log.Error(err))
+		} else if len(topics) != 0 {
+			c.log.Warn("subscriptions are removed since they are no longer permitted", log.Any("topics", m.cfg.Redaction.FormatTopics(topics)))
+		}
+	}
+	return nil
+}
+
+func (m *Manager) authenticator() *Authenticator {
+	m.authMut.RLock()
+	defer m.authMut.RUnlock()
+	return m.auth
+}
+
 // * retain message operations
 
 func (m *Manager) listRetainedMessages() ([]*mqtt.Message, error) {
@@ -262,7 +615,7 @@ func (m *Manager) listRetainedMessages() ([]*mqtt.Message, error) {
 			return store.ErrDataNotFound
 		}
 		v := new(mqtt.Message)
-		if err := proto.Unmarshal(data, v); err != nil {
+		if err := m.encoder.Decode(data, v); err != nil {
 			return errors.Trace(err)
 		}
 		msgs = append(msgs, v)
@@ -275,7 +628,7 @@ func (m *Manager) listRetainedMessages() ([]*mqtt.Message, error) {
 }
 
 func (m *Manager) retainMessage(msg *mqtt.Message) error {
-	data, err := proto.Marshal(msg)
+	data, err := m.encoder.Encode(msg)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -285,3 +638,249 @@ func (m *Manager) retainMessage(msg *mqtt.Message) error {
 func (m *Manager) unretainMessage(topic string) error {
 	return m.retainBucket.DelKV([]byte(topic))
 }
+
+// listSysMessages lists the retained messages generated by broker on $SYS topics
+func (m *Manager) listSysMessages() ([]*mqtt.Message, error) {
+	msgs := make([]*mqtt.Message, 0)
+	err := m.sysBucket.ListKV(func(data []byte) error {
+		if len(data) == 0 {
+			return store.ErrDataNotFound
+		}
+		v := new(mqtt.Message)
+		if err := m.encoder.Decode(data, v); err != nil {
+			return errors.Trace(err)
+		}
+		msgs = append(msgs, v)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return msgs, nil
+}
+
+// retainSysMessage retains the message generated by broker, the one on $SYS topic is kept apart from the retained messages of clients
+func (m *Manager) retainSysMessage(msg *mqtt.Message) error {
+	if !isSysTopic(msg.Context.Topic) {
+		return m.retainMessage(msg)
+	}
+	data, err := m.encoder.Encode(msg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// removes the one retained with the messages of clients by the previous versions
+	if err = m.unretainMessage(msg.Context.Topic); err != nil {
+		return errors.Trace(err)
+	}
+	return m.sysBucket.SetKV([]byte(msg.Context.Topic), data)
+}
+
+// isSysTopic checks whether the topic is in the $SYS namespace reserved by broker
+func isSysTopic(topic string) bool {
+	return topic == "$SYS" || strings.HasPrefix(topic, "$SYS/")
+}
+
+// SetRetainedTransformer sets the transformer of retained messages, it should be set before handling connections
+func (m *Manager) SetRetainedTransformer(t RetainedTransformer) {
+	m.transformer = t
+}
+
+// SetAnomalyHook sets the hook called when any rate of connections crosses its threshold
+func (m *Manager) SetAnomalyHook(h AnomalyHook) {
+	m.anomaly.setHook(h)
+}
+
+// connectFailed counts the failure of the client to connect
+func (m *Manager) connectFailed(err error) {
+	if m.failures.count(err) == &m.failures.auth {
+		m.anomaly.authFailure()
+	}
+}
+
+// publishStatus retains and publishes the status of broker
+func (m *Manager) publishStatus(payload string) error {
+	if m.cfg.Status.Topic == "" {
+		return nil
+	}
+	msg := &mqtt.Message{
+		Context: mqtt.Context{
+			QOS:   m.cfg.Status.QOS,
+			Flags: 0x1,
+			Topic: m.cfg.Status.Topic,
+		},
+		Content: []byte(payload),
+	}
+	err := m.retainSysMessage(msg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// change to normal message before exchange
+	msg.Context.Flags &^= 0x1
+	m.exch.Route(msg, nil)
+	return nil
+}
+
+// deliveryDeadline returns the minimum delivery deadline of the topic, 0 means no deadline
+func (m *Manager) deliveryDeadline(topic string) time.Duration {
+	var res time.Duration
+	for _, v := range m.deadlines.Match(topic) {
+		if d := v.(time.Duration); res == 0 || d < res {
+			res = d
+		}
+	}
+	return res
+}
+
+// sendDeadLetter publishes the message dropped at its delivery deadline to the dead letter topic
+func (m *Manager) sendDeadLetter(msg *mqtt.Message) {
+	if m.cfg.DeadLetterTopic == "" || strings.HasPrefix(msg.Context.Topic, m.cfg.DeadLetterTopic+"/") {
+		return
+	}
+	dl := &mqtt.Message{
+		Context: mqtt.Context{
+			TS:    uint64(common.Now().UnixNano()),
+			QOS:   msg.Context.QOS,
+			Topic: m.cfg.DeadLetterTopic + "/" + msg.Context.Topic,
+		},
+		Content: msg.Content,
+	}
+	m.exch.Route(dl, nil)
+}
+
+// * retained history operations
+
+// historyCount returns the count of retained history of the topic, 0 means no history is kept
+func (m *Manager) historyCount(topic string) int {
+	count := 0
+	for _, v := range m.histories.Match(topic) {
+		if v.(int) > count {
+			count = v.(int)
+		}
+	}
+	return count
+}
+
+// retainedHistory the history of a topic, the messages are replaced on write since readers share them
+type retainedHistory struct {
+	sync.Mutex
+	msgs []*mqtt.Message
+}
+
+// historyKey the key of a message in history, which is the topic followed by the sequence of the message,
+// so the messages of a topic are listed by sequence. Topic never contains NUL. [MQTT-1.5.3-2]
+func historyKey(topic string, seq uint64) []byte {
+	k := make([]byte, len(topic)+9)
+	copy(k, topic)
+	binary.BigEndian.PutUint64(k[len(topic)+1:], seq)
+	return k
+}
+
+func (m *Manager) topicHistory(topic string) *retainedHistory {
+	if v, ok := m.history.Load(topic); ok {
+		return v.(*retainedHistory)
+	}
+	v, _ := m.history.LoadOrStore(topic, new(retainedHistory))
+	return v.(*retainedHistory)
+}
+
+func (m *Manager) loadHistoryMessages() error {
+	return m.historyBucket.ListKV(func(data []byte) error {
+		if len(data) == 0 {
+			return store.ErrDataNotFound
+		}
+		v := new(mqtt.Message)
+		if err := m.encoder.Decode(data, v); err != nil {
+			return errors.Trace(err)
+		}
+		h := m.topicHistory(v.Context.Topic)
+		h.msgs = append(h.msgs, v)
+		return nil
+	})
+}
+
+// listHistoryMessages lists the histories ordered by topic, the messages of each history are ordered by sequence
+func (m *Manager) listHistoryMessages() [][]*mqtt.Message {
+	var res [][]*mqtt.Message
+	m.history.Range(func(_, v interface{}) bool {
+		h := v.(*retainedHistory)
+		h.Lock()
+		msgs := h.msgs
+		h.Unlock()
+		if len(msgs) != 0 {
+			res = append(res, msgs)
+		}
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool {
+		return res[i][0].Context.Topic < res[j][0].Context.Topic
+	})
+	return res
+}
+
+// appendHistory appends the message to the bounded history of its topic, the oldest one is dropped if full,
+// the empty retained message clears the history as it clears the retained message
+func (m *Manager) appendHistory(msg *mqtt.Message) error {
+	if msg.Context.Flags&0x1 == 0x1 && len(msg.Content) == 0 {
+		return m.clearHistory(msg.Context.Topic)
+	}
+	count := m.historyCount(msg.Context.Topic)
+	if count == 0 {
+		return nil
+	}
+
+	h := m.topicHistory(msg.Context.Topic)
+	h.Lock()
+	defer h.Unlock()
+
+	v := &mqtt.Message{
+		Context: msg.Context,
+		Content: msg.Content,
+	}
+	// the id of message in history is its sequence
+	v.Context.ID = 1
+	if n := len(h.msgs); n != 0 {
+		v.Context.ID = h.msgs[n-1].Context.ID + 1
+	}
+	// the history is delivered as retained message
+	v.Context.Flags |= 0x1
+	data, err := m.encoder.Encode(v)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = m.historyBucket.SetKV(historyKey(v.Context.Topic, v.Context.ID), data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// copy on write, the slice may be in use by the readers
+	msgs := append(append(make([]*mqtt.Message, 0, len(h.msgs)+1), h.msgs...), v)
+	defer func() { h.msgs = msgs }()
+	for len(msgs) > count {
+		err = m.historyBucket.DelKV(historyKey(msgs[0].Context.Topic, msgs[0].Context.ID))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		msgs = msgs[1:]
+	}
+	return nil
+}
+
+// clearHistory clears the history of the topic
+func (m *Manager) clearHistory(topic string) error {
+	v, ok := m.history.Load(topic)
+	if !ok {
+		return nil
+	}
+	h := v.(*retainedHistory)
+	h.Lock()
+	defer h.Unlock()
+
+	for len(h.msgs) != 0 {
+		err := m.historyBucket.DelKV(historyKey(topic, h.msgs[0].Context.ID))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		h.msgs = h.msgs[1:]
+	}
+	h.msgs = nil
+	return nil
+}
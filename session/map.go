@@ -4,52 +4,123 @@ import (
 	"sync"
 )
 
+// syncMapShards the count of shards partitioning the map by the hash of keys, so that the connects, disconnects
+// and lookups of different clients rarely contend for the same lock under high connection churn
+const syncMapShards = 32
+
+// syncmap the map partitioned into shards, the operations on the same key are always serialized by its shard,
+// so the previous value returned by store is exactly the one replaced, such as the client taken over
 type syncmap struct {
+	shards []*mapShard
+}
+
+type mapShard struct {
 	data map[string]interface{}
 	mut  sync.RWMutex
 }
 
 func newSyncMap() *syncmap {
-	return &syncmap{
-		data: make(map[string]interface{}),
+	return newShardedSyncMap(syncMapShards)
+}
+
+func newShardedSyncMap(shards int) *syncmap {
+	if shards < 1 {
+		shards = 1
+	}
+	m := &syncmap{shards: make([]*mapShard, shards)}
+	for i := range m.shards {
+		m.shards[i] = &mapShard{data: make(map[string]interface{})}
+	}
+	return m
+}
+
+// shard returns the shard of the key
+func (m *syncmap) shard(k string) *mapShard {
+	if len(m.shards) == 1 {
+		return m.shards[0]
+	}
+	return m.shards[hashKey(k)%uint32(len(m.shards))]
+}
+
+// hashKey returns the FNV-1a hash of the key, which is inlined to avoid allocations
+func hashKey(k string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(k); i++ {
+		h ^= uint32(k[i])
+		h *= 16777619
 	}
+	return h
 }
 
 func (m *syncmap) store(k string, v interface{}) (actual interface{}, loaded bool) {
-	m.mut.Lock()
-	defer m.mut.Unlock()
+	s := m.shard(k)
+	s.mut.Lock()
+	defer s.mut.Unlock()
 
-	old, ok := m.data[k]
-	m.data[k] = v
+	old, ok := s.data[k]
+	s.data[k] = v
 	return old, ok
 }
 
 func (m *syncmap) delete(k string) {
-	m.mut.Lock()
-	defer m.mut.Unlock()
-	delete(m.data, k)
+	s := m.shard(k)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.data, k)
 }
 
+// empty removes and returns all the values, the shards are emptied one by one
 func (m *syncmap) empty() []interface{} {
-	m.mut.Lock()
-	defer m.mut.Unlock()
 	var res []interface{}
-	for k, v := range m.data {
-		delete(m.data, k)
-		res = append(res, v)
+	for _, s := range m.shards {
+		s.mut.Lock()
+		for k, v := range s.data {
+			delete(s.data, k)
+			res = append(res, v)
+		}
+		s.mut.Unlock()
 	}
 	return res
 }
 
 func (m *syncmap) load(k string) (interface{}, bool) {
-	m.mut.RLock()
-	defer m.mut.RUnlock()
-	v, ok := m.data[k]
+	s := m.shard(k)
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	v, ok := s.data[k]
 	return v, ok
 }
 
+func (m *syncmap) values() []interface{} {
+	var res []interface{}
+	for _, s := range m.shards {
+		s.mut.RLock()
+		for _, v := range s.data {
+			res = append(res, v)
+		}
+		s.mut.RUnlock()
+	}
+	return res
+}
+
+func (m *syncmap) items() map[string]interface{} {
+	res := make(map[string]interface{})
+	for _, s := range m.shards {
+		s.mut.RLock()
+		for k, v := range s.data {
+			res[k] = v
+		}
+		s.mut.RUnlock()
+	}
+	return res
+}
+
 func (m *syncmap) count() int {
-	m.mut.RLock()
-	defer m.mut.RUnlock()
-	return len(m.data)
+	res := 0
+	for _, s := range m.shards {
+		s.mut.RLock()
+		res += len(s.data)
+		s.mut.RUnlock()
+	}
+	return res
 }
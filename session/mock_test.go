@@ -60,6 +60,186 @@ principals:
   permissions:
   - action: sub
     permit: [test, talks, '$baidu/iot', '$link/data']
+`
+	testConfMaxTopicFilters = `
+session:
+  maxTopicFiltersPerPacket: 10
+`
+	testConfStatus = `
+session:
+  sysTopics: ["$SYS"]
+  status:
+    topic: $SYS/broker/status
+`
+	testConfDeliveryDeadline = `
+session:
+  deliveryDeadlines:
+  - topic: cmd/#
+    deadline: 200ms
+  deadLetterTopic: dead
+`
+	testConfRetainedHistory = `
+session:
+  retainedHistories:
+  - topic: history/#
+    count: 3
+`
+	testConfRetainedHistoryEncryption = `
+session:
+  retainedHistories:
+  - topic: history/#
+    count: 3
+  persistence:
+    queue:
+      encryption:
+        key: k1
+        keys:
+        - id: k1
+          secret: MDEyMzQ1Njc4OWFiY2RlZg==
+`
+	testConfReceiveMaximum = `
+session:
+  receiveMaximum: 2
+`
+	testConfEncryption = `
+session:
+  persistence:
+    queue:
+      encryption:
+        key: k1
+        keys:
+        - id: k1
+          secret: MDEyMzQ1Njc4OWFiY2RlZg==
+`
+	testConfEncryptionRotated = `
+session:
+  persistence:
+    queue:
+      encryption:
+        key: k2
+        keys:
+        - id: k1
+          secret: MDEyMzQ1Njc4OWFiY2RlZg==
+        - id: k2
+          secret: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=
+`
+	testConfSnapshot = `
+session:
+  persistence:
+    snapshot:
+      dir: var/lib/baetyl/snapshot
+      retain: 2
+`
+	testConfSnapshotInterval = `
+session:
+  persistence:
+    snapshot:
+      dir: var/lib/baetyl/snapshot
+      interval: 50ms
+      retain: 2
+`
+	testConfOrderedSessions = `
+session:
+  orderedSessions: [sub]
+`
+	testConfMaxRetainedPayloadSize = `
+session:
+  maxRetainedPayloadSize: 4
+`
+	testConfDeliverOversizedRetained = `
+session:
+  maxRetainedPayloadSize: 4
+  deliverOversizedRetained: true
+`
+	testConfUnsubscribeOnRevoke = `
+session:
+  unsubscribeOnRevoke: true
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: sub
+    permit: [a, b]
+  - action: pub
+    permit: ['#']
+`
+	testConfIdleCleanSessionTimeout = `
+session:
+  idleCleanSessionTimeout: 200ms
+`
+	testConfMaxWillPayloadSize = `
+session:
+  maxWillPayloadSize: 4
+`
+	testConfSendRetry = `
+session:
+  sendRetry:
+    max: 3
+    backoff: 10ms
+`
+	testConfEcho = `
+session:
+  sysTopics: ["$link", "$SYS"]
+  echo:
+    request: $SYS/echo/req
+    response: $SYS/echo/resp
+    rate: 2
+`
+	testConfResubscription = `
+session:
+  resubscription:
+    window: 200ms
+`
+	testConfRedaction = `
+session:
+  redaction:
+    mode: hash
+    topic: true
+`
+	testConfFairSession = `
+session:
+  fairSessions: ["sub"]
+`
+	testConfSpillQOS0 = `
+session:
+  maxInflightQOS0Messages: 2
+  maxSpilledQOS0Messages: 10
+`
+	testConfMaxRetainedPerSubscribe = `
+session:
+  maxRetainedPerSubscribe: 3
+`
+	testConfMaxRetainedHistoryPerSubscribe = `
+session:
+  maxRetainedPerSubscribe: 4
+  retainedHistories:
+  - topic: history/#
+    count: 3
+`
+	testConfAnomaly = `
+session:
+  anomaly:
+    window: 1m
+    authFailures: 2
+
+principals:
+- username: u1
+  password: p1
+`
+	testConfMaxInflightQOS1 = `
+session:
+  maxInflightQOS1Messages: 5
+`
+	testConfPublishRate = `
+session:
+  publishRate:
+    rate: 10
+    burst: 5
+`
+	testConfPersistenceShards = `
+session:
+  persistence:
+    shards: 3
 `
 	testCleanExpiredMags = `
 session:
@@ -1,10 +1,13 @@
 package session
 
 import (
+	stderrors "errors"
 	"io"
 	"regexp"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
@@ -14,16 +17,27 @@ import (
 	"github.com/docker/distribution/uuid"
 
 	"github.com/baetyl/baetyl-broker/v2/common"
+	"github.com/baetyl/baetyl-broker/v2/exchange"
+	"github.com/baetyl/baetyl-broker/v2/listener"
+	"github.com/baetyl/baetyl-broker/v2/queue"
 )
 
 // Client the client of MQTT
 type Client struct {
+	active    int64 // monotonic time of the latest traffic since epoch, the first field to be aligned for atomic operations
 	id        string
 	interval  time.Duration
 	anonymous bool
+	features  listener.Features
+	maxQOS    mqtt.QOS
+	inflight  chan struct{}   // inbound QOS1 messages whose pubacks are not sent
+	resubs    *resubscription // the topic filters subscribed within the reconciliation window of the resumed session
 	manager   *Manager
 	session   *Session
 	auth      *Authorizer
+	authMut   sync.RWMutex
+	authCache *authCache                       // the recent decisions of auth, nil if disabled
+	principal func(*Authenticator) *Authorizer // authenticates the client again, nil if not authenticated on connect
 	conn      mqtt.Connection
 	log       *log.Logger
 	tomb      utils.Tomb
@@ -37,6 +51,11 @@ type Client struct {
 
 // Handle the connection handler to create a new MQTT client
 func (m *Manager) Handle(conn mqtt.Connection, anonymous bool) {
+	m.HandleWithFeatures(conn, anonymous, listener.Features{})
+}
+
+// HandleWithFeatures the connection handler to create a new MQTT client with the features of listener
+func (m *Manager) HandleWithFeatures(conn mqtt.Connection, anonymous bool, features listener.Features) {
 	id := strings.ReplaceAll(uuid.Generate().String(), "-", "")
 	c := &Client{
 		id:        id,
@@ -44,12 +63,29 @@ func (m *Manager) Handle(conn mqtt.Connection, anonymous bool) {
 		manager:   m,
 		conn:      conn,
 		anonymous: anonymous,
+		features:  features,
+		maxQOS:    1,
 		log:       log.With(log.Any("type", "mqtt"), log.Any("id", id)),
 	}
+	c.touch()
+	m.anomaly.connect()
+	if features.MaxQOS != nil && mqtt.QOS(*features.MaxQOS) < c.maxQOS {
+		c.maxQOS = mqtt.QOS(*features.MaxQOS)
+	}
+	if m.cfg.ReceiveMaximum > 0 {
+		c.inflight = make(chan struct{}, m.cfg.ReceiveMaximum)
+	}
+	if m.cfg.MaxWriteDelay > 0 {
+		conn.SetMaxWriteDelay(m.cfg.MaxWriteDelay)
+	}
+	if m.cfg.AuthCacheSize > 0 {
+		c.authCache = newAuthCache(m.cfg.AuthCacheSize)
+	}
 
 	max := m.cfg.MaxClients
 	if max > 0 && m.clients.count() >= max {
 		c.log.Error("number of clients exceeds the limit", log.Any("max", max))
+		atomic.AddUint64(&m.failures.quota, 1)
 		err := conn.Close()
 		if err != nil {
 			c.log.Error("failed to close conn", log.Error(err))
@@ -119,6 +155,7 @@ func (c *Client) die(msg string, err error) {
 	})
 
 	if c.session != nil {
+		c.manager.anomaly.disconnect()
 		err := c.manager.delClient(c.session.ID())
 		if err != nil {
 			c.log.Error("failed to del client from manager", log.Error(err))
@@ -127,7 +164,60 @@ func (c *Client) die(msg string, err error) {
 }
 
 func (c *Client) authorize(action, topic string) bool {
-	return c.auth == nil || c.auth.Authorize(action, topic)
+	// the shared subscription is authorized by its topic filter
+	if _, filter, ok := exchange.SplitShared(topic); ok && action == Subscribe {
+		topic = filter
+	}
+	c.authMut.RLock()
+	defer c.authMut.RUnlock()
+	if c.auth == nil {
+		return true
+	}
+	if c.authCache == nil {
+		return c.auth.Authorize(action, topic)
+	}
+	// the cache is reset with the write lock when the authorizer is replaced, so no stale decision is put
+	if allowed, ok := c.authCache.get(action, topic); ok {
+		return allowed
+	}
+	allowed := c.auth.Authorize(action, topic)
+	c.authCache.put(action, topic, allowed)
+	return allowed
+}
+
+// epoch the reference of monotonic time, so that the idle duration is not affected by wall clock jumps
+var epoch = time.Now()
+
+// touch records the traffic of client
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.active, int64(time.Since(epoch)))
+}
+
+// idle returns the duration since the latest traffic of client
+func (c *Client) idle() time.Duration {
+	return time.Since(epoch) - time.Duration(atomic.LoadInt64(&c.active))
+}
+
+// reauthenticate authenticates the client again by the reloaded principals, returns false if not permitted,
+// all topics are permitted if no principal is reloaded, the same as the new connections
+func (c *Client) reauthenticate(a *Authenticator) bool {
+	if c.principal == nil {
+		return true
+	}
+	var auth *Authorizer
+	if a != nil {
+		auth = c.principal(a)
+		if auth == nil {
+			return false
+		}
+	}
+	c.authMut.Lock()
+	c.auth = auth
+	if c.authCache != nil {
+		c.authCache.reset()
+	}
+	c.authMut.Unlock()
+	return true
 }
 
 // SendWillMessage sends will message
@@ -139,49 +229,133 @@ func (c *Client) sendWillMessage() {
 	if msg == nil {
 		return
 	}
-	if msg.Context.Flags&0x1 == 0x1 {
+	if c.willRetained(msg) {
+		msg.Context.Flags |= 0x1
 		err := c.retainMessage(msg)
 		if err != nil {
-			c.log.Error("failed to retain will message", log.Any("topic", msg.Context.Topic))
+			c.log.Error("failed to retain will message", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(msg.Context.Topic)))
 		}
+	} else {
+		msg.Context.Flags &^= 0x1
+	}
+	err := c.manager.appendHistory(msg)
+	if err != nil {
+		c.log.Error("failed to append will message to retained history", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(msg.Context.Topic)), log.Error(err))
 	}
 	// change to normal message before exchange
 	msg.Context.Flags &^= 0x1
+	msg.Context.TS = uint64(common.Now().UnixNano())
 	c.manager.exch.Route(msg, c.callback)
 }
 
+// willRetained checks whether the will message is retained when published, the retain flag set by client is overridden
+// by the will retain policy, the will forced to be retained is not retained if not permitted
+func (c *Client) willRetained(msg *mqtt.Message) bool {
+	switch c.manager.cfg.WillRetainPolicy {
+	case "clear":
+		return false
+	case "set":
+		return !c.features.DisableRetain && !c.rejectsSysRetain(msg.Context.Topic)
+	default:
+		return msg.Context.Flags&0x1 == 0x1
+	}
+}
+
 func (c *Client) retainMessage(msg *mqtt.Message) error {
 	if len(msg.Content) == 0 {
 		return c.manager.unretainMessage(msg.Context.Topic)
 	}
+	if max := c.manager.cfg.MaxRetainedPayloadSize; max > 0 && len(msg.Content) > int(max) {
+		if c.manager.cfg.DeliverOversizedRetained {
+			c.log.Warn("retained message is not stored since its payload exceeds the max limit", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(msg.Context.Topic)), log.Any("size", len(msg.Content)))
+			return nil
+		}
+		c.log.Warn("retained message is rejected since its payload exceeds the max limit", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(msg.Context.Topic)), log.Any("size", len(msg.Content)))
+		return ErrSessionRetainedPayloadSizeExceedsLimit
+	}
 	return c.manager.retainMessage(msg)
 }
 
+// rejectsSysRetain checks whether the retained message of client on the topic is rejected, the $SYS topics are reserved by broker
+func (c *Client) rejectsSysRetain(topic string) bool {
+	return c.manager.cfg.SysRetainPolicy != "allow" && isSysTopic(topic)
+}
+
 // SendRetainMessage sends retain message
 func (c *Client) sendRetainMessage() error {
 	if c.session == nil {
 		return nil
 	}
 	msgs, err := c.manager.listRetainedMessages()
-	if err != nil || len(msgs) == 0 {
+	if err != nil {
 		return errors.Trace(err)
 	}
+	sys, err := c.manager.listSysMessages()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	msgs = append(msgs, sys...)
+	// the messages matched are ordered by topic, followed by the ones on $SYS topics and the retained histories
+	var matched []*mqtt.Message
 	// TODO: improve
 	for _, msg := range msgs {
-		if ok, qos := c.session.matchQOS(msg.Context.Topic); ok {
-			if msg.Context.QOS > qos {
-				msg.Context.QOS = qos
-			}
-			e := common.NewEvent(msg, 0, nil)
-			err = c.session.Push(e)
-			if err != nil {
-				return errors.Trace(err)
+		// the topic with retained history is delivered by its history
+		if c.manager.historyCount(msg.Context.Topic) > 0 {
+			continue
+		}
+		if ok, _ := c.session.matchQOS(msg.Context.Topic); ok {
+			matched = append(matched, msg)
+		}
+	}
+	for _, hs := range c.manager.listHistoryMessages() {
+		for _, h := range hs {
+			if ok, _ := c.session.matchQOS(h.Context.Topic); ok {
+				// copy, the history is shared by all sessions
+				matched = append(matched, &mqtt.Message{Context: h.Context, Content: append([]byte(nil), h.Content...)})
 			}
 		}
 	}
+	if max := c.manager.cfg.MaxRetainedPerSubscribe; max > 0 && len(matched) > max {
+		policy := c.manager.cfg.RetainedOverflowPolicy
+		c.log.Warn("retained messages matched exceed the max limit", log.Any("matched", len(matched)), log.Any("max", max), log.Any("policy", policy))
+		atomic.AddUint64(&c.manager.retainedOverflows, 1)
+		if policy == "reject" {
+			matched = nil
+		} else {
+			matched = matched[:max]
+		}
+	}
+	for _, msg := range matched {
+		err = c.pushRetainMessage(msg)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
 	return nil
 }
 
+func (c *Client) pushRetainMessage(msg *mqtt.Message) error {
+	ok, qos := c.session.matchQOS(msg.Context.Topic)
+	if !ok {
+		return nil
+	}
+	if t := c.manager.transformer; t != nil {
+		// msg is a copy of the stored one
+		msg = t(c.session.ID(), c.session.matchSubscriptions(msg.Context.Topic), msg)
+		if msg == nil {
+			return nil
+		}
+	}
+	// delivered by the minimum of the stored qos and the max qos granted to the matching subscriptions
+	if msg.Context.QOS > qos {
+		msg.Context.QOS = qos
+	}
+	// the retained message is accepted again when it is delivered to the new subscription
+	msg.Context.TS = uint64(common.Now().UnixNano())
+	e := common.NewEvent(msg, 0, nil)
+	return errors.Trace(c.session.Push(e))
+}
+
 // * ingress
 
 func (c *Client) receiving() error {
@@ -190,11 +364,12 @@ func (c *Client) receiving() error {
 
 	pkt, err := c.conn.Receive()
 	if err != nil {
+		c.manager.failures.countReceive(err)
 		c.die("failed to receive packet at first time", err)
 		return errors.Trace(err)
 	}
 	if ent := c.log.Check(log.DebugLevel, "client received a packet"); ent != nil {
-		data := pkt.String()
+		data := c.manager.cfg.Redaction.FormatPacket(pkt)
 		if len(data) > 200 {
 			data = data[:200]
 		}
@@ -202,10 +377,12 @@ func (c *Client) receiving() error {
 	}
 	p, ok := pkt.(*mqtt.Connect)
 	if !ok {
+		c.manager.connectFailed(ErrSessionClientPacketUnexpected)
 		c.die(ErrSessionClientPacketUnexpected.Error(), ErrSessionClientPacketUnexpected)
 		return ErrSessionClientPacketUnexpected
 	}
 	if err = c.onConnect(p); err != nil {
+		c.manager.connectFailed(err)
 		c.die("failed to handle connect packet", err)
 		return errors.Trace(err)
 	}
@@ -216,8 +393,9 @@ func (c *Client) receiving() error {
 			c.die("failed to receive packet", err)
 			return errors.Trace(err)
 		}
+		c.touch()
 		if ent := c.log.Check(log.DebugLevel, "client received a packet"); ent != nil {
-			data := pkt.String()
+			data := c.manager.cfg.Redaction.FormatPacket(pkt)
 			if len(data) > 200 {
 				data = data[:200]
 			}
@@ -286,7 +464,7 @@ func (c *Client) onConnect(p *mqtt.Connect) error {
 		return ErrSessionClientIDInvalid
 	}
 
-	if !c.anonymous && c.manager.auth != nil {
+	if auth := c.manager.authenticator(); !c.anonymous && auth != nil {
 		if p.Password != "" {
 			// username/password authentication
 			if p.Username == "" {
@@ -296,7 +474,11 @@ func (c *Client) onConnect(p *mqtt.Connect) error {
 				}
 				return ErrSessionUsernameNotSet
 			}
-			c.auth = c.manager.auth.AuthenticateAccount(p.Username, p.Password)
+			username, password := p.Username, p.Password
+			c.principal = func(a *Authenticator) *Authorizer {
+				return a.AuthenticateAccount(username, password)
+			}
+			c.auth = c.principal(auth)
 			if c.auth == nil {
 				err := c.sendConnack(mqtt.BadUsernameOrPassword, false)
 				if err != nil {
@@ -307,7 +489,10 @@ func (c *Client) onConnect(p *mqtt.Connect) error {
 		} else {
 			if cn, ok := mqtt.GetTLSCommonName(c.conn); ok {
 				// if it is bidirectional authentication, will use certificate authentication
-				c.auth = c.manager.auth.AuthenticateCertificate(cn)
+				c.principal = func(a *Authenticator) *Authorizer {
+					return a.AuthenticateCertificate(cn)
+				}
+				c.auth = c.principal(auth)
 				if c.auth == nil {
 					err := c.sendConnack(mqtt.BadUsernameOrPassword, false)
 					if err != nil {
@@ -325,24 +510,40 @@ func (c *Client) onConnect(p *mqtt.Connect) error {
 		}
 	}
 
+	if max := c.manager.cfg.MaxWillPayloadSize; p.Will != nil && max > 0 && len(p.Will.Payload) > int(max) {
+		if c.manager.cfg.OversizedWillPolicy != "drop" {
+			return ErrSessionWillMessagePayloadSizeExceedsLimit
+		}
+		c.log.Warn("oversized will message is dropped", log.Any("size", len(p.Will.Payload)))
+		p.Will = nil
+	}
 	if p.Will != nil {
 		if len(p.Will.Payload) > int(c.manager.cfg.MaxMessagePayloadSize) {
 			return ErrSessionWillMessagePayloadSizeExceedsLimit
 		}
-		if p.Will.QOS > 1 {
+		if p.Will.QOS > c.maxQOS {
 			return ErrSessionWillMessageQosNotSupported
 		}
+		// the retain flag cleared by broker is not checked
+		if p.Will.Retain && c.manager.cfg.WillRetainPolicy != "clear" && (c.features.DisableRetain || c.rejectsSysRetain(p.Will.Topic)) {
+			return ErrSessionWillMessageRetainNotPermitted
+		}
 		if !c.manager.checker.CheckTopic(p.Will.Topic, false) {
 			return ErrSessionWillMessageTopicInvalid
 		}
+		// the will is published on behalf of the client later, so it is authorized as a publish now
 		if !c.authorize(Publish, p.Will.Topic) {
-			err := c.sendConnack(mqtt.NotAuthorized, false)
-			if err != nil {
-				c.log.Error("faile to sen connack", log.Error(err))
+			if c.manager.cfg.UnauthorizedWillPolicy != "drop" {
+				err := c.sendConnack(mqtt.NotAuthorized, false)
+				if err != nil {
+					c.log.Error("faile to sen connack", log.Error(err))
+				}
+				return ErrSessionWillMessageTopicNotPermitted
 			}
-			return ErrSessionWillMessageTopicNotPermitted
+			c.log.Warn("will message whose topic is not permitted is dropped", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(p.Will.Topic)))
+		} else {
+			si.WillMessage = common.NewMessage(&mqtt.Publish{Message: *p.Will})
 		}
-		si.WillMessage = common.NewMessage(&mqtt.Publish{Message: *p.Will})
 	}
 
 	s, exists, err := c.manager.addClient(si, c)
@@ -361,52 +562,117 @@ func (c *Client) onConnect(p *mqtt.Connect) error {
 	c.log.Info("client is connected")
 
 	c.tomb.Go(c.sending, c.resending)
+	if exists && !p.CleanSession && c.manager.cfg.Resubscription.Policy != "union" {
+		c.resubs = &resubscription{topics: map[string]struct{}{}}
+		c.tomb.Go(c.reconciling)
+	}
 
 	return nil
 }
 
 func (c *Client) onPublish(p *mqtt.Publish) error {
-	// TODO: improvement, cache auth result
+	// a publish without topic is a protocol error, MQTT 3.1.1 has no topic alias to resolve it
+	if p.Message.Topic == "" {
+		return ErrSessionMessageTopicEmpty
+	}
 	if len(p.Message.Payload) > int(c.manager.cfg.MaxMessagePayloadSize) {
 		return ErrSessionMessagePayloadSizeExceedsLimit
 	}
-	if p.Message.QOS > 1 {
+	if p.Message.QOS > c.maxQOS {
 		return ErrSessionMessageQosNotSupported
 	}
+	if p.Message.Retain && c.features.DisableRetain {
+		return ErrSessionMessageRetainNotPermitted
+	}
 	if !c.manager.checker.CheckTopic(p.Message.Topic, false) {
 		return ErrSessionMessageTopicInvalid
 	}
 	if !c.authorize(Publish, p.Message.Topic) {
 		return ErrSessionMessageTopicNotPermitted
 	}
+	if err := c.throttle(); err != nil {
+		return err
+	}
 	msg := common.NewMessage(p)
+	msg.Context.TS = uint64(common.Now().UnixNano())
+	if c.manager.echo != nil && msg.Context.Topic == c.manager.cfg.Echo.Request {
+		return c.echo(msg)
+	}
 	if msg.Context.Flags&0x1 == 0x1 {
+		if c.rejectsSysRetain(msg.Context.Topic) {
+			return ErrSessionMessageRetainNotPermitted
+		}
 		err := c.retainMessage(msg)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		// change to normal message before exch
-		msg.Context.Flags &^= 0x1
 	}
+	err := c.manager.appendHistory(msg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// change to normal message before exch
+	msg.Context.Flags &^= 0x1
+	return c.route(msg)
+}
+
+// route routes the message published by client to the subscribers
+func (c *Client) route(msg *mqtt.Message) error {
 	cb := c.callback
-	if p.Message.QOS == 0 {
+	if msg.Context.QOS == 0 {
 		cb = nil
+	} else if err := c.acquireInflight(); err != nil {
+		return err
+	}
+	err := c.manager.exch.Route(msg, cb)
+	// the puback is sent only after the message is persisted by all the subscribers' queues, if any fails
+	// the client is closed to make the publisher resend, since the puback of MQTT 3.1.1 can't carry a reason code,
+	// and the closed queue of a closing session is not a failure
+	if err != nil && msg.Context.QOS > 0 && errors.Cause(err) != queue.ErrQueueClosed {
+		return ErrSessionMessagePersistFailed
 	}
-	c.manager.exch.Route(msg, cb)
 	return nil
 }
 
+// acquireInflight waits until the count of inbound QOS1 messages in flight is less than the receive maximum,
+// the connection is not read during waiting
+func (c *Client) acquireInflight() error {
+	if c.inflight == nil {
+		return nil
+	}
+	select {
+	case c.inflight <- struct{}{}:
+		return nil
+	default:
+	}
+	c.log.Debug("client pauses receiving since inbound messages in flight reach the receive maximum", log.Any("max", cap(c.inflight)))
+	select {
+	case c.inflight <- struct{}{}:
+		return nil
+	case <-c.tomb.Dying():
+		return ErrSessionClientAlreadyClosed
+	}
+}
+
 func (c *Client) onSubscribe(p *mqtt.Subscribe) error {
 	// MQTT-3.8.3-3: A SUBSCRIBE packet with no payload is a protocol violation
 	if len(p.Subscriptions) == 0 {
 		return ErrSessionSubscribePayloadEmpty
 	}
+	// reject the oversized packet before it holds the session lock and the exchange
+	if len(p.Subscriptions) > c.manager.cfg.MaxTopicFiltersPerPacket {
+		return ErrSessionTopicFiltersExceedsLimit
+	}
 
 	sa, subs := c.genSuback(p)
+	subs = c.resubscribe(p, sa, subs)
+	subs = c.atomicSubscribe(sa, subs)
 	err := c.session.subscribe(subs, sa, c.authorize)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	// the suback is sent after the subscriptions are bound in the exchange, so that the messages published
+	// once the suback is received are delivered, the embedders can rely on it instead of waiting for a while
 	err = c.send(sa, false)
 	if err != nil {
 		return errors.Trace(err)
@@ -415,9 +681,21 @@ func (c *Client) onSubscribe(p *mqtt.Subscribe) error {
 }
 
 func (c *Client) onUnsubscribe(p *mqtt.Unsubscribe) error {
+	if len(p.Topics) > c.manager.cfg.MaxTopicFiltersPerPacket {
+		return ErrSessionTopicFiltersExceedsLimit
+	}
 	usa := mqtt.NewUnsuback()
 	usa.ID = p.ID
-	c.session.unsubscribe(p.Topics)
+	// UNSUBACK is always sent, MQTT 3.1.1 has no reason code to tell that a topic filter was not subscribed
+	res, err := c.session.unsubscribe(p.Topics)
+	if err != nil {
+		c.log.Error("failed to unsubscribe", log.Error(err))
+	}
+	for i, ok := range res {
+		if !ok {
+			c.log.Debug("unsubscribe topic not subscribed", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(p.Topics[i])))
+		}
+	}
 	return c.send(usa, false)
 }
 
@@ -430,6 +708,12 @@ func (c *Client) callback(id uint64) {
 	if err != nil {
 		c.log.Error("faile to sen puback", log.Any("id", id), log.Error(err))
 	}
+	if c.inflight != nil {
+		select {
+		case <-c.inflight:
+		default:
+		}
+	}
 }
 
 func (c *Client) genSuback(p *mqtt.Subscribe) (*mqtt.Suback, []mqtt.Subscription) {
@@ -439,16 +723,26 @@ func (c *Client) genSuback(p *mqtt.Subscribe) (*mqtt.Suback, []mqtt.Subscription
 	}
 	var subs []mqtt.Subscription
 	for i, sub := range p.Subscriptions {
-		if !c.manager.checker.CheckTopic(sub.Topic, true) {
-			c.log.Error("subscribe topic invalid", log.Any("topic", sub.Topic))
+		if c.features.DisableSharedSubscription && strings.HasPrefix(sub.Topic, exchange.SharedPrefix) {
+			c.log.Error("shared subscription is disabled", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(sub.Topic)))
+			sa.ReturnCodes[i] = mqtt.QOSFailure
+		} else if c.features.DisableWildcard && strings.ContainsAny(sub.Topic, "+#") {
+			c.log.Error("wildcard subscription is disabled", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(sub.Topic)))
+			sa.ReturnCodes[i] = mqtt.QOSFailure
+		} else if !c.checkTopicFilter(sub.Topic) {
+			c.log.Error("subscribe topic invalid", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(sub.Topic)))
 			sa.ReturnCodes[i] = mqtt.QOSFailure
 		} else if sub.QOS > 1 {
 			c.log.Error("subscribe QOS not supported", log.Any("qos", int(sub.QOS)))
 			sa.ReturnCodes[i] = mqtt.QOSFailure
 		} else if !c.authorize(Subscribe, sub.Topic) {
-			c.log.Error("subscribe topic not permitted", log.Any("topic", sub.Topic))
+			c.log.Error("subscribe topic not permitted", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(sub.Topic)))
 			sa.ReturnCodes[i] = mqtt.QOSFailure
 		} else {
+			// grants the max QoS of listener if the requested QoS is higher
+			if sub.QOS > c.maxQOS {
+				sub.QOS = c.maxQOS
+			}
 			sa.ReturnCodes[i] = sub.QOS
 			subs = append(subs, sub)
 		}
@@ -456,25 +750,162 @@ func (c *Client) genSuback(p *mqtt.Subscribe) (*mqtt.Suback, []mqtt.Subscription
 	return sa, subs
 }
 
+// atomicSubscribe rejects all the topic filters of the subscribe if any is rejected in atomic subscribe policy,
+// returns the subscriptions to be subscribed
+func (c *Client) atomicSubscribe(sa *mqtt.Suback, subs []mqtt.Subscription) []mqtt.Subscription {
+	if c.manager.cfg.SubscribePolicy != "atomic" || !rejectSuback(sa) {
+		return subs
+	}
+	c.log.Warn("rejected all topic filters of the subscribe since some are rejected", log.Any("id", int(sa.ID)))
+	return nil
+}
+
+// rejectSuback sets all the return codes of the suback to failure if any is failure, returns whether any is failure
+func rejectSuback(sa *mqtt.Suback) bool {
+	failed := false
+	for _, rc := range sa.ReturnCodes {
+		if rc == mqtt.QOSFailure {
+			failed = true
+			break
+		}
+	}
+	if failed {
+		for i := range sa.ReturnCodes {
+			sa.ReturnCodes[i] = mqtt.QOSFailure
+		}
+	}
+	return failed
+}
+
+// checkTopicFilter checks the topic filter to subscribe, the shared subscription is checked by its group and topic filter
+func (c *Client) checkTopicFilter(topic string) bool {
+	if !strings.HasPrefix(topic, exchange.SharedPrefix) {
+		return c.manager.checker.CheckTopic(topic, true)
+	}
+	group, filter, ok := exchange.SplitShared(topic)
+	return ok && !strings.ContainsAny(group, "+#") && c.manager.checker.CheckTopic(filter, true)
+}
+
+// resubscription tracks the topic filters subscribed within the reconciliation window, closed if topics is nil
+type resubscription struct {
+	topics map[string]struct{}
+	mut    sync.Mutex
+}
+
+// resubscribe applies the resubscription policy to the subscriptions within the reconciliation window,
+// returns the subscriptions to be subscribed
+func (c *Client) resubscribe(p *mqtt.Subscribe, sa *mqtt.Suback, subs []mqtt.Subscription) []mqtt.Subscription {
+	if c.resubs == nil {
+		return subs
+	}
+	c.resubs.mut.Lock()
+	defer c.resubs.mut.Unlock()
+	if c.resubs.topics == nil {
+		return subs
+	}
+	if c.manager.cfg.Resubscription.Policy == "replace" {
+		for _, sub := range subs {
+			c.resubs.topics[sub.Topic] = struct{}{}
+		}
+		return subs
+	}
+	// keeps the stored subscriptions, their QoS is not changed
+	stored := c.session.subscriptions()
+	for i, sub := range p.Subscriptions {
+		if sa.ReturnCodes[i] == mqtt.QOSFailure {
+			continue
+		}
+		if qos, ok := stored[sub.Topic]; ok {
+			sa.ReturnCodes[i] = qos
+			continue
+		}
+		c.log.Warn("rejected a subscription not stored when the session resumed", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(sub.Topic)))
+		sa.ReturnCodes[i] = mqtt.QOSFailure
+	}
+	return nil
+}
+
+// reconciling closes the reconciliation window, and removes the stored subscriptions not subscribed again
+// within the window if the policy is "replace"
+func (c *Client) reconciling() error {
+	timer := time.NewTimer(c.manager.cfg.Resubscription.Window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.tomb.Dying():
+		return nil
+	}
+
+	c.resubs.mut.Lock()
+	defer c.resubs.mut.Unlock()
+	resubs := c.resubs.topics
+	c.resubs.topics = nil
+	if c.manager.cfg.Resubscription.Policy != "replace" {
+		return nil
+	}
+	var topics []string
+	for topic := range c.session.subscriptions() {
+		if _, ok := resubs[topic]; !ok {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+	c.log.Info("removed the subscriptions not subscribed again when the session resumed", log.Any("topics", c.manager.cfg.Redaction.FormatTopics(topics)))
+	_, err := c.session.unsubscribe(topics)
+	if err != nil {
+		c.log.Error("failed to remove the subscriptions", log.Error(err))
+	}
+	return nil
+}
+
 // * egress
 
 func (c *Client) send(pkt mqtt.Packet, async bool) error {
+	return c.sendRetry(pkt, async, 0)
+}
+
+// sendRetry sends a packet, and retries at most the given times with exponential backoff if the connection fails transiently
+func (c *Client) sendRetry(pkt mqtt.Packet, async bool, retries int) error {
 	if !c.tomb.Alive() {
 		return ErrSessionClientAlreadyClosed
 	}
-	c.mut.Lock()
-	err := c.conn.Send(pkt, async)
-	c.mut.Unlock()
-	if err != nil {
-		c.die("failed to send packet", err)
-		return err
+	backoff := c.manager.cfg.SendRetry.Backoff
+	for i := 0; ; i++ {
+		c.mut.Lock()
+		err := c.conn.Send(pkt, async)
+		c.mut.Unlock()
+		if err == nil {
+			break
+		}
+		if i >= retries || !isTransient(err) {
+			c.die("failed to send packet", err)
+			return err
+		}
+		c.log.Warn("failed to send packet, will retry", log.Any("retries", i+1), log.Any("backoff", backoff), log.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-c.tomb.Dying():
+			return ErrSessionClientAlreadyClosed
+		}
+		if backoff *= 2; backoff > c.manager.cfg.SendRetry.MaxBackoff {
+			backoff = c.manager.cfg.SendRetry.MaxBackoff
+		}
 	}
+	c.touch()
 	if ent := c.log.Check(log.DebugLevel, "client sent a packet"); ent != nil {
-		ent.Write(log.Any("packet", pkt.String()))
+		ent.Write(log.Any("packet", c.manager.cfg.Redaction.FormatPacket(pkt)))
 	}
 	return nil
 }
 
+// isTransient checks whether the error is temporary, such as the write buffer is full
+func isTransient(err error) bool {
+	var te interface{ Temporary() bool }
+	return stderrors.As(errors.Cause(err), &te) && te.Temporary()
+}
+
 func (c *Client) sendConnack(code mqtt.ConnackCode, exists bool) error {
 	ack := &mqtt.Connack{
 		SessionPresent: exists,
@@ -483,8 +914,12 @@ func (c *Client) sendConnack(code mqtt.ConnackCode, exists bool) error {
 	return c.send(ack, false)
 }
 
-func (c *Client) sendEvent(m *eventWrapper, dup bool) (err error) {
-	return c.send(m.packet(dup), true)
+// sendEvent sends the message, the asynchronous write may be buffered and coalesced with the following ones
+func (c *Client) sendEvent(m *eventWrapper, dup, async bool) (err error) {
+	if m.qos == 1 {
+		return c.sendRetry(m.packet(dup), async, c.manager.cfg.SendRetry.Max)
+	}
+	return c.send(m.packet(dup), async)
 }
 
 func (c *Client) sending() error {
@@ -492,52 +927,129 @@ func (c *Client) sending() error {
 	defer c.log.Info("client has stopped sending messages")
 
 	var msg *eventWrapper
+	// the event popped latest, logged if the delivery panics
+	var evt *common.Event
+	defer c.recoverSending(&evt)
 	qos0 := c.session.qos0msg.Chan()
 	qos1 := c.session.qos1msg.Chan()
 	queue := c.session.qos1ack
 	cache := c.session.qos1pkt
 	for {
 		if msg != nil {
-			if err := c.sendEvent(msg, false); err != nil {
+			// the buffered messages are flushed with the last pending one so that low-volume subscribers are not delayed
+			if err := c.sendEvent(msg, false, len(qos0) > 0 || len(qos1) > 0); err != nil {
 				c.log.Debug("failed to send message", log.Error(err))
 				return nil
 			}
 			if msg.qos == 1 {
+				if c.manager.cfg.QOS1Commit == "written" {
+					// the popped message is committed once written, while it is still resent until acknowledged,
+					// and kept in the inflight window, the commit by the acknowledgement later is a no-op
+					msg.Done()
+				}
 				select {
 				case queue <- msg:
-				case <-c.tomb.Dying():
-					return nil
+				default:
+					// the window is saturated until an acknowledgement arrives
+					since := c.saturateInflight()
+					select {
+					case queue <- msg:
+						c.recoverInflight(since)
+					case <-c.tomb.Dying():
+						atomic.StoreInt64(&c.session.saturated, 0)
+						return nil
+					}
 				}
 			}
+			// the sent message must not be sent again if the next one is dropped
+			msg = nil
 		}
 		select {
-		case evt := <-qos0:
+		case evt = <-qos0:
 			if ent := c.log.Check(log.DebugLevel, "queue popped a message as qos 0"); ent != nil {
-				ent.Write(log.Any("message", evt.String()))
+				ent.Write(log.Any("message", c.manager.cfg.Redaction.FormatMessage(evt.Message)))
 			}
 			if !c.authorize(Subscribe, evt.Context.Topic) {
-				c.log.Warn("dropped a message whose topic is not permitted when sending", log.Any("topic", evt.Context.Topic))
+				c.log.Warn("dropped a message whose topic is not permitted when sending", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(evt.Context.Topic)))
+				continue
+			}
+			if c.exceedsDeadline(evt) {
 				continue
 			}
 			msg = newEventWrapper(0, 0, evt)
-		case evt := <-qos1:
+		case evt = <-qos1:
 			if ent := c.log.Check(log.DebugLevel, "queue popped a message as qos 1"); ent != nil {
-				ent.Write(log.Any("message", evt.String()))
+				ent.Write(log.Any("message", c.manager.cfg.Redaction.FormatMessage(evt.Message)))
 			}
 			if !c.authorize(Subscribe, evt.Context.Topic) {
-				c.log.Warn("dropped a message whose topic is not permitted when sending", log.Any("topic", evt.Context.Topic))
+				c.log.Warn("dropped a message whose topic is not permitted when sending", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(evt.Context.Topic)))
+				continue
+			}
+			if c.exceedsDeadline(evt) {
+				// commit to remove the message from queue after the ones in flight before it
+				c.skip(cache, evt)
 				continue
 			}
+			if evt.Context.QOS == 0 {
+				// the message of ordered session delivered as QoS 0 needs no acknowledgement from client,
+				// it is committed after the ones in flight before it
+				c.skip(cache, evt)
+				msg = newEventWrapper(0, 0, evt)
+				break
+			}
 			msg = c.wrap(evt)
 			if err := cache.store(msg); err != nil {
 				c.log.Error(err.Error())
 			}
+		case <-c.session.quit:
+			return nil
 		case <-c.tomb.Dying():
 			return nil
 		}
 	}
 }
 
+// skip commits the qos1 event popped but not sent as qos 1, the queue deletes all the messages before the offset
+// committed, so the event is committed after the messages in flight before it instead of immediately
+func (c *Client) skip(cache *cache, evt *common.Event) {
+	if c.manager.cfg.QOS1Commit == "written" {
+		// the messages before it are committed once written
+		evt.Done()
+		return
+	}
+	cache.skip(evt)
+}
+
+// recoverSending recovers the panic of sending, such as on a malformed message, and closes the client with the reason,
+// so that only the failed session is affected instead of crashing the broker
+func (c *Client) recoverSending(evt **common.Event) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	fields := []log.Field{log.Any("panic", r), log.Any("stack", string(debug.Stack()))}
+	if e := *evt; e != nil && e.Message != nil {
+		fields = append(fields, log.Any("message", c.manager.cfg.Redaction.FormatMessage(e.Message)))
+	}
+	c.log.Error("client recovered from a panic when sending messages", fields...)
+	c.die("client is closed since sending messages panicked", ErrSessionDeliveryPanicked)
+}
+
+// exceedsDeadline checks whether the message is not sent before its delivery deadline,
+// the message is sent to the dead letter topic if exceeds
+func (c *Client) exceedsDeadline(evt *common.Event) bool {
+	if evt.Context.TS == 0 {
+		return false
+	}
+	deadline := c.manager.deliveryDeadline(evt.Context.Topic)
+	if deadline <= 0 || evt.Age() < deadline {
+		return false
+	}
+	c.log.Warn("dropped a message which is not sent before its delivery deadline", log.Any("topic", c.manager.cfg.Redaction.FormatTopic(evt.Context.Topic)), log.Any("deadline", deadline))
+	c.manager.sendDeadLetter(evt.Message)
+	return true
+}
+
 func (c *Client) resending() error {
 	c.log.Info("client starts to resend messages", log.Any("interval", c.interval))
 	defer c.log.Info("client has stopped resending messages")
@@ -552,8 +1064,8 @@ func (c *Client) resending() error {
 			case <-timer.C:
 			default:
 			}
-			for timer.Reset(c.next(msg)); msg.Wait(timer.C, c.tomb.Dying()) == common.ErrAcknowledgeTimedOut; timer.Reset(c.interval) {
-				if err := c.sendEvent(msg, true); err != nil {
+			for timer.Reset(c.next(msg)); msg.wait(timer.C, c.tomb.Dying()) == common.ErrAcknowledgeTimedOut; timer.Reset(c.interval) {
+				if err := c.sendEvent(msg, true, true); err != nil {
 					c.log.Debug("failed to resend message", log.Error(err))
 					return nil
 				}
@@ -561,6 +1073,8 @@ func (c *Client) resending() error {
 		}
 		select {
 		case msg = <-queue:
+		case <-c.session.quit:
+			return nil
 		case <-c.tomb.Dying():
 			return nil
 		}
@@ -1,16 +1,32 @@
 package session
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"os"
+	"path"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+	"github.com/baetyl/baetyl-broker/v2/listener"
+	"github.com/baetyl/baetyl-broker/v2/store"
 )
 
 func TestSessionMqttConnect(t *testing.T) {
@@ -63,7 +79,7 @@ func TestSessionMqttConnect(t *testing.T) {
 	b.manager.Handle(c, false)
 
 	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), CleanSession: true, Version: 3})
-	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
 	b.waitClientReady(t.Name(), false)
 	b.assertSessionStore(t.Name(), "", errors.New("pebble: not found"))
 	b.assertSessionCount(1)
@@ -595,19 +611,18 @@ func TestSessionMqttCleanSession(t *testing.T) {
 	sub = newMockConn(t)
 	b.manager.Handle(sub, false)
 	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
-	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	// * the persistent session is discarded with its subscriptions when cleansession=true
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
 	b.assertSessionStore("sub", "", errors.New("pebble: not found"))
-	b.assertExchangeCount(1)
+	b.assertExchangeCount(0)
 
 	pub.assertS2CPacketTimeout()
 	sub.assertS2CPacketTimeout()
 
 	pub.sendC2S(pktpub0)
-	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=686930> Dup=false>")
 	pub.sendC2S(pktpub1)
 	pub.assertS2CPacket("<Puback ID=1>")
-	sub.assertS2CPacket("<Publish ID=3 Message=<Message Topic=\"test\" QOS=1 Retain=false Payload=686931> Dup=false>")
-	sub.sendC2S(&mqtt.Puback{ID: 1})
+	sub.assertS2CPacketTimeout()
 	sub.sendC2S(&mqtt.Disconnect{})
 	sub.assertS2CPacketTimeout()
 	sub.assertClosed(true)
@@ -744,15 +759,15 @@ func TestSessionMqttAllStates(t *testing.T) {
 	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"subs\":{\"test\":1}}", nil)
 	b.assertExchangeCount(1)
 
-	// [cleansession=true] c connects again, session is in state1
+	// [cleansession=true] c connects again, the persistent session is discarded, session is in state0
 	c = newMockConn(t)
 	b.manager.Handle(c, false)
 	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), CleanSession: true, Version: 3})
-	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
 	b.assertSessionStore(t.Name(), "", errors.New("pebble: not found"))
-	b.assertExchangeCount(1)
+	b.assertExchangeCount(0)
 
-	// [cleansession=true] c unsubscribes, session is removed
+	// [cleansession=true] c unsubscribes, nothing is changed
 	c.sendC2S(&mqtt.Unsubscribe{ID: 4, Topics: []string{"test"}})
 	c.assertS2CPacket("<Unsuback ID=4>")
 	b.assertSessionStore(t.Name(), "", errors.New("pebble: not found"))
@@ -1383,6 +1398,2904 @@ func TestSessionMqttRetain(t *testing.T) {
 	assert.Equal(t, []byte("hi"), msgs[0].Content)
 }
 
+func TestSessionMqttMaxTopicFiltersPerPacket(t *testing.T) {
+	b := newMockBroker(t, testConfMaxTopicFilters)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	genSubs := func(n int) []mqtt.Subscription {
+		subs := make([]mqtt.Subscription, n)
+		for i := range subs {
+			subs[i] = mqtt.Subscription{Topic: "test/" + strconv.Itoa(i), QOS: 1}
+		}
+		return subs
+	}
+
+	// the limit is permitted
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: genSubs(10)})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 1, 1, 1, 1, 1, 1, 1, 1, 1]>")
+	b.assertExchangeCount(10)
+
+	// unsubscribe exceeds the limit
+	topics := make([]string, 11)
+	for i := range topics {
+		topics[i] = "test/" + strconv.Itoa(i)
+	}
+	c.sendC2S(&mqtt.Unsubscribe{ID: 2, Topics: topics})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+	b.waitClientReady(t.Name(), true)
+	b.assertExchangeCount(10)
+
+	// an oversized subscribe is rejected before it is processed
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+
+	c.sendC2S(&mqtt.Subscribe{ID: 3, Subscriptions: genSubs(100000)})
+	b.waitClientReady(t.Name(), true)
+	c.assertClosed(true)
+	c.assertS2CPacketTimeout()
+	b.assertExchangeCount(10)
+	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"subs\":{\"test/0\":1,\"test/1\":1,\"test/2\":1,\"test/3\":1,\"test/4\":1,\"test/5\":1,\"test/6\":1,\"test/7\":1,\"test/8\":1,\"test/9\":1}}", nil)
+}
+
+func TestSessionMqttBrokerStatus(t *testing.T) {
+	b := newMockBroker(t, testConfStatus)
+
+	// the online status is retained after startup, apart from the retained messages of clients
+	msgs, err := b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 0)
+	msgs, err = b.manager.listSysMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "$SYS/broker/status", msgs[0].Context.Topic)
+	assert.Equal(t, []byte("online"), msgs[0].Content)
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$SYS/broker/status"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"$SYS/broker/status\" QOS=0 Retain=true Payload=6f6e6c696e65> Dup=false>")
+
+	// the offline status is retained after shutdown
+	b.close()
+	b = newMockBrokerNotClean(t, testConfDefault)
+	defer b.closeAndClean()
+	msgs, err = b.manager.listSysMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "$SYS/broker/status", msgs[0].Context.Topic)
+	assert.Equal(t, []byte("offline"), msgs[0].Content)
+	assert.Equal(t, uint32(0x1), msgs[0].Context.Flags)
+
+	// invalid status topic
+	var cfg Config
+	err = utils.UnmarshalYAML([]byte("session:\n  status:\n    topic: $SYS/broker/status\n"), &cfg)
+	assert.NoError(t, err)
+	_, err = NewManager(cfg)
+	assert.Equal(t, ErrSessionStatusTopicInvalid, err)
+}
+
+func TestSessionMqttDeliveryDeadline(t *testing.T) {
+	b := newMockBroker(t, testConfDeliveryDeadline)
+	defer b.closeAndClean()
+
+	// sub subscribes and goes offline
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "cmd/a", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	sub.sendC2S(&mqtt.Disconnect{})
+	sub.assertS2CPacketTimeout()
+	sub.assertClosed(true)
+	b.waitClientReady("sub", true)
+
+	dl := newMockConn(t)
+	b.manager.Handle(dl, false)
+	dl.sendC2S(&mqtt.Connect{ClientID: "dl", Version: 3})
+	dl.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	dl.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "dead/#"}}})
+	dl.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "cmd/a"
+	pktpub.Message.Payload = []byte("c1")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	// sub comes back after the deadline, the message is dropped and sent to the dead letter topic
+	time.Sleep(time.Millisecond * 300)
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	sub.assertS2CPacketTimeout()
+	dl.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"dead/cmd/a\" QOS=0 Retain=false Payload=6331> Dup=false>")
+
+	// the message sent in time is delivered
+	pktpub.ID = 2
+	pktpub.Message.Payload = []byte("c2")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=2>")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"cmd/a\" QOS=1 Retain=false Payload=6332> Dup=false>")
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+	dl.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttDeliveryDeadlineCommit(t *testing.T) {
+	b := newMockBroker(t, testConfDeliveryDeadline)
+
+	route := func(topic, payload string, ts uint64) {
+		m := &mqtt.Message{Content: []byte(payload)}
+		m.Context.Topic = topic
+		m.Context.QOS = 1
+		m.Context.TS = ts
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}, {Topic: "cmd/a", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 1]>")
+
+	// the qos1 message is not acknowledged, and the message after it is dropped at its deadline
+	route("a", "1", uint64(common.Now().UnixNano()))
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=31> Dup=false>")
+	route("cmd/a", "2", uint64(common.Now().Add(-time.Second).UnixNano()))
+	sub.assertS2CPacketTimeout()
+	time.Sleep(b.manager.cfg.Persistence.Queue.DeleteTimeout * 2)
+	b.close()
+
+	// the qos1 message is not deleted by the commit of the one dropped after it
+	b = newMockBrokerNotClean(t, testConfDeliveryDeadline)
+	defer b.closeAndClean()
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=31> Dup=false>")
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+	sub.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttDeliveryDeadlineClockJump(t *testing.T) {
+	b := newMockBroker(t, testConfDeliveryDeadline)
+	defer b.closeAndClean()
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "cmd/a", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// the wall clock jumps forward and backward, the messages are delivered
+	for i, jump := range []time.Duration{time.Hour, -time.Hour} {
+		restore := common.SetClock(func() time.Time { return time.Now().Add(jump) })
+		pktpub := &mqtt.Publish{ID: mqtt.ID(i + 1)}
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = "cmd/a"
+		pktpub.Message.Payload = []byte("c1")
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i+1))
+		sub.assertS2CPacket(fmt.Sprintf("<Publish ID=%d Message=<Message Topic=\"cmd/a\" QOS=1 Retain=false Payload=6331> Dup=false>", i+1))
+		sub.sendC2S(&mqtt.Puback{ID: mqtt.ID(i + 1)})
+		pktpub = &mqtt.Publish{}
+		pktpub.Message.Topic = "cmd/a"
+		pktpub.Message.Payload = []byte("c0")
+		pub.sendC2S(pktpub)
+		sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"cmd/a\" QOS=0 Retain=false Payload=6330> Dup=false>")
+		restore()
+	}
+}
+
+// holdQueue holds the events without acknowledgement
+type holdQueue chan *common.Event
+
+func (q holdQueue) Push(e *common.Event) error {
+	q <- e
+	return nil
+}
+
+func (q holdQueue) ID() string {
+	return "hold"
+}
+
+func TestSessionMqttReceiveMaximum(t *testing.T) {
+	b := newMockBroker(t, testConfReceiveMaximum)
+	defer b.closeAndClean()
+
+	q := make(holdQueue, 10)
+	b.manager.exch.Bind("hold", q)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	for i := 1; i <= 3; i++ {
+		pkt := &mqtt.Publish{ID: mqtt.ID(i)}
+		pkt.Message.QOS = 1
+		pkt.Message.Topic = "hold"
+		pkt.Message.Payload = []byte("hi")
+		pub.sendC2S(pkt)
+	}
+	pub.sendC2S(&mqtt.Pingreq{})
+
+	// the third message is not processed and the connection is not read before a puback sent
+	e1 := <-q
+	e2 := <-q
+	select {
+	case e := <-q:
+		assert.FailNow(t, "unexpected message", e.String())
+	case <-time.After(time.Millisecond * 100):
+	}
+	pub.assertS2CPacketTimeout()
+
+	e1.Done()
+	pub.assertS2CPacket("<Puback ID=1>")
+	e3 := <-q
+	pub.assertS2CPacket("<Pingresp>")
+
+	e2.Done()
+	pub.assertS2CPacket("<Puback ID=2>")
+	e3.Done()
+	pub.assertS2CPacket("<Puback ID=3>")
+}
+
+func TestSessionMqttListenerFeatures(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	maxQOS := uint32(0)
+	internal := listener.Features{}
+	external := listener.Features{
+		MaxQOS:                    &maxQOS,
+		DisableRetain:             true,
+		DisableWildcard:           true,
+		DisableSharedSubscription: true,
+	}
+
+	subs := []mqtt.Subscription{{Topic: "test", QOS: 1}, {Topic: "test/#"}, {Topic: "$share/g/other"}}
+	retained := &mqtt.Publish{}
+	retained.Message.Topic = "test"
+	retained.Message.Retain = true
+	retained.Message.Payload = []byte("hi")
+	qos1 := &mqtt.Publish{ID: 1}
+	qos1.Message.Topic = "test"
+	qos1.Message.QOS = 1
+
+	// internal listener allows all features
+	c := newMockConn(t)
+	b.manager.HandleWithFeatures(c, false, internal)
+	c.sendC2S(&mqtt.Connect{ClientID: "internal", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: subs})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 0, 0]>")
+	c.sendC2S(retained)
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	c.sendC2S(qos1)
+	c.assertS2CPacket("<Puback ID=1>")
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"test\" QOS=1 Retain=false Payload=> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 1})
+	c.assertClosed(false)
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// external listener grants QoS 0 and rejects wildcard and shared subscriptions
+	c = newMockConn(t)
+	b.manager.HandleWithFeatures(c, false, external)
+	c.sendC2S(&mqtt.Connect{ClientID: "external", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: subs})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 128, 128]>")
+	b.assertExchangeCount(1)
+	// the retained message published by internal client is delivered as qos 0
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=true Payload=6869> Dup=false>")
+
+	// external listener rejects retained message
+	c.sendC2S(retained)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// external listener rejects qos 1 message
+	c = newMockConn(t)
+	b.manager.HandleWithFeatures(c, false, external)
+	c.sendC2S(&mqtt.Connect{ClientID: "external", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(qos1)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// external listener rejects retained will message
+	c = newMockConn(t)
+	b.manager.HandleWithFeatures(c, false, external)
+	c.sendC2S(&mqtt.Connect{ClientID: "external", CleanSession: true, Version: 3, Will: &retained.Message})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+}
+
+func TestSessionMqttLag(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// the lag grows without ack
+	for i := 1; i <= 3; i++ {
+		pktpub := &mqtt.Publish{ID: mqtt.ID(i)}
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = "test"
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i))
+		sub.assertS2CPacket(fmt.Sprintf("<Publish ID=%d Message=<Message Topic=\"test\" QOS=1 Retain=false Payload=> Dup=false>", i))
+		stats, err := b.manager.SessionStats("sub")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), stats.Offset)
+		assert.Equal(t, uint64(i), stats.Lag)
+	}
+	stats := b.manager.Stats()
+	assert.Len(t, stats.LaggingSessions, 1)
+	assert.Equal(t, "sub", stats.LaggingSessions[0].ID)
+	assert.Equal(t, uint64(3), stats.LaggingSessions[0].Lag)
+
+	// the lag shrinks on ack
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+	sub.sendC2S(&mqtt.Puback{ID: 2})
+	assert.Eventually(t, func() bool {
+		stats, err := b.manager.SessionStats("sub")
+		return err == nil && stats.Lag == 1 && stats.Acked == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := b.manager.SessionStats("unknown")
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestSessionMqttUnsubscribeNotSubscribed(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// UNSUBACK is sent even if the topic filter is not subscribed
+	c.sendC2S(&mqtt.Unsubscribe{ID: 2, Topics: []string{"nonexists"}})
+	c.assertS2CPacket("<Unsuback ID=2>")
+	c.sendC2S(&mqtt.Unsubscribe{ID: 3, Topics: []string{"nonexists"}})
+	c.assertS2CPacket("<Unsuback ID=3>")
+	b.assertExchangeCount(1)
+	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"subs\":{\"test\":1}}", nil)
+
+	// unsubscribe reports whether each topic filter was subscribed
+	v, ok := b.manager.sessions.load(t.Name())
+	assert.True(t, ok)
+	res, err := v.(*Session).unsubscribe([]string{"nonexists", "test", "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false}, res)
+	b.assertExchangeCount(0)
+	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\"}", nil)
+}
+
+func TestSessionMqttRetainedEncryption(t *testing.T) {
+	b := newMockBroker(t, testConfEncryption)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "secret"
+	pktpub.Message.Retain = true
+	pktpub.Message.Payload = []byte("confidential")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	assertRetained := func(b *mockBroker) {
+		sub := newMockConn(t)
+		b.manager.Handle(sub, false)
+		sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+		sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "secret"}}})
+		sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+		sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"secret\" QOS=0 Retain=true Payload=636f6e666964656e7469616c> Dup=false>")
+		sub.sendC2S(&mqtt.Disconnect{})
+		sub.assertS2CPacketTimeout()
+		sub.assertClosed(true)
+	}
+	assertRetained(b)
+
+	// the stored bytes are ciphertext
+	count := 0
+	assert.NoError(t, b.manager.retainBucket.ListKV(func(data []byte) error {
+		count++
+		assert.False(t, bytes.Contains(data, []byte("secret")))
+		assert.False(t, bytes.Contains(data, []byte("confidential")))
+		return nil
+	}))
+	assert.Equal(t, 1, count)
+	b.close()
+
+	// the retained message encrypted by the old key is decrypted after key rotation
+	b = newMockBrokerNotClean(t, testConfEncryptionRotated)
+	defer b.closeAndClean()
+	assertRetained(b)
+}
+
+func TestSessionMqttSnapshotRestore(t *testing.T) {
+	b := newMockBroker(t, testConfSnapshot)
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	sub.sendC2S(&mqtt.Disconnect{})
+	sub.assertS2CPacketTimeout()
+	sub.assertClosed(true)
+	b.waitClientReady("sub", true)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "t"
+	pktpub.Message.Retain = true
+	pktpub.Message.Payload = []byte("r1")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	snap, err := b.manager.Snapshot()
+	assert.NoError(t, err)
+	snaps, err := ListSnapshots(b.cfg.Persistence.Snapshot.Dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{snap}, snaps)
+
+	// mutates the state after the snapshot
+	assert.NoError(t, b.manager.unretainMessage("t"))
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=7231> Dup=false>")
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+	sub.sendC2S(&mqtt.Unsubscribe{ID: 2, Topics: []string{"t"}})
+	sub.assertS2CPacket("<Unsuback ID=2>")
+	sub.sendC2S(&mqtt.Disconnect{})
+	sub.assertS2CPacketTimeout()
+	sub.assertClosed(true)
+	b.close()
+
+	// an invalid archive is rejected
+	assert.True(t, errors.Is(RestoreState(b.cfg, bytes.NewBufferString("invalid")), ErrSessionSnapshotInvalid))
+
+	// restores the state at the time of snapshot
+	f, err := os.Open(snap)
+	assert.NoError(t, err)
+	assert.NoError(t, RestoreState(b.cfg, f))
+	assert.NoError(t, f.Close())
+
+	b = newMockBrokerNotClean(t, testConfSnapshot)
+	defer b.closeAndClean()
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"t\":1}}", nil)
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=7231> Dup=false>")
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=true Payload=7231> Dup=false>")
+}
+
+func TestSessionMqttSnapshotInterval(t *testing.T) {
+	b := newMockBroker(t, testConfSnapshotInterval)
+	defer b.closeAndClean()
+
+	time.Sleep(time.Millisecond * 300)
+	snaps, err := ListSnapshots(b.cfg.Persistence.Snapshot.Dir)
+	assert.NoError(t, err)
+	assert.Len(t, snaps, 2)
+	assert.True(t, snaps[0] < snaps[1])
+}
+
+func TestSessionMqttPersistenceShards(t *testing.T) {
+	b := newMockBroker(t, testConfPersistenceShards)
+	assert.Len(t, b.manager.stores, 3)
+
+	// the client ids are spread over all the shards
+	ids := []string{"c0", "c1", "c2", "c3", "c4", "c5"}
+	shards := map[string]int{}
+	seen := map[int]bool{}
+	for _, id := range ids {
+		shards[id] = int(hashKey(id) % 3)
+		seen[shards[id]] = true
+	}
+	assert.Len(t, seen, 3)
+
+	for _, id := range ids {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: id, Version: 3})
+		c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+		c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+		c.sendC2S(&mqtt.Disconnect{})
+		c.assertS2CPacketTimeout()
+		c.assertClosed(true)
+	}
+
+	// the puback is sent after the message is stored in the queues of all the subscribers
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "t"
+	pktpub.Message.Payload = []byte("hi")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	// the queue of each session is stored in its shard only
+	for _, id := range ids {
+		for i, db := range b.manager.stores {
+			bucket, err := db.NewBatchBucket(id)
+			assert.NoError(t, err)
+			offset, err := bucket.MaxOffset()
+			assert.NoError(t, err)
+			if i == shards[id] {
+				assert.Equal(t, uint64(1), offset, id)
+			} else {
+				assert.Equal(t, uint64(0), offset, id)
+			}
+		}
+	}
+	// the queues in the other shards can't be exported with the main store
+	assert.Equal(t, ErrSessionSnapshotNotSupported, b.manager.ExportState(ioutil.Discard))
+	b.close()
+
+	// the count of shards can't be changed once stored
+	cfg := b.cfg
+	cfg.Persistence.Shards = 2
+	_, err := NewManager(cfg)
+	assert.Equal(t, ErrSessionPersistenceShardsChanged, err)
+	// the periodic snapshot is rejected if sharded
+	cfg = b.cfg
+	cfg.Persistence.Snapshot.Interval = time.Minute
+	_, err = NewManager(cfg)
+	assert.Equal(t, ErrSessionSnapshotNotSupported, err)
+
+	// the queues are recovered from their shards after restarting
+	b = newMockBrokerNotClean(t, testConfPersistenceShards)
+	defer b.closeAndClean()
+	b.assertSessionCount(len(ids))
+	for _, id := range ids {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: id, Version: 3})
+		c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+		c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=6869> Dup=false>")
+		c.sendC2S(&mqtt.Puback{ID: 1})
+		c.assertS2CPacketTimeout()
+	}
+}
+
+func TestSessionMqttOrderedSession(t *testing.T) {
+	b := newMockBroker(t, testConfOrderedSessions)
+	defer b.closeAndClean()
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}, {Topic: "b"}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 0]>")
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// publishes interleaved across topics and QoS
+	pubs := []struct {
+		topic string
+		qos   mqtt.QOS
+	}{{"a", 1}, {"b", 0}, {"a", 0}, {"b", 1}, {"a", 1}, {"a", 0}, {"b", 0}, {"a", 1}}
+	id := mqtt.ID(0)
+	for i, p := range pubs {
+		pkt := &mqtt.Publish{}
+		pkt.Message.Topic = p.topic
+		pkt.Message.QOS = p.qos
+		pkt.Message.Payload = []byte(strconv.Itoa(i))
+		if p.qos == 1 {
+			id++
+			pkt.ID = id
+		}
+		pub.sendC2S(pkt)
+		if p.qos == 1 {
+			pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", id))
+		}
+	}
+
+	// the subscriber receives the messages in the order accepted by broker
+	expected := []string{
+		"<Publish ID=1 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=30> Dup=false>",
+		"<Publish ID=0 Message=<Message Topic=\"b\" QOS=0 Retain=false Payload=31> Dup=false>",
+		"<Publish ID=0 Message=<Message Topic=\"a\" QOS=0 Retain=false Payload=32> Dup=false>",
+		"<Publish ID=0 Message=<Message Topic=\"b\" QOS=0 Retain=false Payload=33> Dup=false>",
+		"<Publish ID=2 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=34> Dup=false>",
+		"<Publish ID=0 Message=<Message Topic=\"a\" QOS=0 Retain=false Payload=35> Dup=false>",
+		"<Publish ID=0 Message=<Message Topic=\"b\" QOS=0 Retain=false Payload=36> Dup=false>",
+		"<Publish ID=3 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=37> Dup=false>",
+	}
+	for _, e := range expected {
+		sub.assertS2CPacket(e)
+	}
+	for i := 1; i <= 3; i++ {
+		sub.sendC2S(&mqtt.Puback{ID: mqtt.ID(i)})
+	}
+	sub.assertS2CPacketTimeout()
+
+	// the messages delivered as QoS 0 are acknowledged, so nothing is left after reconnecting
+	sub.sendC2S(&mqtt.Disconnect{})
+	sub.assertS2CPacketTimeout()
+	sub.assertClosed(true)
+	b.waitClientReady("sub", true)
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	sub.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttOrderedSessionCommit(t *testing.T) {
+	b := newMockBroker(t, testConfOrderedSessions)
+
+	route := func(topic, payload string) {
+		m := &mqtt.Message{Content: []byte(payload)}
+		m.Context.Topic = topic
+		m.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}, {Topic: "b"}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 0]>")
+
+	// the qos1 message is not acknowledged, and the message after it is downgraded to QoS 0
+	route("a", "1")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=31> Dup=false>")
+	route("b", "2")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"b\" QOS=0 Retain=false Payload=32> Dup=false>")
+	time.Sleep(b.manager.cfg.Persistence.Queue.DeleteTimeout * 2)
+	b.close()
+
+	// the qos1 message is not deleted by the commit of the one after it
+	b = newMockBrokerNotClean(t, testConfOrderedSessions)
+	defer b.closeAndClean()
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=31> Dup=false>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"b\" QOS=0 Retain=false Payload=32> Dup=false>")
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+	sub.assertS2CPacketTimeout()
+	time.Sleep(b.manager.cfg.Persistence.Queue.DeleteTimeout * 2)
+	// both are committed once the qos1 message is acknowledged
+	v, ok := b.manager.sessions.load("sub")
+	assert.True(t, ok)
+	stats := v.(*Session).Stats()
+	assert.Equal(t, uint64(2), stats.Acked)
+	assert.Equal(t, uint64(0), stats.Lag)
+}
+
+func TestSessionMqttMaxRetainedPayloadSize(t *testing.T) {
+	for _, deliver := range []bool{false, true} {
+		cfg := testConfMaxRetainedPayloadSize
+		if deliver {
+			cfg = testConfDeliverOversizedRetained
+		}
+		b := newMockBroker(t, cfg)
+
+		sub := newMockConn(t)
+		b.manager.Handle(sub, false)
+		sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+		sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t"}}})
+		sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+		pub := newMockConn(t)
+		b.manager.Handle(pub, false)
+		pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+		pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+		// the same size is allowed as a non-retained message
+		pkt := &mqtt.Publish{}
+		pkt.Message.Topic = "t"
+		pkt.Message.Payload = []byte("12345")
+		pub.sendC2S(pkt)
+		sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=3132333435> Dup=false>")
+
+		// the retained message within the limit is stored
+		pkt.Message.Retain = true
+		pkt.Message.Payload = []byte("1234")
+		pub.sendC2S(pkt)
+		sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=31323334> Dup=false>")
+
+		pkt.Message.Payload = []byte("12345")
+		pub.sendC2S(pkt)
+		if deliver {
+			sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=3132333435> Dup=false>")
+			pub.assertS2CPacketTimeout()
+		} else {
+			sub.assertS2CPacketTimeout()
+			pub.assertClosed(true)
+		}
+
+		// the oversized retained message is not stored
+		msgs, err := b.manager.listRetainedMessages()
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 1)
+		assert.Equal(t, []byte("1234"), msgs[0].Content)
+		b.closeAndClean()
+	}
+}
+
+func TestSessionMqttReloadPrincipals(t *testing.T) {
+	for _, unsubscribe := range []bool{false, true} {
+		b := newMockBroker(t, testConfUnsubscribeOnRevoke)
+		b.manager.cfg.UnsubscribeOnRevoke = unsubscribe
+
+		sub := newMockConn(t)
+		b.manager.Handle(sub, false)
+		sub.sendC2S(&mqtt.Connect{ClientID: "sub", Username: "u1", Password: "p1", Version: 3})
+		sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a"}, {Topic: "b"}}})
+		sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 0]>")
+
+		pub := newMockConn(t)
+		b.manager.Handle(pub, false)
+		pub.sendC2S(&mqtt.Connect{ClientID: "pub", Username: "u1", Password: "p1", CleanSession: true, Version: 3})
+		pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		publish := func(topic string) {
+			pkt := &mqtt.Publish{}
+			pkt.Message.Topic = topic
+			pkt.Message.Payload = []byte("hi")
+			pub.sendC2S(pkt)
+		}
+		publish("a")
+		sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"a\" QOS=0 Retain=false Payload=6869> Dup=false>")
+
+		// revokes the permission to subscribe topic a
+		principals := []Principal{{
+			Username: "u1",
+			Password: "p1",
+			Permissions: []Permission{
+				{Action: Subscribe, Permits: []string{"b"}},
+				{Action: Publish, Permits: []string{"#"}},
+			},
+		}}
+		assert.NoError(t, b.manager.ReloadPrincipals(principals))
+		publish("a")
+		publish("b")
+		sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"b\" QOS=0 Retain=false Payload=6869> Dup=false>")
+		sub.assertS2CPacketTimeout()
+		if unsubscribe {
+			b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"b\":0}}", nil)
+		} else {
+			b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"a\":0,\"b\":0}}", nil)
+		}
+
+		// the invalid principals are rejected
+		principals[0].Permissions[0].Permits = []string{"a/#/b"}
+		assert.Error(t, b.manager.ReloadPrincipals(principals))
+
+		// the client is closed if not permitted anymore
+		principals[0].Password = "p2"
+		principals[0].Permissions[0].Permits = []string{"b"}
+		assert.NoError(t, b.manager.ReloadPrincipals(principals))
+		sub.assertClosed(true)
+		pub.assertClosed(true)
+		b.closeAndClean()
+	}
+}
+
+func TestSessionMqttIdleCleanSessionTimeout(t *testing.T) {
+	b := newMockBroker(t, testConfIdleCleanSessionTimeout)
+	defer b.closeAndClean()
+
+	// the persistent session is never reaped
+	obs := newMockConn(t)
+	b.manager.Handle(obs, false)
+	obs.sendC2S(&mqtt.Connect{ClientID: "obs", Version: 3})
+	obs.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	obs.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "will"}}})
+	obs.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	// the dead connection of clean session without keep alive
+	dead := newMockConn(t)
+	b.manager.Handle(dead, false)
+	will := &mqtt.Publish{}
+	will.Message.Topic = "will"
+	will.Message.Payload = []byte("dead")
+	dead.sendC2S(&mqtt.Connect{ClientID: "dead", CleanSession: true, Version: 3, Will: &will.Message})
+	dead.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	alive := newMockConn(t)
+	b.manager.Handle(alive, false)
+	alive.sendC2S(&mqtt.Connect{ClientID: "alive", CleanSession: true, Version: 3})
+	alive.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(time.Millisecond * 100)
+		alive.sendC2S(&mqtt.Pingreq{})
+		alive.assertS2CPacket("<Pingresp>")
+	}
+
+	// the dead one is reaped after the timeout and its will message is sent
+	dead.assertClosed(true)
+	obs.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"will\" QOS=0 Retain=false Payload=64656164> Dup=false>")
+	alive.assertClosed(false)
+	obs.assertClosed(false)
+	b.assertClientCount(2)
+	b.assertSessionCount(2)
+}
+
+// failingDB fails to write messages into the queues created after failing is set
+type failingDB struct {
+	store.DB
+	failing int32
+}
+
+func (d *failingDB) NewBatchBucket(name string) (store.BatchBucket, error) {
+	bk, err := d.DB.NewBatchBucket(name)
+	return &failingBucket{BatchBucket: bk, db: d}, err
+}
+
+type failingBucket struct {
+	store.BatchBucket
+	db *failingDB
+}
+
+func (b *failingBucket) Set(offset uint64, value []byte) error {
+	if atomic.LoadInt32(&b.db.failing) == 1 {
+		return errors.New("disk is full")
+	}
+	return b.BatchBucket.Set(offset, value)
+}
+
+func TestSessionMqttPubackAfterPersisted(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	db := &failingDB{DB: b.manager.store}
+	b.manager.store = db
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	sub.sendC2S(&mqtt.Disconnect{})
+	sub.assertS2CPacketTimeout()
+	sub.assertClosed(true)
+
+	// the message fails to be persisted, no puback is sent and the publisher is closed
+	atomic.StoreInt32(&db.failing, 1)
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.Topic = "t"
+	pktpub.Message.QOS = 1
+	pktpub.Message.Payload = []byte("hi")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacketTimeout()
+	pub.assertClosed(true)
+	b.close()
+
+	// broker restarts, the publisher resends the message which is acknowledged after persisted
+	b = newMockBrokerNotClean(t, testConfDefault)
+	defer b.closeAndClean()
+	pub = newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	pktpub.Dup = true
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=6869> Dup=false>")
+	sub.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttPublishEmptyTopic(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "#", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// the publisher is disconnected without puback and the message never reaches the subscriber
+	for _, qos := range []mqtt.QOS{0, 1} {
+		pub := newMockConn(t)
+		b.manager.Handle(pub, false)
+		pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+		pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		pktpub := &mqtt.Publish{ID: 1}
+		pktpub.Message.QOS = qos
+		pktpub.Message.Payload = []byte("hi")
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacketTimeout()
+		pub.assertClosed(true)
+		sub.assertS2CPacketTimeout()
+	}
+	sub.assertClosed(false)
+}
+
+func TestSessionMqttMaxWillPayloadSize(t *testing.T) {
+	b := newMockBroker(t, testConfMaxWillPayloadSize)
+	defer b.closeAndClean()
+
+	obs := newMockConn(t)
+	b.manager.Handle(obs, false)
+	obs.sendC2S(&mqtt.Connect{ClientID: "obs", CleanSession: true, Version: 3})
+	obs.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	obs.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "will"}}})
+	obs.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	will := &mqtt.Publish{}
+	will.Message.Topic = "will"
+	will.Message.Payload = []byte("dead")
+
+	// the will message within the limit is stored
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Version: 3, Will: &will.Message})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	b.assertSessionStore("c", "{\"id\":\"c\",\"will\":{\"Context\":{\"Topic\":\"will\"},\"Content\":\"ZGVhZA==\"}}", nil)
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the connect with oversized will message is rejected by default
+	will.Message.Payload = []byte("dead!")
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Version: 3, Will: &will.Message})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the oversized will message is dropped and never published
+	b.manager.cfg.OversizedWillPolicy = "drop"
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Version: 3, Will: &will.Message})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	b.assertSessionStore("c", "{\"id\":\"c\"}", nil)
+	c.Close()
+	obs.assertS2CPacketTimeout()
+	obs.assertClosed(false)
+}
+
+func TestSessionMqttUnauthorizedWillPolicy(t *testing.T) {
+	b := newMockBroker(t, testConfSession)
+	defer b.closeAndClean()
+	assert.Equal(t, "reject", b.manager.cfg.UnauthorizedWillPolicy)
+
+	obs := newMockConn(t)
+	b.manager.Handle(obs, false)
+	obs.sendC2S(&mqtt.Connect{ClientID: "obs", Username: "u1", Password: "p1", CleanSession: true, Version: 3})
+	obs.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	obs.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "#"}}})
+	obs.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	// u2 is not permitted to publish to the will topic
+	will := &mqtt.Publish{}
+	will.Message.Topic = "will"
+	will.Message.Payload = []byte("dead")
+
+	// the connect is rejected by default
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Username: "u2", Password: "p2", Version: 3, Will: &will.Message})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=5>")
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the will message is dropped and never published
+	b.manager.cfg.UnauthorizedWillPolicy = "drop"
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Username: "u2", Password: "p2", Version: 3, Will: &will.Message})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	b.assertSessionStore("c", "{\"id\":\"c\"}", nil)
+	c.err <- errors.New("connection lost")
+	c.assertS2CPacketTimeout()
+	obs.assertS2CPacketTimeout()
+	obs.assertClosed(false)
+}
+
+// flakyConn fails to send the given count of publish packets transiently
+type flakyConn struct {
+	*mockConn
+	failures int32
+}
+
+func (c *flakyConn) Send(pkt mqtt.Packet, async bool) error {
+	if _, ok := pkt.(*mqtt.Publish); ok && atomic.AddInt32(&c.failures, -1) >= 0 {
+		return syscall.EAGAIN
+	}
+	return c.mockConn.Send(pkt, async)
+}
+
+func TestSessionMqttSendRetry(t *testing.T) {
+	b := newMockBroker(t, testConfSendRetry)
+	defer b.closeAndClean()
+
+	sub := &flakyConn{mockConn: newMockConn(t)}
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{}
+	pktpub.Message.Topic = "t"
+	pktpub.Message.Payload = []byte("hi")
+
+	// the qos1 message is delivered after retries
+	atomic.StoreInt32(&sub.failures, 3)
+	pktpub.ID = 1
+	pktpub.Message.QOS = 1
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=6869> Dup=false>")
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+	sub.assertClosed(false)
+
+	// the connection is closed if the retries are exhausted
+	atomic.StoreInt32(&sub.failures, 4)
+	pktpub.ID = 2
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=2>")
+	sub.assertS2CPacketTimeout()
+	sub.assertClosed(true)
+}
+
+func TestSessionMqttSendNoRetry(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	sub := &flakyConn{mockConn: newMockConn(t), failures: 1}
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	m := &mqtt.Message{}
+	m.Context.Topic = "t"
+	m.Context.QOS = 1
+	m.Content = []byte("hi")
+	assert.NoError(t, b.manager.exch.Route(m, nil))
+	sub.assertS2CPacketTimeout()
+	sub.assertClosed(true)
+}
+
+func TestSessionMqttEcho(t *testing.T) {
+	b := newMockBroker(t, testConfEcho)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$SYS/echo/req"}, {Topic: "$SYS/echo/resp"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 0]>")
+
+	// the requests are echoed to the response topic instead of routed, at most 2 per second
+	pktpub := &mqtt.Publish{}
+	pktpub.Message.Topic = "$SYS/echo/req"
+	pktpub.Message.Retain = true
+	pktpub.Message.Payload = []byte("hi")
+	for i := 0; i < 3; i++ {
+		c.sendC2S(pktpub)
+	}
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"$SYS/echo/resp\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"$SYS/echo/resp\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	c.assertS2CPacketTimeout()
+
+	// the qos1 request beyond the rate is acknowledged but not echoed
+	pktpub.ID = 1
+	pktpub.Message.QOS = 1
+	c.sendC2S(pktpub)
+	c.assertS2CPacket("<Puback ID=1>")
+	c.assertS2CPacketTimeout()
+
+	// neither the request nor the response is retained
+	msgs, err := b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 0)
+	c.assertClosed(false)
+}
+
+func TestSessionMqttResubscription(t *testing.T) {
+	cases := []struct {
+		policy string
+		suback string
+		subs   string
+	}{
+		{policy: "union", suback: "<Suback ID=2 ReturnCodes=[0, 1]>", subs: "{\"a\":0,\"b\":0,\"c\":1,\"d\":0}"},
+		{policy: "replace", suback: "<Suback ID=2 ReturnCodes=[0, 1]>", subs: "{\"a\":0,\"c\":1,\"d\":0}"},
+		{policy: "keep", suback: "<Suback ID=2 ReturnCodes=[1, 128]>", subs: "{\"a\":1,\"b\":0,\"d\":0}"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			b := newMockBroker(t, testConfResubscription)
+			defer b.closeAndClean()
+			b.manager.cfg.Resubscription.Policy = tc.policy
+
+			c := newMockConn(t)
+			b.manager.Handle(c, false)
+			c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+			c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}, {Topic: "b"}}})
+			c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 0]>")
+			c.sendC2S(&mqtt.Disconnect{})
+			c.assertS2CPacketTimeout()
+			c.assertClosed(true)
+
+			// reconnects and subscribes a different set within the window
+			c = newMockConn(t)
+			b.manager.Handle(c, false)
+			c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+			c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+			c.sendC2S(&mqtt.Subscribe{ID: 2, Subscriptions: []mqtt.Subscription{{Topic: "a"}, {Topic: "c", QOS: 1}}})
+			c.assertS2CPacket(tc.suback)
+
+			// subscribes as usual after the window
+			time.Sleep(time.Millisecond * 400)
+			c.sendC2S(&mqtt.Subscribe{ID: 3, Subscriptions: []mqtt.Subscription{{Topic: "d"}}})
+			c.assertS2CPacket("<Suback ID=3 ReturnCodes=[0]>")
+			b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":"+tc.subs+"}", nil)
+		})
+	}
+}
+
+func TestSessionMqttRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logfile := path.Join(dir, "broker.log")
+	_, err = log.Init(log.Config{Level: "debug", Encoding: "console", Filename: logfile, MaxAge: 1, MaxSize: 1, MaxBackups: 1})
+	assert.NoError(t, err)
+
+	var cfg Config
+	assert.NoError(t, utils.UnmarshalYAML([]byte(testConfRedaction), &cfg))
+	os.RemoveAll(path.Dir(cfg.Persistence.Store.Path))
+	b := &mockBroker{t: t, cfg: cfg}
+	b.manager, err = NewManager(cfg)
+	assert.NoError(t, err)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	will := &mqtt.Publish{}
+	will.Message.Topic = "secret/will"
+	will.Message.Payload = []byte("secret-will")
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Version: 3, Will: &will.Message})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "secret/+", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.Topic = "secret/topic"
+	pktpub.Message.QOS = 1
+	pktpub.Message.Payload = []byte("secret-payload")
+	c.sendC2S(pktpub)
+	c.assertS2CPacket("<Puback ID=1>")
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"secret/topic\" QOS=1 Retain=false Payload=7365637265742d7061796c6f6164> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 1})
+	c.sendC2S(&mqtt.Unsubscribe{ID: 2, Topics: []string{"secret/none"}})
+	c.assertS2CPacket("<Unsuback ID=2>")
+
+	// neither the topics nor the payloads appear in logs, only the metadata is kept
+	data, err := ioutil.ReadFile(logfile)
+	assert.NoError(t, err)
+	logs := string(data)
+	assert.Contains(t, logs, "client received a packet")
+	assert.Contains(t, logs, "unsubscribe topic not subscribed")
+	assert.Contains(t, logs, "Size=14")
+	assert.NotContains(t, logs, "secret")
+	assert.NotContains(t, logs, "736563726574")
+}
+
+func TestSessionMqttFairSession(t *testing.T) {
+	b := newMockBroker(t, testConfFairSession)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a"}, {Topic: "b"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 0]>")
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the messages of "b" are not starved by the flood of "a" pending in the session
+	for i := 0; i < 50; i++ {
+		m := &mqtt.Message{}
+		m.Context.Topic = "a"
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+	m := &mqtt.Message{}
+	m.Context.Topic = "b"
+	assert.NoError(t, b.manager.exch.Route(m, nil))
+
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	found := false
+	for i := 0; i < 3 && !found; i++ {
+		pkt := c.receiveS2C()
+		assert.NotNil(t, pkt)
+		found = strings.Contains(pkt.String(), "Topic=\"b\"")
+	}
+	assert.True(t, found)
+}
+
+func TestSessionMqttConnectFailures(t *testing.T) {
+	b := newMockBroker(t, testConfSession)
+	defer b.closeAndClean()
+
+	// bad credentials
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Username: "u1", Password: "p2", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=4>")
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// unsupported version
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Username: "u1", Password: "p1", Version: 5})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=1>")
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// not connect at first
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Pingreq{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// tls handshake failed
+	for _, err := range []error{
+		tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"},
+		fmt.Errorf("tls: bad certificate: %w", tls.AlertError(42)),
+		&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}},
+		&net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")},
+	} {
+		c = newMockConn(t)
+		b.manager.Handle(c, false)
+		c.err <- err
+		c.assertS2CPacketTimeout()
+		c.assertClosed(true)
+	}
+
+	// malformed packet, the error mentioning tls is not counted as tls failure
+	for _, err := range []error{errors.New("invalid packet type"), errors.New("invalid topic: tls: x")} {
+		c = newMockConn(t)
+		b.manager.Handle(c, false)
+		c.err <- err
+		c.assertS2CPacketTimeout()
+		c.assertClosed(true)
+	}
+
+	// closed by peer before connecting is not counted
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.err <- io.EOF
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	b.assertClientCount(0)
+	assert.Equal(t, ConnectFailures{Auth: 1, Protocol: 1, Version: 1, Malformed: 2, TLS: 4}, b.manager.Stats().ConnectFailures)
+}
+
+func TestSessionMqttAuthCache(t *testing.T) {
+	b := newMockBroker(t, testConfUnsubscribeOnRevoke)
+	defer b.closeAndClean()
+	b.manager.cfg.AuthCacheSize = 2
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "pub", Username: "u1", Password: "p1", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{}
+	pktpub.Message.QOS = 1
+	for i, topic := range []string{"a", "b", "c", "c"} {
+		pktpub.ID = mqtt.ID(i + 1)
+		pktpub.Message.Topic = topic
+		c.sendC2S(pktpub)
+		c.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i+1))
+	}
+
+	// the least recently used decision is evicted
+	v, ok := b.manager.clients.load("pub")
+	assert.True(t, ok)
+	cache := v.(*Client).authCache
+	_, ok = cache.get(Publish, "a")
+	assert.False(t, ok)
+	allowed, ok := cache.get(Publish, "c")
+	assert.True(t, ok)
+	assert.True(t, allowed)
+
+	// the cached decisions are dropped once the principals are reloaded
+	principals := []Principal{{
+		Username: "u1",
+		Password: "p1",
+		Permissions: []Permission{
+			{Action: Subscribe, Permits: []string{"a", "b"}},
+			{Action: Publish, Permits: []string{"b"}},
+		},
+	}}
+	assert.NoError(t, b.manager.ReloadPrincipals(principals))
+	_, ok = cache.get(Publish, "c")
+	assert.False(t, ok)
+	pktpub.ID = 5
+	c.sendC2S(pktpub)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+}
+
+func TestSessionMqttTakeoverInflight(t *testing.T) {
+	b := newMockBroker(t, testConfResending)
+	defer b.closeAndClean()
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	publish := func(id mqtt.ID, payload string) {
+		pkt := &mqtt.Publish{ID: id}
+		pkt.Message.Topic = "t"
+		pkt.Message.QOS = 1
+		pkt.Message.Payload = []byte(payload)
+		pub.sendC2S(pkt)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", id))
+	}
+
+	old := newMockConn(t)
+	b.manager.Handle(old, false)
+	old.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	old.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	old.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	old.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// the message in flight to the old connection is not acknowledged before takeover
+	publish(1, "a")
+	old.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=61> Dup=false>")
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	old.assertClosed(true)
+	// the late acknowledgement of the old connection is ignored
+	old.sendC2S(&mqtt.Puback{ID: 1})
+
+	// the message is handed off to the new connection once
+	c.assertS2CPacket("<Publish ID=2 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=61> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 2})
+	publish(2, "b")
+	c.assertS2CPacket("<Publish ID=3 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=62> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 3})
+
+	// nothing is resent after the resend interval since all are acknowledged
+	time.Sleep(time.Second * 3)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(false)
+}
+
+func TestSessionMqttPacketIDWrap(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// the packet ids are about to wrap before any qos1 message is sent
+	v, ok := b.manager.sessions.load("sub")
+	assert.True(t, ok)
+	s := v.(*Session)
+	s.cnt = mqtt.NewCounterWithNext(65530)
+	s.ackMut.Lock()
+	s.qos1pkt.offset = s.cnt.GetNextID()
+	s.ackMut.Unlock()
+
+	for i := 0; i < 10; i++ {
+		msg := &mqtt.Message{Content: []byte(strconv.Itoa(i))}
+		msg.Context.Topic = "t"
+		msg.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(msg, nil))
+	}
+
+	// the messages in flight without acknowledgement never share a packet id
+	var ids []mqtt.ID
+	for i := 0; i < 10; i++ {
+		pkt, ok := c.receiveS2C().(*mqtt.Publish)
+		assert.True(t, ok)
+		assert.Equal(t, strconv.Itoa(i), string(pkt.Message.Payload))
+		ids = append(ids, pkt.ID)
+	}
+	assert.Equal(t, []mqtt.ID{65530, 65531, 65532, 65533, 65534, 65535, 1, 2, 3, 4}, ids)
+
+	// all are acknowledged across the wrap
+	for _, id := range ids {
+		c.sendC2S(&mqtt.Puback{ID: id})
+	}
+	c.assertS2CPacketTimeout()
+	count := 0
+	s.qos1pkt.data.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 0, count)
+	s.ackMut.Lock()
+	assert.Equal(t, mqtt.ID(5), s.qos1pkt.offset)
+	s.ackMut.Unlock()
+}
+
+func TestSessionMqttSysRetain(t *testing.T) {
+	b := newMockBroker(t, testConfStatus)
+	defer b.closeAndClean()
+
+	// the retained message of client on $SYS topic is rejected
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{}
+	pktpub.Message.Topic = "$SYS/broker/status"
+	pktpub.Message.Retain = true
+	pktpub.Message.Payload = []byte("fake")
+	c.sendC2S(pktpub)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// so is the retained will
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", CleanSession: true, Version: 3, Will: &pktpub.Message})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the messages not retained are routed as usual, and the values of broker are delivered as retained
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$SYS/#"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"$SYS/broker/status\" QOS=0 Retain=true Payload=6f6e6c696e65> Dup=false>")
+	pktpub.Message.Retain = false
+	pktpub.Message.Topic = "$SYS/client"
+	c.sendC2S(pktpub)
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"$SYS/client\" QOS=0 Retain=false Payload=66616b65> Dup=false>")
+	c.assertClosed(false)
+
+	msgs, err := b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 0)
+
+	// the retained messages of clients on $SYS topics are stored with the others if allowed
+	b.manager.cfg.SysRetainPolicy = "allow"
+	pktpub.Message.Retain = true
+	c.sendC2S(pktpub)
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"$SYS/client\" QOS=0 Retain=false Payload=66616b65> Dup=false>")
+	msgs, err = b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	c.assertClosed(false)
+}
+
+func TestSessionMqttPublishOnceSubscribed(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// the message published right after the suback is never missed
+	for i := 0; i < 50; i++ {
+		topic := "t/" + strconv.Itoa(i)
+		sub.sendC2S(&mqtt.Subscribe{ID: mqtt.ID(i + 1), Subscriptions: []mqtt.Subscription{{Topic: topic}}})
+		sub.assertS2CPacket(fmt.Sprintf("<Suback ID=%d ReturnCodes=[0]>", i+1))
+		pktpub := &mqtt.Publish{}
+		pktpub.Message.Topic = topic
+		pktpub.Message.Payload = []byte("hi")
+		pub.sendC2S(pktpub)
+		// so is the one routed in process
+		b.manager.exch.Route(&mqtt.Message{Context: mqtt.Context{Topic: topic}, Content: []byte("hi")}, nil)
+		sub.assertS2CPacket(fmt.Sprintf("<Publish ID=0 Message=<Message Topic=\"%s\" QOS=0 Retain=false Payload=6869> Dup=false>", topic))
+		sub.assertS2CPacket(fmt.Sprintf("<Publish ID=0 Message=<Message Topic=\"%s\" QOS=0 Retain=false Payload=6869> Dup=false>", topic))
+	}
+	sub.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttRetainedQOS(t *testing.T) {
+	cases := []struct {
+		stored, granted mqtt.QOS
+		expect          string
+	}{
+		{stored: 0, granted: 0, expect: "<Publish ID=0 Message=<Message Topic=\"r\" QOS=0 Retain=true Payload=6869> Dup=false>"},
+		{stored: 0, granted: 1, expect: "<Publish ID=0 Message=<Message Topic=\"r\" QOS=0 Retain=true Payload=6869> Dup=false>"},
+		{stored: 1, granted: 0, expect: "<Publish ID=0 Message=<Message Topic=\"r\" QOS=0 Retain=true Payload=6869> Dup=false>"},
+		{stored: 1, granted: 1, expect: "<Publish ID=1 Message=<Message Topic=\"r\" QOS=1 Retain=true Payload=6869> Dup=false>"},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("stored=%d,granted=%d", tc.stored, tc.granted), func(t *testing.T) {
+			b := newMockBroker(t, testConfDefault)
+			defer b.closeAndClean()
+
+			pub := newMockConn(t)
+			b.manager.Handle(pub, false)
+			pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+			pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			pktpub := &mqtt.Publish{ID: mqtt.ID(tc.stored)}
+			pktpub.Message.Topic = "r"
+			pktpub.Message.QOS = tc.stored
+			pktpub.Message.Retain = true
+			pktpub.Message.Payload = []byte("hi")
+			pub.sendC2S(pktpub)
+			if tc.stored == 1 {
+				pub.assertS2CPacket("<Puback ID=1>")
+			}
+
+			// the retained message is delivered by the minimum of its qos and the granted qos
+			sub := newMockConn(t)
+			b.manager.Handle(sub, false)
+			sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+			sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "r", QOS: tc.granted}}})
+			sub.assertS2CPacket(fmt.Sprintf("<Suback ID=1 ReturnCodes=[%d]>", tc.granted))
+			sub.assertS2CPacket(tc.expect)
+			sub.assertS2CPacketTimeout()
+		})
+	}
+}
+
+func TestSessionMqttDiagnoseSession(t *testing.T) {
+	b := newMockBroker(t, testConfResending)
+	defer b.closeAndClean()
+
+	_, err := b.manager.DiagnoseSession("sub")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}, {Topic: "b/#"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 0]>")
+
+	// a qos1 message sent but not acknowledged
+	m := &mqtt.Message{Content: []byte("hi")}
+	m.Context.Topic = "a"
+	m.Context.QOS = 1
+	assert.NoError(t, b.manager.exch.Route(m, nil))
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=6869> Dup=false>")
+
+	d, err := b.manager.DiagnoseSession("sub")
+	assert.NoError(t, err)
+	assert.Equal(t, "sub", d.ID)
+	assert.True(t, d.Connected)
+	assert.False(t, d.CleanSession)
+	assert.Nil(t, d.WillMessage)
+	assert.NotNil(t, d.Persisted)
+	assert.Equal(t, map[string]mqtt.QOS{"a": 1, "b/#": 0}, d.Persisted.Subscriptions)
+	assert.Equal(t, []SubscriptionDiagnosis{
+		{Topic: "a", QOS: 1, InTrie: true, Bound: true},
+		{Topic: "b/#", QOS: 0, InTrie: true, Bound: true},
+	}, d.Subscriptions)
+	assert.Equal(t, 2, d.TrieCount)
+	assert.Equal(t, uint64(1), d.Stats.Offset)
+	assert.Equal(t, uint64(1), d.Stats.Lag)
+	assert.Equal(t, mqtt.ID(1), d.NextAck)
+	assert.Equal(t, []mqtt.ID{1}, d.Pending)
+
+	// acknowledged and disconnected
+	c.sendC2S(&mqtt.Puback{ID: 1})
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	d, err = b.manager.DiagnoseSession("sub")
+	assert.NoError(t, err)
+	assert.False(t, d.Connected)
+	assert.Equal(t, mqtt.ID(2), d.NextAck)
+	assert.Empty(t, d.Pending)
+	assert.Equal(t, uint64(0), d.Stats.Lag)
+}
+
+func TestSessionMqttSpillQOS0(t *testing.T) {
+	b := newMockBroker(t, testConfSpillQOS0)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// 2 messages are kept in memory, 10 messages are spilled to disk, the rest are dropped
+	for i := 1; i <= 20; i++ {
+		m := &mqtt.Message{Content: []byte{byte(i)}}
+		m.Context.Topic = "a"
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	for i := 1; i <= 12; i++ {
+		c.assertS2CPacket(fmt.Sprintf("<Publish ID=0 Message=<Message Topic=\"a\" QOS=0 Retain=false Payload=%02x> Dup=false>", i))
+	}
+	c.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttAnomalyHook(t *testing.T) {
+	b := newMockBroker(t, testConfAnomaly)
+	defer b.closeAndClean()
+	alerts := make(chan AnomalyAlert, 10)
+	b.manager.SetAnomalyHook(func(alert AnomalyAlert) {
+		alerts <- alert
+	})
+
+	// a burst of auth failures
+	for i := 0; i < 4; i++ {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: "c", Username: "u1", Password: "p2", Version: 3})
+		c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=4>")
+		c.assertS2CPacketTimeout()
+		c.assertClosed(true)
+	}
+
+	// fired once when the threshold is crossed
+	select {
+	case alert := <-alerts:
+		assert.Equal(t, AnomalyAlert{Rate: RateAuthFailures, Count: 3, Threshold: 2, Window: time.Minute}, alert)
+	default:
+		assert.FailNow(t, "anomaly hook is not called")
+	}
+	assert.Len(t, alerts, 0)
+
+	// the disconnection of a connected client is counted
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", Username: "u1", Password: "p1", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	assert.Equal(t, ConnectionRates{Connects: 5, AuthFailures: 4, Disconnects: 1, Window: time.Minute}, b.manager.Stats().Rates)
+	assert.Len(t, alerts, 0)
+}
+
+func TestSessionMqttInflightSaturation(t *testing.T) {
+	b := newMockBroker(t, testConfMaxInflightQOS1)
+	defer b.closeAndClean()
+	events := make(chan InflightEvent, 10)
+	b.manager.SetInflightHook(func(e InflightEvent) {
+		events <- e
+	})
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// the window holds 5 messages besides the one waiting for acknowledgement by resending, the next one saturates it
+	for i := 0; i < 7; i++ {
+		msg := &mqtt.Message{Content: []byte(strconv.Itoa(i))}
+		msg.Context.Topic = "t"
+		msg.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(msg, nil))
+	}
+
+	// the window is saturated by the messages not acknowledged
+	var first *mqtt.Publish
+	for i := 0; ; i++ {
+		pkt := c.receiveS2C().(*mqtt.Publish)
+		if i == 0 {
+			first = pkt
+		}
+		select {
+		case e := <-events:
+			assert.Equal(t, InflightEvent{Session: "sub", Saturated: true, Capacity: 5}, e)
+		case <-time.After(100 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	time.Sleep(50 * time.Millisecond)
+	stats := b.manager.Stats()
+	assert.Equal(t, uint64(1), stats.InflightSaturations)
+	assert.Len(t, stats.LaggingSessions, 1)
+	assert.True(t, stats.LaggingSessions[0].Saturated >= 50*time.Millisecond, stats.LaggingSessions[0].Saturated)
+
+	// recovered once acknowledged
+	c.sendC2S(&mqtt.Puback{ID: first.ID})
+	select {
+	case e := <-events:
+		assert.False(t, e.Saturated)
+		assert.Equal(t, "sub", e.Session)
+		assert.True(t, e.Duration >= 50*time.Millisecond, e.Duration)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "inflight hook is not called on recovery")
+	}
+	s, err := b.manager.SessionStats("sub")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), s.Saturated)
+}
+
+func TestSessionMqttSubscribeDuringPublish(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	for round := 1; round <= 10; round++ {
+		topic := "t/" + strconv.Itoa(round)
+		var seq uint64
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m := &mqtt.Message{Content: []byte(strconv.FormatUint(atomic.AddUint64(&seq, 1), 10))}
+				m.Context.Topic = topic
+				m.Context.QOS = 1
+				b.manager.exch.Route(m, nil)
+			}
+		}()
+
+		received := map[uint64]bool{}
+		receive := func(pkt mqtt.Packet) bool {
+			p, ok := pkt.(*mqtt.Publish)
+			if !ok {
+				return false
+			}
+			v, err := strconv.ParseUint(string(p.Message.Payload), 10, 64)
+			assert.NoError(t, err)
+			received[v] = true
+			c.sendC2S(&mqtt.Puback{ID: p.ID})
+			return true
+		}
+
+		// the messages published concurrently may be sent before the suback
+		c.sendC2S(&mqtt.Subscribe{ID: mqtt.ID(round), Subscriptions: []mqtt.Subscription{{Topic: topic, QOS: 1}}})
+		var pkt mqtt.Packet
+		for pkt = c.receiveS2C(); receive(pkt); pkt = c.receiveS2C() {
+		}
+		assert.Equal(t, fmt.Sprintf("<Suback ID=%d ReturnCodes=[1]>", round), pkt.String())
+		acked := atomic.LoadUint64(&seq)
+		// the publisher is blocked if the inflight messages are not acknowledged
+		for atomic.LoadUint64(&seq) < acked+50 {
+			assert.True(t, receive(c.receiveS2C()))
+		}
+		close(stop)
+		for stopped := false; !stopped; {
+			select {
+			case pkt := <-c.s2c:
+				assert.True(t, receive(pkt), pkt.String())
+			case <-done:
+				stopped = true
+			}
+		}
+		last := atomic.LoadUint64(&seq)
+
+		// all the messages published after the suback are delivered
+		for v := acked + 1; v <= last; v++ {
+			for !received[v] {
+				select {
+				case pkt := <-c.s2c:
+					assert.True(t, receive(pkt), pkt.String())
+				case <-time.After(5 * time.Second):
+					assert.FailNow(t, "message published after suback is missed", "round=%d seq=%d", round, v)
+				}
+			}
+		}
+	}
+}
+
+func TestSessionMqttMaxRetainedPerSubscribe(t *testing.T) {
+	for _, policy := range []string{"truncate", "reject"} {
+		t.Run(policy, func(t *testing.T) {
+			b := newMockBroker(t, testConfMaxRetainedPerSubscribe)
+			defer b.closeAndClean()
+			b.manager.cfg.RetainedOverflowPolicy = policy
+
+			for _, topic := range []string{"e", "a/1", "d", "b", "c"} {
+				m := &mqtt.Message{Content: []byte("hi")}
+				m.Context.Topic = topic
+				m.Context.Flags = 0x1
+				assert.NoError(t, b.manager.retainMessage(m))
+			}
+
+			sub := newMockConn(t)
+			b.manager.Handle(sub, false)
+			sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+			sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+			// not exceeding the limit
+			sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a/#"}}})
+			sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+			sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"a/1\" QOS=0 Retain=true Payload=6869> Dup=false>")
+			sub.assertS2CPacketTimeout()
+			assert.Equal(t, uint64(0), b.manager.Stats().RetainedOverflows)
+
+			sub.sendC2S(&mqtt.Subscribe{ID: 2, Subscriptions: []mqtt.Subscription{{Topic: "#"}}})
+			sub.assertS2CPacket("<Suback ID=2 ReturnCodes=[0]>")
+			if policy == "truncate" {
+				// the first ones ordered by topic are delivered
+				for _, topic := range []string{"a/1", "b", "c"} {
+					sub.assertS2CPacket(fmt.Sprintf("<Publish ID=0 Message=<Message Topic=\"%s\" QOS=0 Retain=true Payload=6869> Dup=false>", topic))
+				}
+			}
+			sub.assertS2CPacketTimeout()
+			assert.Equal(t, uint64(1), b.manager.Stats().RetainedOverflows)
+		})
+	}
+}
+
+func TestSessionMqttWillRetainPolicy(t *testing.T) {
+	cases := []struct {
+		policy   string
+		retain   bool
+		retained bool
+	}{
+		{policy: "keep", retain: true, retained: true},
+		{policy: "keep", retain: false, retained: false},
+		{policy: "clear", retain: true, retained: false},
+		{policy: "set", retain: false, retained: true},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s,retain=%t", tc.policy, tc.retain), func(t *testing.T) {
+			b := newMockBroker(t, testConfDefault)
+			defer b.closeAndClean()
+			b.manager.cfg.WillRetainPolicy = tc.policy
+
+			obs := newMockConn(t)
+			b.manager.Handle(obs, false)
+			obs.sendC2S(&mqtt.Connect{ClientID: "obs", CleanSession: true, Version: 3})
+			obs.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			obs.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "will"}}})
+			obs.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+			c := newMockConn(t)
+			b.manager.Handle(c, false)
+			will := &mqtt.Publish{}
+			will.Message.Topic = "will"
+			will.Message.Payload = []byte("dead")
+			will.Message.Retain = tc.retain
+			c.sendC2S(&mqtt.Connect{ClientID: "c", CleanSession: true, Version: 3, Will: &will.Message})
+			c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			c.err <- errors.New("connection lost")
+			obs.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"will\" QOS=0 Retain=false Payload=64656164> Dup=false>")
+
+			msgs, err := b.manager.listRetainedMessages()
+			assert.NoError(t, err)
+			if tc.retained {
+				assert.Len(t, msgs, 1)
+			} else {
+				assert.Len(t, msgs, 0)
+			}
+		})
+	}
+}
+
+func TestSessionMqttCleanSessionInflight(t *testing.T) {
+	b := newMockBroker(t, testConfResending)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// the qos1 messages in flight are not acknowledged before disconnecting
+	for i := 1; i <= 3; i++ {
+		m := &mqtt.Message{Content: []byte("hi")}
+		m.Context.Topic = "a"
+		m.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+		c.assertS2CPacket(fmt.Sprintf("<Publish ID=%d Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=6869> Dup=false>", i))
+	}
+	c.err <- io.EOF
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// no trace is left in the store
+	b.assertSessionCount(0)
+	b.assertSessionStore("sub", "", errors.New("pebble: not found"))
+	bucket, err := b.manager.store.NewBatchBucket("sub")
+	assert.NoError(t, err)
+	offset, err := bucket.MaxOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), offset)
+
+	// nothing is redelivered to the new clean session, even after the resend interval
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	time.Sleep(b.manager.cfg.ResendInterval)
+	c.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttChangeMaxInflightQOS1(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the backlog is stored with the batch size 20
+	for i := 1; i <= 30; i++ {
+		m := &mqtt.Message{Content: []byte(strconv.Itoa(i))}
+		m.Context.Topic = "a"
+		m.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+
+	// receives and acknowledges a message, returns its payload
+	next := func(c *mockConn) int {
+		pkt, ok := c.receiveS2C().(*mqtt.Publish)
+		assert.True(t, ok)
+		v, err := strconv.Atoi(string(pkt.Message.Payload))
+		assert.NoError(t, err)
+		c.sendC2S(&mqtt.Puback{ID: pkt.ID})
+		return v
+	}
+
+	// the broker restarts with a smaller batch size, the backlog is read in smaller batches
+	b.close()
+	b = newMockBrokerNotClean(t, testConfMaxInflightQOS1)
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	for i := 1; i <= 10; i++ {
+		assert.Equal(t, i, next(c))
+	}
+	c.sendC2S(&mqtt.Disconnect{})
+
+	// the broker restarts with the batch size 20 again, the rest of the backlog is delivered in order
+	b.close()
+	b = newMockBrokerNotClean(t, testConfDefault)
+	defer b.closeAndClean()
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	// the messages acknowledged but not yet deleted before closing may be redelivered, but none is lost
+	first := next(c)
+	assert.True(t, first <= 11)
+	for i := first + 1; i <= 30; i++ {
+		assert.Equal(t, i, next(c))
+	}
+	c.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttOverlappingSubscriptionsQOS(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	// mixed subscribes overlapping topic filters of mixed QoS, low subscribes all of QoS 0
+	mixed := newMockConn(t)
+	b.manager.Handle(mixed, false)
+	mixed.sendC2S(&mqtt.Connect{ClientID: "mixed", CleanSession: true, Version: 3})
+	mixed.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	mixed.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a/#", QOS: 0}, {Topic: "a/+", QOS: 1}, {Topic: "a/b", QOS: 0}}})
+	mixed.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 1, 0]>")
+
+	low := newMockConn(t)
+	b.manager.Handle(low, false)
+	low.sendC2S(&mqtt.Connect{ClientID: "low", CleanSession: true, Version: 3})
+	low.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	low.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a/#", QOS: 0}, {Topic: "a/b", QOS: 0}}})
+	low.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 0]>")
+
+	assertOffset := func(id string, expected uint64) {
+		stats, err := b.manager.SessionStats(id)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, stats.Offset)
+	}
+
+	// the qos1 message is delivered once at the maximum QoS of the matching subscriptions
+	m := &mqtt.Message{Content: []byte("hi")}
+	m.Context.Topic = "a/b"
+	m.Context.QOS = 1
+	assert.NoError(t, b.manager.exch.Route(m, nil))
+	mixed.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"a/b\" QOS=1 Retain=false Payload=6869> Dup=false>")
+	mixed.assertS2CPacketTimeout()
+	assertOffset("mixed", 1)
+	low.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"a/b\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	low.assertS2CPacketTimeout()
+	assertOffset("low", 0)
+	mixed.sendC2S(&mqtt.Puback{ID: 1})
+
+	// the qos0 message is delivered at QoS 0 regardless of the subscriptions
+	m = &mqtt.Message{Content: []byte("hi")}
+	m.Context.Topic = "a/b"
+	assert.NoError(t, b.manager.exch.Route(m, nil))
+	mixed.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"a/b\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	mixed.assertS2CPacketTimeout()
+	assertOffset("mixed", 1)
+	low.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"a/b\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	low.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttWillOnTakeover(t *testing.T) {
+	for _, publish := range []bool{false, true} {
+		t.Run(fmt.Sprintf("willOnTakeover=%t", publish), func(t *testing.T) {
+			b := newMockBroker(t, testConfDefault)
+			defer b.closeAndClean()
+			b.manager.cfg.WillOnTakeover = publish
+
+			obs := newMockConn(t)
+			b.manager.Handle(obs, false)
+			obs.sendC2S(&mqtt.Connect{ClientID: "obs", CleanSession: true, Version: 3})
+			obs.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			obs.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "will"}}})
+			obs.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+			old := newMockConn(t)
+			b.manager.Handle(old, false)
+			will := &mqtt.Publish{}
+			will.Message.Topic = "will"
+			will.Message.Payload = []byte("dead")
+			old.sendC2S(&mqtt.Connect{ClientID: "c", Version: 3, Will: &will.Message})
+			old.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+			// the session is taken over by a new connection without will
+			c := newMockConn(t)
+			b.manager.Handle(c, false)
+			c.sendC2S(&mqtt.Connect{ClientID: "c", Version: 3})
+			c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+			old.assertClosed(true)
+			if publish {
+				obs.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"will\" QOS=0 Retain=false Payload=64656164> Dup=false>")
+			}
+			obs.assertS2CPacketTimeout()
+
+			// the new connection has no will to publish when lost
+			c.err <- errors.New("connection lost")
+			obs.assertS2CPacketTimeout()
+		})
+	}
+}
+
+func TestSessionMqttCleanSessionTransition(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	route := func(payload string) {
+		m := &mqtt.Message{Content: []byte(payload)}
+		m.Context.Topic = "t"
+		m.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the backlog is queued for the persistent session
+	route("a")
+	route("b")
+
+	// [false -> true] the persistent session is discarded with its subscriptions and backlog
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.assertS2CPacketTimeout()
+	b.assertSessionStore("sub", "", errors.New("pebble: not found"))
+	b.assertExchangeCount(0)
+	bucket, err := b.manager.store.NewBatchBucket("sub")
+	assert.NoError(t, err)
+	offset, err := bucket.MaxOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), offset)
+
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	route("c")
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=63> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 1})
+
+	// [true -> false] the clean session taken over is discarded, and the new one is persisted
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	b.assertSessionStore("sub", "{\"id\":\"sub\"}", nil)
+	b.assertExchangeCount(0)
+
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"t\":1}}", nil)
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the backlog of the new persistent session is delivered after reconnecting
+	route("d")
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=64> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 1})
+	c.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttCleanToPersistentQueued(t *testing.T) {
+	b := newMockBroker(t, testConfMaxInflightQOS1)
+	b.manager.cfg.MaxInflightQOS0Messages = 1
+	b.manager.cfg.MaxSpilledQOS0Messages = 10
+
+	route := func(topic, payload string, qos uint32) {
+		m := &mqtt.Message{Content: []byte(payload)}
+		m.Context.Topic = topic
+		m.Context.QOS = qos
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+	assertEmpty := func(name string) {
+		bucket, err := b.manager.store.NewBatchBucket(name)
+		assert.NoError(t, err)
+		offset, err := bucket.MaxOffset()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), offset)
+	}
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "q0", QOS: 0}, {Topic: "q1", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 1]>")
+
+	// the inflight window is saturated, so the messages routed next are queued by the clean session
+	for i := 1; i <= 7; i++ {
+		route("q1", "a", 1)
+		c.assertS2CPacket(fmt.Sprintf("<Publish ID=%d Message=<Message Topic=\"q1\" QOS=1 Retain=false Payload=61> Dup=false>", i))
+	}
+	route("q1", "b", 1)
+	route("q1", "b", 1)
+	for i := 0; i < 5; i++ {
+		route("q0", "b", 0)
+	}
+	c.assertS2CPacketTimeout()
+	spill, err := b.manager.store.NewBatchBucket(spillBucketPrefix + "sub")
+	assert.NoError(t, err)
+	offset, err := spill.MaxOffset()
+	assert.NoError(t, err)
+	assert.NotEqual(t, uint64(0), offset)
+
+	// [true -> false] the clean session is discarded with the messages queued, none of them is stored retroactively
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.assertS2CPacketTimeout()
+	b.assertSessionStore("sub", "{\"id\":\"sub\"}", nil)
+	b.assertSessionCount(1)
+	b.assertExchangeCount(0)
+	assertEmpty("sub")
+	assertEmpty(spillBucketPrefix + "sub")
+
+	// the messages queued after the transition are delivered, and the qos1 ones are persisted
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "q0", QOS: 0}, {Topic: "q1", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 1]>")
+	route("q0", "c", 0)
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"q0\" QOS=0 Retain=false Payload=63> Dup=false>")
+	route("q1", "c", 1)
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"q1\" QOS=1 Retain=false Payload=63> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 1})
+	c.sendC2S(&mqtt.Disconnect{})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	route("q1", "d", 1)
+	b.close()
+
+	b = newMockBrokerNotClean(t, testConfMaxInflightQOS1)
+	defer b.closeAndClean()
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"q1\" QOS=1 Retain=false Payload=64> Dup=false>")
+	c.sendC2S(&mqtt.Puback{ID: 1})
+	c.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttQOS1Commit(t *testing.T) {
+	for _, policy := range []string{"ack", "written"} {
+		t.Run(policy, func(t *testing.T) {
+			b := newMockBroker(t, testConfDefault)
+			b.manager.cfg.QOS1Commit = policy
+
+			c := newMockConn(t)
+			b.manager.Handle(c, false)
+			c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+			c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+			c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+			// the message is written but not acknowledged before the broker crashes
+			m := &mqtt.Message{Content: []byte("hi")}
+			m.Context.Topic = "t"
+			m.Context.QOS = 1
+			assert.NoError(t, b.manager.exch.Route(m, nil))
+			c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=6869> Dup=false>")
+			time.Sleep(b.manager.cfg.Persistence.Queue.DeleteTimeout * 2)
+			b.close()
+
+			b = newMockBrokerNotClean(t, testConfDefault)
+			defer b.closeAndClean()
+			c = newMockConn(t)
+			b.manager.Handle(c, false)
+			c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+			c.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+			if policy == "ack" {
+				// redelivered rather than lost
+				c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=6869> Dup=false>")
+				c.sendC2S(&mqtt.Puback{ID: 1})
+			}
+			c.assertS2CPacketTimeout()
+		})
+	}
+}
+
+func TestSessionMqttQOS1CommitWritten(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+	b.manager.cfg.QOS1Commit = "written"
+	b.manager.cfg.MaxInflightQOS1Messages = 1
+	b.manager.cfg.ResendInterval = time.Second
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// the window holds 3 messages, and the queue holds 1 more
+	for i := 1; i <= 4; i++ {
+		m := &mqtt.Message{Content: []byte(strconv.Itoa(i))}
+		m.Context.Topic = "t"
+		m.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(m, nil))
+	}
+	// the window is still full of the messages written but not acknowledged
+	for i := 1; i <= 3; i++ {
+		c.assertS2CPacket(fmt.Sprintf("<Publish ID=%d Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=%x> Dup=false>", i, strconv.Itoa(i)))
+	}
+	c.assertS2CPacketTimeout()
+
+	// the message written is still resent until acknowledged
+	c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=31> Dup=true>")
+	for i := 1; i <= 3; i++ {
+		c.sendC2S(&mqtt.Puback{ID: mqtt.ID(i)})
+	}
+	// the rest is sent once the window is released, ignoring the resends racing with the acknowledgements
+	for {
+		pkt, ok := c.receiveS2C().(*mqtt.Publish)
+		assert.True(t, ok)
+		if !pkt.Dup {
+			assert.Equal(t, "<Publish ID=4 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=34> Dup=false>", pkt.String())
+			break
+		}
+	}
+}
+
+func TestSessionMqttSubscribePolicy(t *testing.T) {
+	for _, policy := range []string{"partial", "atomic"} {
+		t.Run(policy, func(t *testing.T) {
+			b := newMockBroker(t, testConfDefault)
+			defer b.closeAndClean()
+			b.manager.cfg.SubscribePolicy = policy
+
+			c := newMockConn(t)
+			b.manager.Handle(c, false)
+			c.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+			c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+			c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a", QOS: 1}}})
+			c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+			b.assertExchangeCount(1)
+
+			// the invalid topic filter is among the good ones
+			c.sendC2S(&mqtt.Subscribe{ID: 2, Subscriptions: []mqtt.Subscription{{Topic: "b", QOS: 1}, {Topic: "c/#/d", QOS: 1}, {Topic: "a", QOS: 0}}})
+			m := &mqtt.Message{Content: []byte("hi")}
+			m.Context.Topic = "a"
+			if policy == "partial" {
+				c.assertS2CPacket("<Suback ID=2 ReturnCodes=[1, 128, 0]>")
+				b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"a\":0,\"b\":1}}", nil)
+				b.assertExchangeCount(2)
+				assert.NoError(t, b.manager.exch.Route(m, nil))
+				c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"a\" QOS=0 Retain=false Payload=6869> Dup=false>")
+			} else {
+				// none takes effect, even the QoS of the existing subscription is kept
+				c.assertS2CPacket("<Suback ID=2 ReturnCodes=[128, 128, 128]>")
+				b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"a\":1}}", nil)
+				b.assertExchangeCount(1)
+				m.Context.QOS = 1
+				assert.NoError(t, b.manager.exch.Route(m, nil))
+				c.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"a\" QOS=1 Retain=false Payload=6869> Dup=false>")
+				c.sendC2S(&mqtt.Puback{ID: 1})
+			}
+			m = &mqtt.Message{Content: []byte("hi")}
+			m.Context.Topic = "b"
+			assert.NoError(t, b.manager.exch.Route(m, nil))
+			if policy == "partial" {
+				c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"b\" QOS=0 Retain=false Payload=6869> Dup=false>")
+			}
+			c.assertS2CPacketTimeout()
+		})
+	}
+}
+
+func TestSessionMqttSharedAndNormalSubscription(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	// a holds both the normal and the shared subscriptions of the same topic filter, m is the other member of the group
+	a := newMockConn(t)
+	b.manager.Handle(a, false)
+	a.sendC2S(&mqtt.Connect{ClientID: "a", CleanSession: true, Version: 3})
+	a.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	a.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 0}, {Topic: "$share/g/t", QOS: 1}}})
+	a.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 1]>")
+	// the shared subscription without a valid group or topic filter is rejected
+	a.sendC2S(&mqtt.Subscribe{ID: 2, Subscriptions: []mqtt.Subscription{{Topic: "$share/g"}, {Topic: "$share//t"}, {Topic: "$share/+/t"}}})
+	a.assertS2CPacket("<Suback ID=2 ReturnCodes=[128, 128, 128]>")
+
+	m := newMockConn(t)
+	b.manager.Handle(m, false)
+	m.sendC2S(&mqtt.Connect{ClientID: "m", CleanSession: true, Version: 3})
+	m.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	m.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$share/g/t", QOS: 1}}})
+	m.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	for i := 1; i <= 4; i++ {
+		msg := &mqtt.Message{Content: []byte(strconv.Itoa(i))}
+		msg.Context.Topic = "t"
+		msg.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(msg, nil))
+	}
+
+	// a receives all by the normal subscription at QoS 0, and the ones chosen for the group at QoS 1
+	var normal, shared []string
+	for i := 0; i < 6; i++ {
+		pkt, ok := a.receiveS2C().(*mqtt.Publish)
+		assert.True(t, ok)
+		if pkt.Message.QOS == 0 {
+			normal = append(normal, string(pkt.Message.Payload))
+			continue
+		}
+		shared = append(shared, string(pkt.Message.Payload))
+		a.sendC2S(&mqtt.Puback{ID: pkt.ID})
+	}
+	a.assertS2CPacketTimeout()
+	assert.Equal(t, []string{"1", "2", "3", "4"}, normal)
+	assert.Equal(t, []string{"1", "3"}, shared)
+
+	// the other member receives the rest once
+	m.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=32> Dup=false>")
+	m.assertS2CPacket("<Publish ID=2 Message=<Message Topic=\"t\" QOS=1 Retain=false Payload=34> Dup=false>")
+	m.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttUnsubscribeShared(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	conns := map[string]*mockConn{}
+	for _, id := range []string{"a", "m"} {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: id, CleanSession: true, Version: 3})
+		c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$share/g/t"}}})
+		c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+		conns[id] = c
+	}
+	// the group is bound once for all its members
+	b.assertExchangeCount(1)
+
+	publish := func(payload string) {
+		msg := &mqtt.Message{Content: []byte(payload)}
+		msg.Context.Topic = "t"
+		assert.NoError(t, b.manager.exch.Route(msg, nil))
+	}
+
+	// the member unsubscribed leaves the group, the rest receive all
+	conns["a"].sendC2S(&mqtt.Unsubscribe{ID: 2, Topics: []string{"$share/g/t"}})
+	conns["a"].assertS2CPacket("<Unsuback ID=2>")
+	v, ok := b.manager.sessions.load("a")
+	assert.True(t, ok)
+	assert.False(t, b.manager.exch.Bound("$share/g/t", v.(*Session)))
+	assert.Empty(t, v.(*Session).subscriptions())
+	b.assertExchangeCount(1)
+	publish("1")
+	publish("2")
+	conns["m"].assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=31> Dup=false>")
+	conns["m"].assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=32> Dup=false>")
+	conns["a"].assertS2CPacketTimeout()
+
+	// the group is cleaned up when the last member leaves
+	conns["m"].sendC2S(&mqtt.Unsubscribe{ID: 2, Topics: []string{"$share/g/t"}})
+	conns["m"].assertS2CPacket("<Unsuback ID=2>")
+	b.assertExchangeCount(0)
+	publish("3")
+	conns["a"].assertS2CPacketTimeout()
+	conns["m"].assertS2CPacketTimeout()
+}
+
+func TestSessionMqttRetainedShared(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.Topic = "t"
+	pktpub.Message.QOS = 1
+	pktpub.Message.Retain = true
+	pktpub.Message.Payload = []byte("hi")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+	// the topic with the shared prefix can't be published
+	pktpub.ID = 2
+	pktpub.Message.Topic = "$share/g/t"
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacketTimeout()
+	pub.assertClosed(true)
+
+	// m is a member of the group only, which never receives the retained message
+	m := newMockConn(t)
+	b.manager.Handle(m, false)
+	m.sendC2S(&mqtt.Connect{ClientID: "m", CleanSession: true, Version: 3})
+	m.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	m.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$share/g/t", QOS: 1}, {Topic: "$share/g/#", QOS: 1}}})
+	m.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 1]>")
+	m.assertS2CPacketTimeout()
+
+	// a holds both the normal and the shared subscriptions, and receives the retained copy once by the normal one
+	a := newMockConn(t)
+	b.manager.Handle(a, false)
+	a.sendC2S(&mqtt.Connect{ClientID: "a", CleanSession: true, Version: 3})
+	a.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	a.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$share/g/t", QOS: 1}, {Topic: "t", QOS: 0}}})
+	a.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 0]>")
+	a.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=true Payload=6869> Dup=false>")
+	a.assertS2CPacketTimeout()
+
+	// n holds the normal subscription only
+	n := newMockConn(t)
+	b.manager.Handle(n, false)
+	n.sendC2S(&mqtt.Connect{ClientID: "n", CleanSession: true, Version: 3})
+	n.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	n.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t", QOS: 1}}})
+	n.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	n.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"t\" QOS=1 Retain=true Payload=6869> Dup=false>")
+	n.sendC2S(&mqtt.Puback{ID: 1})
+	n.assertS2CPacketTimeout()
+	m.assertS2CPacketTimeout()
+
+	// the messages routed later are still delivered to the group and the normal subscribers
+	msg := &mqtt.Message{Content: []byte("hi")}
+	msg.Context.Topic = "t"
+	assert.NoError(t, b.manager.exch.Route(msg, nil))
+	n.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	a.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=6869> Dup=false>")
+}
+
+func TestSessionMqttPublishRate(t *testing.T) {
+	b := newMockBroker(t, testConfPublishRate)
+	defer b.closeAndClean()
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t"}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	stats, err := b.manager.SessionStats("pub")
+	assert.NoError(t, err)
+	assert.NotNil(t, stats.Tokens)
+	assert.InDelta(t, 5, *stats.Tokens, 0.1)
+
+	publish := func(count int) time.Duration {
+		start := time.Now()
+		for i := 0; i < count; i++ {
+			pkt := &mqtt.Publish{}
+			pkt.Message.Topic = "t"
+			pub.sendC2S(pkt)
+		}
+		for i := 0; i < count; i++ {
+			sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=> Dup=false>")
+		}
+		return time.Since(start)
+	}
+
+	// the burst within the capacity passes at once
+	assert.True(t, publish(5) < 50*time.Millisecond)
+	stats, err = b.manager.SessionStats("pub")
+	assert.NoError(t, err)
+	assert.InDelta(t, 0, *stats.Tokens, 0.5)
+
+	// the sustained flow is throttled to the rate
+	d := publish(5)
+	assert.True(t, d > 400*time.Millisecond, d)
+	assert.True(t, d < time.Second, d)
+
+	// the bucket is per session, the subscriber not publishing keeps the full capacity
+	stats, err = b.manager.SessionStats("sub")
+	assert.NoError(t, err)
+	assert.InDelta(t, 5, *stats.Tokens, 0.1)
+}
+
+func TestSessionMqttDeliveryPanic(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	conns := map[string]*mockConn{}
+	for _, id := range []string{"bad", "good"} {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: id, CleanSession: true, Version: 3})
+		c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+		c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "t"}}})
+		c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+		conns[id] = c
+	}
+
+	// a malformed message without content panics when sent
+	v, ok := b.manager.sessions.load("bad")
+	assert.True(t, ok)
+	assert.NoError(t, v.(*Session).qos0msg.Push(&common.Event{}))
+
+	// only the session of the panic is closed
+	for i := 0; i < 50 && b.manager.sessions.count() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.assertSessionCount(1)
+	b.assertClientCount(1)
+	conns["bad"].assertClosed(true)
+
+	msg := &mqtt.Message{Content: []byte("ok")}
+	msg.Context.Topic = "t"
+	assert.NoError(t, b.manager.exch.Route(msg, nil))
+	conns["good"].assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"t\" QOS=0 Retain=false Payload=6f6b> Dup=false>")
+	conns["bad"].assertS2CPacketTimeout()
+}
+
+func TestSessionMqttMaxRetainedHistoryPerSubscribe(t *testing.T) {
+	b := newMockBroker(t, testConfMaxRetainedHistoryPerSubscribe)
+	defer b.closeAndClean()
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	for i, topic := range []string{"history/c", "history/b", "history/a", "history/c", "history/b", "history/a", "history/b", "history/a"} {
+		pktpub := &mqtt.Publish{ID: mqtt.ID(i + 1)}
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = topic
+		pktpub.Message.Payload = []byte(strconv.Itoa(i + 1))
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i+1))
+	}
+
+	// the histories are truncated after ordered by topic and sequence
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "history/#"}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	for _, v := range []struct {
+		topic   string
+		payload string
+	}{{"history/a", "3"}, {"history/a", "6"}, {"history/a", "8"}, {"history/b", "2"}} {
+		sub.assertS2CPacket(fmt.Sprintf("<Publish ID=0 Message=<Message Topic=\"%s\" QOS=0 Retain=true Payload=%x> Dup=false>", v.topic, v.payload))
+	}
+	sub.assertS2CPacketTimeout()
+	assert.Equal(t, uint64(1), b.manager.Stats().RetainedOverflows)
+}
+
+func TestSessionMqttRetainedTransformer(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	// converts celsius to fahrenheit for the subscription of topic filter "fahrenheit/+"
+	b.manager.SetRetainedTransformer(func(sid string, subs []mqtt.Subscription, msg *mqtt.Message) *mqtt.Message {
+		for _, sub := range subs {
+			if sub.Topic == "fahrenheit/+" {
+				v, err := strconv.Atoi(string(msg.Content))
+				assert.NoError(t, err)
+				msg.Content = []byte(strconv.Itoa(v*9/5 + 32))
+				return msg
+			}
+		}
+		return msg
+	})
+
+	m := &mqtt.Message{}
+	m.Context.Topic = "fahrenheit/temp"
+	m.Context.Flags = 0x1
+	m.Content = []byte("20")
+	assert.NoError(t, b.manager.retainMessage(m))
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c", CleanSession: true, Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "fahrenheit/temp"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"fahrenheit/temp\" QOS=0 Retain=true Payload=3230> Dup=false>")
+
+	f := newMockConn(t)
+	b.manager.Handle(f, false)
+	f.sendC2S(&mqtt.Connect{ClientID: "f", CleanSession: true, Version: 3})
+	f.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	f.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "fahrenheit/+"}}})
+	f.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	f.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"fahrenheit/temp\" QOS=0 Retain=true Payload=3638> Dup=false>")
+
+	// the stored value is not changed
+	msgs, err := b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, []byte("20"), msgs[0].Content)
+}
+
+func TestSessionMqttRetainedHistory(t *testing.T) {
+	b := newMockBroker(t, testConfRetainedHistory)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// publish 5 messages to a topic keeping the last 3 messages
+	for i := 1; i <= 5; i++ {
+		pktpub := &mqtt.Publish{ID: mqtt.ID(i)}
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = "history/a"
+		pktpub.Message.Payload = []byte("m" + strconv.Itoa(i))
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i))
+	}
+	assert.Len(t, b.manager.listHistoryMessages(), 1)
+
+	// a new subscriber receives the last 3 messages in order
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "history/a", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	for i := 3; i <= 5; i++ {
+		sub.assertS2CPacket(fmt.Sprintf("<Publish ID=%d Message=<Message Topic=\"history/a\" QOS=1 Retain=true Payload=%x> Dup=false>", i-2, "m"+strconv.Itoa(i)))
+		sub.sendC2S(&mqtt.Puback{ID: mqtt.ID(i - 2)})
+	}
+	sub.assertS2CPacketTimeout()
+
+	// the history is persisted
+	b.close()
+	b = newMockBrokerNotClean(t, testConfRetainedHistory)
+	defer b.closeAndClean()
+	hs := b.manager.listHistoryMessages()
+	assert.Len(t, hs, 1)
+	assert.Len(t, hs[0], 3)
+	assert.Equal(t, []byte("m3"), hs[0][0].Content)
+	assert.Equal(t, []byte("m5"), hs[0][2].Content)
+
+	// an empty retained message clears the history
+	pub = newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 6}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "history/a"
+	pktpub.Message.Retain = true
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=6>")
+	assert.Len(t, b.manager.listHistoryMessages(), 0)
+	count := 0
+	assert.NoError(t, b.manager.historyBucket.ListKV(func(data []byte) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 0, count)
+
+	// a new history starts after cleared
+	pktpub = &mqtt.Publish{ID: 7}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "history/a"
+	pktpub.Message.Payload = []byte("m7")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=7>")
+	hs = b.manager.listHistoryMessages()
+	assert.Len(t, hs, 1)
+	assert.Len(t, hs[0], 1)
+	assert.Equal(t, []byte("m7"), hs[0][0].Content)
+}
+
+func TestSessionMqttRetainedHistoryEncryption(t *testing.T) {
+	b := newMockBroker(t, testConfRetainedHistoryEncryption)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", CleanSession: true, Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "history/secret"
+	pktpub.Message.Payload = []byte("confidential")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	// the stored bytes are ciphertext
+	count := 0
+	assert.NoError(t, b.manager.historyBucket.ListKV(func(data []byte) error {
+		count++
+		assert.False(t, bytes.Contains(data, []byte("secret")))
+		assert.False(t, bytes.Contains(data, []byte("confidential")))
+		return nil
+	}))
+	assert.Equal(t, 1, count)
+	b.close()
+
+	// the history is decrypted after restart
+	b = newMockBrokerNotClean(t, testConfRetainedHistoryEncryption)
+	defer b.closeAndClean()
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", CleanSession: true, Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "history/#"}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"history/secret\" QOS=0 Retain=true Payload=636f6e666964656e7469616c> Dup=false>")
+}
+
 func TestSessionMqttDefaultMaxMessagePayload(t *testing.T) {
 	b := newMockBroker(t, testConfDefault)
 	defer b.closeAndClean()
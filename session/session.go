@@ -2,7 +2,10 @@ package session
 
 import (
 	"encoding/json"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
@@ -12,6 +15,9 @@ import (
 	"github.com/baetyl/baetyl-broker/v2/queue"
 )
 
+// spillBucketPrefix the prefix of the buckets spilling qos0 messages, client ids never contain '#'
+const spillBucketPrefix = "#spill/"
+
 // Info session information
 type Info struct {
 	ID            string              `json:"id,omitempty"`
@@ -27,16 +33,33 @@ func (i *Info) String() string {
 
 // Session session of a client
 type Session struct {
-	info    Info
-	manager *Manager
-	subs    *mqtt.Trie
-	cnt     *mqtt.Counter
-	qos0msg queue.Queue // queue for qos0
-	qos1msg queue.Queue // queue for qos1
-	qos1pkt *cache
-	qos1ack chan *eventWrapper
-	log     *log.Logger
-	mut     sync.RWMutex // mutex for session
+	saturated int64 // monotonic time since epoch when the inflight window saturated, 0 if not, the first field to be aligned for atomic operations
+	info      Info
+	manager   *Manager
+	subs      *mqtt.Trie
+	cnt       *mqtt.Counter
+	qos0msg   queue.Queue // queue for qos0
+	qos1msg   queue.Queue // queue for qos1
+	qos1pkt   *cache
+	qos1ack   chan *eventWrapper
+	ackMut    sync.Mutex    // guards qos1pkt instead of the session lock, which is held by the pushes blocked on the full qos1 queue until acknowledged
+	ordered   bool          // all messages flow into qos1 queue to keep the order accepted by broker
+	limiter   *tokenBucket  // throttles the publishes of the session, nil if not throttled
+	quit      chan struct{} // closed once the session is closing, no message is pushed or delivered after that
+	once      sync.Once
+	log       *log.Logger
+	mut       rwMutex // mutex for session, lock wait and hold times are sampled if enabled
+}
+
+// SessionStats statistics of session
+type SessionStats struct {
+	ID        string        `json:"id"`
+	Offset    uint64        `json:"offset"` // offset of the latest message in qos1 queue
+	Acked     uint64        `json:"acked"`  // offset of the latest acknowledged message in qos1 queue
+	Lag       uint64        `json:"lag"`    // count of the messages in qos1 queue not acknowledged yet
+	Lock      LockStats     `json:"lock"`
+	Tokens    *float64      `json:"tokens,omitempty"`    // tokens left in the bucket throttling the publishes, negative if reserved in advance, nil if not throttled
+	Saturated time.Duration `json:"saturated,omitempty"` // how long the inflight window has been saturated, 0 if not saturated
 }
 
 func newSession(i Info, m *Manager) (*Session, error) {
@@ -46,25 +69,60 @@ func newSession(i Info, m *Manager) (*Session, error) {
 		manager: m,
 		subs:    mqtt.NewTrie(),
 		cnt:     cnt,
-		qos0msg: queue.NewTemporary(i.ID, m.cfg.MaxInflightQOS0Messages, true),
 		qos1ack: make(chan *eventWrapper, m.cfg.MaxInflightQOS1Messages),
 		qos1pkt: &cache{
 			offset: cnt.GetNextID(),
 		},
-		log: m.log.With(log.Any("id", i.ID)),
+		quit: make(chan struct{}),
+		log:  m.log.With(log.Any("id", i.ID)),
+	}
+	s.mut.rate = uint64(m.cfg.LockStatsSampleRate)
+	if m.cfg.PublishRate.Rate > 0 {
+		s.limiter = newTokenBucket(m.cfg.PublishRate)
+	}
+	for _, id := range m.cfg.OrderedSessions {
+		if id == i.ID {
+			s.ordered = true
+		}
+	}
+	// the qos1 queue is always in order, since its messages are removed from storage by the offset acknowledged
+	for _, id := range m.cfg.FairSessions {
+		if id == i.ID {
+			s.qos0msg = queue.NewFair(i.ID, m.cfg.MaxInflightQOS0Messages, m.cfg.Redaction)
+		}
+	}
+	if s.qos0msg == nil && m.cfg.MaxSpilledQOS0Messages > 0 {
+		sbk, err := m.sessionStore(i.ID).NewBatchBucket(spillBucketPrefix + i.ID)
+		if err != nil {
+			s.log.Error("failed to create qos0 spill bucket", log.Error(err))
+			return nil, err
+		}
+		s.qos0msg, err = queue.NewSpilling(i.ID, m.cfg.MaxInflightQOS0Messages, sbk, m.encoder, m.cfg.MaxSpilledQOS0Messages, m.cfg.Redaction)
+		if err != nil {
+			s.log.Error("failed to create qos0 spilling queue", log.Error(err))
+			return nil, err
+		}
+	}
+	if s.qos0msg == nil {
+		s.qos0msg = queue.NewTemporary(i.ID, m.cfg.MaxInflightQOS0Messages, true, m.cfg.Redaction)
 	}
 
 	qc := m.cfg.Persistence.Queue
 	qc.Name = i.ID
+	// the batch size only limits the messages read from the bucket at once, the messages are stored by offset,
+	// so the bucket created with a different max inflight qos1 messages is still readable after restarting
 	qc.BatchSize = m.cfg.MaxInflightQOS1Messages
-	qbk, err := m.store.NewBatchBucket(qc.Name)
+	qc.Redaction = m.cfg.Redaction
+	qbk, err := m.sessionStore(i.ID).NewBatchBucket(qc.Name)
 	if err != nil {
 		s.log.Error("failed to create qos1 bucket", log.Error(err))
+		s.closeQOS0()
 		return nil, err
 	}
 	s.qos1msg, err = queue.NewPersistence(qc, qbk)
 	if err != nil {
 		s.log.Error("failed to create qos1 persistent", log.Error(err))
+		s.closeQOS0()
 		return nil, err
 	}
 
@@ -76,6 +134,7 @@ func newSession(i Info, m *Manager) (*Session, error) {
 
 	err = s.persistent()
 	if err != nil {
+		s.close()
 		return nil, errors.Trace(err)
 	}
 	return s, nil
@@ -85,12 +144,13 @@ func (s *Session) close() {
 	s.log.Info("session is closing")
 	defer s.log.Info("session has closed")
 
-	if s.qos0msg != nil {
-		err := s.qos0msg.Close(s.info.CleanSession)
-		if err != nil {
-			s.log.Error("failed to clase qos0 queue", log.Error(err))
-		}
-	}
+	// rejects the pushes from now on
+	s.once.Do(func() {
+		close(s.quit)
+	})
+
+	// the queues are closed before locking to release the pushes blocked by them
+	s.closeQOS0()
 
 	if s.qos1msg != nil {
 		err := s.qos1msg.Close(s.info.CleanSession)
@@ -98,6 +158,33 @@ func (s *Session) close() {
 			s.log.Error("failed to clase qos1 queue", log.Error(err))
 		}
 	}
+
+	// waits for the pushes in flight to return, and unbinds all the subscriptions even if the caller didn't,
+	// so that no stale binding of the closed session is left in the exchange on any path
+	s.mut.Lock()
+	for topic := range s.info.Subscriptions {
+		s.manager.exch.Unbind(topic, s)
+	}
+	s.mut.Unlock()
+
+	// drops the messages sent but not acknowledged, which are kept in qos1 queue if the session is persistent
+	for {
+		select {
+		case <-s.qos1ack:
+		default:
+			return
+		}
+	}
+}
+
+// closed checks whether the session is closing, the pushes check it with lock so that none is in flight after close
+func (s *Session) closed() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
 }
 
 // * the following operations need lock
@@ -111,7 +198,7 @@ func (s *Session) update(si Info, auth func(action, topic string) bool) error {
 
 	for topic := range s.info.Subscriptions {
 		if auth != nil && !auth(Subscribe, topic) {
-			s.log.Warn(ErrSessionMessageTopicNotPermitted.Error(), log.Any("topic", topic))
+			s.log.Warn(ErrSessionMessageTopicNotPermitted.Error(), log.Any("topic", s.manager.cfg.Redaction.FormatTopic(topic)))
 			s.subs.Empty(topic)
 			s.manager.exch.Unbind(topic, s)
 			delete(s.info.Subscriptions, topic)
@@ -126,11 +213,13 @@ func (s *Session) update(si Info, auth func(action, topic string) bool) error {
 			return errors.Trace(err)
 		}
 	}
+	s.handover()
 
 	qc := s.manager.cfg.Persistence.Queue
 	qc.Name = si.ID
 	qc.BatchSize = s.manager.cfg.MaxInflightQOS1Messages
-	qbk, err := s.manager.store.NewBatchBucket(qc.Name)
+	qc.Redaction = s.manager.cfg.Redaction
+	qbk, err := s.manager.sessionStore(si.ID).NewBatchBucket(qc.Name)
 	if err != nil {
 		s.log.Error("failed to create qos1 bucket", log.Error(err))
 		return errors.Trace(err)
@@ -144,6 +233,25 @@ func (s *Session) update(si Info, auth func(action, topic string) bool) error {
 	return errors.Trace(s.persistent())
 }
 
+// handover drops the qos1 messages in flight to the connection taken over without acknowledgement,
+// so that they are kept in storage and recovered by the new qos1 queue for the new connection,
+// the acknowledgements of the previous connection are ignored since the packet ids are not reused, the messages
+// are sent to the new connection by new packet ids without DUP, which only marks the packet resent by the same id
+func (s *Session) handover() {
+	s.ackMut.Lock()
+	s.qos1pkt = &cache{
+		offset: s.cnt.GetNextID(),
+	}
+	s.ackMut.Unlock()
+	for {
+		select {
+		case <-s.qos1ack:
+		default:
+			return
+		}
+	}
+}
+
 func (s *Session) disableQos1() {
 	s.mut.Lock()
 	defer s.mut.Unlock()
@@ -153,44 +261,171 @@ func (s *Session) disableQos1() {
 	}
 }
 
-// Push pushes source message to session queue
+// Push pushes source message routed by the normal subscriptions to session queue
 func (s *Session) Push(e *common.Event) error {
-	s.mut.Lock()
-	defer s.mut.Unlock()
+	return s.push("", e)
+}
+
+// PushShared pushes source message routed by the shared subscription to session queue,
+// the message is delivered at the QoS of the shared subscription regardless of the normal ones
+func (s *Session) PushShared(topic string, e *common.Event) error {
+	return s.push(topic, e)
+}
+
+// matches returns the QoS of the subscriptions matching the message, which is the shared subscription if not empty
+func (s *Session) matches(shared string, e *common.Event) []interface{} {
+	if shared != "" {
+		return s.subs.Get(shared)
+	}
+	return s.subs.Match(e.Context.Topic)
+}
 
+func (s *Session) push(shared string, e *common.Event) error {
+	if s.ordered {
+		return s.pushOrdered(shared, e)
+	}
+	// qos0 queue is never replaced and safe for concurrent pushes, so the read lock is enough
+	// to keep the subscriptions consistent while routing, only qos1 queue needs the write lock
+	s.mut.RLock()
+	if s.closed() {
+		s.mut.RUnlock()
+		e.Done()
+		return queue.ErrQueueClosed
+	}
 	// always flow message with qos 0 into qos0 queue
 	if e.Context.QOS == 0 {
+		defer s.mut.RUnlock()
 		return s.qos0msg.Push(e)
 	}
 
 	// TODO: improve
-	qs := s.subs.Match(e.Context.Topic)
+	qs := s.matches(shared, e)
 	if len(qs) == 0 {
-		s.log.Warn("a message is ignored since there is no sub matched", log.Any("message", e.String()))
+		s.mut.RUnlock()
+		s.log.Warn("a message is ignored since there is no sub matched", log.Any("message", s.manager.cfg.Redaction.FormatMessage(e.Message)))
 		e.Done()
 		return nil
 	}
 
-	for _, q := range qs {
-		if q.(mqtt.QOS) > 0 {
-			// chose maximum QoS of all the matching subscriptions. [MQTT-3.3.5-1]
+	if deliveryQOS(e.Context.QOS, qs) > 0 {
+		s.mut.RUnlock()
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		if s.closed() {
+			e.Done()
+			return queue.ErrQueueClosed
+		}
+		// the subscriptions may have changed while the lock was released, so match again
+		qs = s.matches(shared, e)
+		if len(qs) == 0 {
+			s.log.Warn("a message is ignored since there is no sub matched", log.Any("message", s.manager.cfg.Redaction.FormatMessage(e.Message)))
+			e.Done()
+			return nil
+		}
+		if deliveryQOS(e.Context.QOS, qs) > 0 {
 			return s.qos1msg.Push(e)
 		}
+		return s.qos0msg.Push(e)
 	}
 
+	defer s.mut.RUnlock()
 	return s.qos0msg.Push(e)
 }
 
-// ID id
-func (s *Session) ID() string {
+// deliveryQOS returns the QoS to deliver the message, which is the minimum of the message QoS
+// and the maximum QoS of all the matching subscriptions. [MQTT-3.3.5-1]
+func deliveryQOS(qos uint32, subs []interface{}) uint32 {
+	var max uint32
+	for _, q := range subs {
+		if v := uint32(q.(mqtt.QOS)); v > max {
+			max = v
+		}
+	}
+	if max < qos {
+		return max
+	}
+	return qos
+}
+
+// pushOrdered pushes the messages of all QoS into qos1 queue to keep the order accepted by broker,
+// the message is tagged with the QoS to deliver, and the one delivered as QoS 0 is committed once the qos1 messages
+// popped before it are acknowledged
+func (s *Session) pushOrdered(shared string, e *common.Event) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
+	if s.closed() {
+		e.Done()
+		return queue.ErrQueueClosed
+	}
+
+	qs := s.matches(shared, e)
+	if len(qs) == 0 {
+		s.log.Warn("a message is ignored since there is no sub matched", log.Any("message", s.manager.cfg.Redaction.FormatMessage(e.Message)))
+		e.Done()
+		return nil
+	}
+	qos := deliveryQOS(e.Context.QOS, qs)
+	if qos == e.Context.QOS {
+		return s.qos1msg.Push(e)
+	}
+	// the event is shared by all sessions, so a copy is tagged
+	msg := &mqtt.Message{Context: e.Context, Content: e.Content}
+	msg.Context.QOS = qos
+	if err := s.qos1msg.Push(common.NewEvent(msg, 0, nil)); err != nil {
+		return errors.Trace(err)
+	}
+	e.Done()
+	return nil
+}
+
+// closeQOS0 closes qos0 queue, which stops its draining routine if any
+func (s *Session) closeQOS0() {
+	if s.qos0msg == nil {
+		return
+	}
+	err := s.qos0msg.Close(s.info.CleanSession)
+	if err != nil {
+		s.log.Error("failed to clase qos0 queue", log.Error(err))
+	}
+}
+
+// Stats returns the statistics of session
+func (s *Session) Stats() SessionStats {
+	s.mut.RLock()
+	res := SessionStats{ID: s.info.ID}
+	if r, ok := s.qos1msg.(queue.OffsetReporter); ok {
+		res.Offset, res.Acked = r.Offsets()
+		if res.Offset > res.Acked {
+			res.Lag = res.Offset - res.Acked
+		}
+	}
+	s.mut.RUnlock()
+	// lock stats are read after unlock to include the read lock above
+	res.Lock = s.mut.stats()
+	if s.limiter != nil {
+		tokens := s.limiter.level()
+		res.Tokens = &tokens
+	}
+	res.Saturated = s.saturatedFor()
+	return res
+}
+
+// ID id
+func (s *Session) ID() string {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
 	return s.info.ID
 }
 
 // * the following operations are only used by mqtt client
 
+// subscribe sets the subscriptions and binds them in the exchange under the session lock, the pushes routed by the new bindings
+// wait for the lock and match the subscriptions set, so the messages routed after the suback are always delivered,
+// the ones routed during the subscribe may be delivered or not, such as the qos1 message acknowledged to its publisher
+// before the suback is sent, the topic filter subscribed again replaces its QoS, while the messages already queued
+// are delivered at the QoS granted when they were pushed
 func (s *Session) subscribe(subs []mqtt.Subscription, sa *mqtt.Suback, auth func(action, topic string) bool) error {
 	if len(subs) == 0 {
 		return nil
@@ -205,7 +440,7 @@ func (s *Session) subscribe(subs []mqtt.Subscription, sa *mqtt.Suback, auth func
 
 	for i, v := range subs {
 		if auth != nil && !auth(Subscribe, v.Topic) {
-			s.log.Warn(ErrSessionMessageTopicNotPermitted.Error(), log.Any("topic", v.Topic))
+			s.log.Warn(ErrSessionMessageTopicNotPermitted.Error(), log.Any("topic", s.manager.cfg.Redaction.FormatTopic(v.Topic)))
 			sa.ReturnCodes[i] = mqtt.QOSFailure
 			continue
 		}
@@ -217,21 +452,64 @@ func (s *Session) subscribe(subs []mqtt.Subscription, sa *mqtt.Suback, auth func
 	return errors.Trace(s.persistent())
 }
 
-func (s *Session) unsubscribe(topics []string) error {
+// unsubscribe removes the subscriptions and returns whether each topic filter was subscribed,
+// the topic filter not subscribed is ignored, the shared subscription leaves its group instead of a normal binding
+func (s *Session) unsubscribe(topics []string) ([]bool, error) {
 	if len(topics) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
-	for _, topic := range topics {
+	changed := false
+	res := make([]bool, len(topics))
+	for i, topic := range topics {
+		if _, ok := s.info.Subscriptions[topic]; !ok {
+			continue
+		}
 		s.subs.Empty(topic)
 		s.manager.exch.Unbind(topic, s)
 		delete(s.info.Subscriptions, topic)
+		res[i] = true
+		changed = true
+	}
+	if !changed {
+		return res, nil
 	}
+	return res, errors.Trace(s.persistent())
+}
 
-	return errors.Trace(s.persistent())
+// revoke removes the subscriptions not permitted by auth, and returns the removed topic filters
+func (s *Session) revoke(auth func(action, topic string) bool) ([]string, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var topics []string
+	for topic := range s.info.Subscriptions {
+		if auth(Subscribe, topic) {
+			continue
+		}
+		s.subs.Empty(topic)
+		s.manager.exch.Unbind(topic, s)
+		delete(s.info.Subscriptions, topic)
+		topics = append(topics, topic)
+	}
+	if len(topics) == 0 {
+		return nil, nil
+	}
+	sort.Strings(topics)
+	return topics, errors.Trace(s.persistent())
+}
+
+func (s *Session) subscriptions() map[string]mqtt.QOS {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	subs := make(map[string]mqtt.QOS, len(s.info.Subscriptions))
+	for topic, qos := range s.info.Subscriptions {
+		subs[topic] = qos
+	}
+	return subs
 }
 
 func (s *Session) will() *mqtt.Message {
@@ -246,6 +524,14 @@ func (s *Session) cleanSession() bool {
 	return s.info.CleanSession
 }
 
+// discard marks the persistent session as clean and deletes its stored info, the queued messages are deleted when closed
+func (s *Session) discard() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.info.CleanSession = true
+	return errors.Trace(s.persistent())
+}
+
 func (s *Session) cleanWill() error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
@@ -259,10 +545,27 @@ func (s *Session) matchQOS(topic string) (bool, uint32) {
 	return mqtt.MatchTopicQOS(s.subs, topic)
 }
 
-func (s *Session) acknowledge(id uint64) {
+// matchSubscriptions returns the subscriptions matching the topic
+func (s *Session) matchSubscriptions(topic string) []mqtt.Subscription {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
 
+	var res []mqtt.Subscription
+	for filter, qos := range s.info.Subscriptions {
+		if matchTopic(filter, topic) {
+			res = append(res, mqtt.Subscription{Topic: filter, QOS: qos})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Topic < res[j].Topic
+	})
+	return res
+}
+
+func (s *Session) acknowledge(id uint64) {
+	s.ackMut.Lock()
+	defer s.ackMut.Unlock()
+
 	err := s.qos1pkt.delete(id)
 	if err != nil {
 		s.log.Warn("failed to acknowledge", log.Any("id", id), log.Error(err))
@@ -290,3 +593,21 @@ func (s *Session) persistent() error {
 	}
 	return nil
 }
+
+// matchTopic checks whether the topic matches the topic filter
+func matchTopic(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	// the topic starting with $ is not matched by the filter starting with wildcard [MQTT-4.7.2-1]
+	if strings.HasPrefix(topic, "$") && (fs[0] == "#" || fs[0] == "+") {
+		return false
+	}
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,555 @@
+package session
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+	"github.com/baetyl/baetyl-broker/v2/queue"
+)
+
+const testConfLockStats = `
+session:
+  lockStatsSampleRate: 1
+`
+
+func TestSessionLockStats(t *testing.T) {
+	b := newMockBroker(t, testConfLockStats)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	stats := b.manager.Stats()
+	assert.Equal(t, 1, stats.Sessions)
+	assert.Equal(t, 1, stats.Clients)
+	assert.Len(t, stats.HotSessions, 1)
+	assert.Equal(t, t.Name(), stats.HotSessions[0].ID)
+	assert.NotZero(t, stats.HotSessions[0].Lock.Samples)
+	assert.NotZero(t, stats.HotSessions[0].Lock.Holds)
+
+	// disabled by default
+	m := &rwMutex{}
+	m.Lock()
+	m.Unlock()
+	m.RLock()
+	m.RUnlock()
+	assert.Equal(t, LockStats{}, m.stats())
+}
+
+func TestSessionPushConcurrentSubscribe(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+	b.manager.cfg.MaxInflightQOS0Messages = 100000
+	b.manager.cfg.MaxInflightQOS1Messages = 1000
+
+	s, err := newSession(Info{ID: t.Name(), Subscriptions: map[string]mqtt.QOS{"a": 1}}, b.manager)
+	assert.NoError(t, err)
+	defer s.close()
+	recv0, recv1, stop := drainSession(s)
+
+	var done int32
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	// subscribe and unsubscribe concurrently
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			sa := &mqtt.Suback{ReturnCodes: make([]mqtt.QOS, 1)}
+			assert.NoError(t, s.subscribe([]mqtt.Subscription{{Topic: "b/#", QOS: mqtt.QOS(i % 2)}}, sa, nil))
+			_, err := s.unsubscribe([]string{"b/#"})
+			assert.NoError(t, err)
+		}
+	}()
+
+	n := 1000
+	var pubs sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		pubs.Add(1)
+		go func(p int) {
+			defer pubs.Done()
+			for i := 0; i < n; i++ {
+				msg := &mqtt.Message{}
+				msg.Context.Topic = "a"
+				msg.Context.QOS = uint32(i % 2)
+				if p%2 == 1 {
+					msg.Context.Topic = "b/c"
+				}
+				err := s.Push(common.NewEvent(msg, 1, func(uint64) { atomic.AddInt32(&done, 1) }))
+				assert.NoError(t, err)
+			}
+		}(p)
+	}
+	pubs.Wait()
+	close(quit)
+	wg.Wait()
+
+	// every event is acknowledged, the messages to the stable subscription are all delivered by their qos
+	assert.Equal(t, int32(4*n), atomic.LoadInt32(&done))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(recv0) >= int32(n) && atomic.LoadInt32(recv1) >= int32(n)
+	}, 5*time.Second, 10*time.Millisecond)
+	stop()
+}
+
+func TestSessionPushConcurrentClose(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+	b.manager.cfg.OrderedSessions = []string{"ordered"}
+
+	base := runtime.NumGoroutine()
+	for r := 0; r < 20; r++ {
+		id := "plain"
+		if r%2 == 1 {
+			id = "ordered"
+		}
+		s, err := newSession(Info{ID: id, CleanSession: true, Subscriptions: map[string]mqtt.QOS{"a": 1}}, b.manager)
+		assert.NoError(t, err)
+		_, _, stop := drainSession(s)
+
+		var pushed, done int32
+		var pubs sync.WaitGroup
+		for p := 0; p < 4; p++ {
+			pubs.Add(1)
+			go func() {
+				defer pubs.Done()
+				for i := 0; ; i++ {
+					msg := &mqtt.Message{}
+					msg.Context.Topic = "a"
+					msg.Context.QOS = uint32(i % 2)
+					atomic.AddInt32(&pushed, 1)
+					err := s.Push(common.NewEvent(msg, 1, func(uint64) { atomic.AddInt32(&done, 1) }))
+					if err != nil {
+						assert.Equal(t, queue.ErrQueueClosed, errors.Cause(err))
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond * 10)
+		s.close()
+		pubs.Wait()
+		stop()
+
+		// no push is accepted after close, and every event pushed is acknowledged once
+		msg := &mqtt.Message{}
+		msg.Context.Topic = "a"
+		assert.Equal(t, queue.ErrQueueClosed, s.Push(common.NewEvent(msg, 1, nil)))
+		assert.Equal(t, atomic.LoadInt32(&pushed), atomic.LoadInt32(&done))
+		s.close()
+	}
+	// the goroutines of the sessions are all stopped
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= base
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSessionCloseUnbinds(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	subs := map[string]mqtt.QOS{"a": 1, "b/+": 0, "$share/g/c": 1}
+	s, err := newSession(Info{ID: "s", CleanSession: true, Subscriptions: subs}, b.manager)
+	assert.NoError(t, err)
+	for topic := range subs {
+		assert.True(t, b.manager.exch.Bound(topic, s))
+	}
+
+	// the session is closed without being unbound by the manager, such as on an error path
+	s.close()
+	for topic := range subs {
+		assert.False(t, b.manager.exch.Bound(topic, s))
+	}
+	b.assertExchangeCount(0)
+
+	// the publishes find no binding, so they are acknowledged at once
+	for _, topic := range []string{"a", "b/1", "c"} {
+		acked := false
+		msg := &mqtt.Message{}
+		msg.Context.Topic = topic
+		msg.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(msg, func(uint64) { acked = true }))
+		assert.True(t, acked)
+	}
+}
+
+func TestSessionUpgradeQOS(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	s, err := newSession(Info{ID: "s", CleanSession: true, Subscriptions: map[string]mqtt.QOS{"t": 0}}, b.manager)
+	assert.NoError(t, err)
+	defer s.close()
+
+	push := func(payload string) {
+		msg := &mqtt.Message{Content: []byte(payload)}
+		msg.Context.Topic = "t"
+		msg.Context.QOS = 1
+		assert.NoError(t, b.manager.exch.Route(msg, nil))
+	}
+
+	// queued at the QoS granted when pushed
+	push("0")
+	sa := &mqtt.Suback{ReturnCodes: make([]mqtt.QOS, 1)}
+	assert.NoError(t, s.subscribe([]mqtt.Subscription{{Topic: "t", QOS: 1}}, sa, nil))
+	assert.Equal(t, map[string]mqtt.QOS{"t": 1}, s.subscriptions())
+	assert.True(t, b.manager.exch.Bound("t", s))
+	b.assertExchangeCount(1)
+	push("1")
+
+	// the queued message is not upgraded, the new one is delivered at the upgraded QoS only once
+	select {
+	case e := <-s.qos0msg.Chan():
+		assert.Equal(t, "0", string(e.Content))
+	case <-time.After(time.Second):
+		assert.FailNow(t, "the message queued before upgrade is not delivered at QoS 0")
+	}
+	select {
+	case e := <-s.qos1msg.Chan():
+		assert.Equal(t, "1", string(e.Content))
+	case <-time.After(time.Second):
+		assert.FailNow(t, "the message pushed after upgrade is not delivered at QoS 1")
+	}
+	select {
+	case e := <-s.qos0msg.Chan():
+		assert.Fail(t, "unexpected message at QoS 0", string(e.Content))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSessionConnectChurn(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	// connects with overlapping client ids, the connection may be taken over before its connack is sent
+	connect := func(id string) *mockConn {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: id, CleanSession: true, Version: 3})
+		for {
+			select {
+			case pkt := <-c.s2c:
+				assert.Equal(t, "<Connack SessionPresent=false ReturnCode=0>", pkt.String())
+				return c
+			case <-time.After(10 * time.Millisecond):
+				c.RLock()
+				closed := c.closed
+				c.RUnlock()
+				if closed {
+					return c
+				}
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				id := "c" + strconv.Itoa((g+i)%4)
+				c := connect(id)
+				// the others are left to be taken over
+				if i%2 == 0 {
+					c.sendC2S(&mqtt.Disconnect{})
+				}
+				if v, ok := b.manager.sessions.load(id); ok {
+					assert.Equal(t, id, v.(*Session).ID())
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// the last connection of each id takes over the rest, nothing is left after disconnecting
+	for i := 0; i < 4; i++ {
+		c := connect("c" + strconv.Itoa(i))
+		c.sendC2S(&mqtt.Disconnect{})
+	}
+	for i := 0; i < 100 && (b.manager.clients.count() != 0 || b.manager.sessions.count() != 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.assertClientCount(0)
+	b.assertSessionCount(0)
+	b.assertExchangeCount(0)
+}
+
+func TestSessionMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		expect        bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/+", "a/b", true},
+		{"+", "$SYS", false},
+		{"#", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+		{"a/b", "a/b/", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expect, matchTopic(c.filter, c.topic), c.filter+" "+c.topic)
+	}
+}
+
+// drainSession consumes the messages of both queues of the session and counts them
+func drainSession(s *Session) (*int32, *int32, func()) {
+	var recv0, recv1 int32
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case e := <-s.qos0msg.Chan():
+				atomic.AddInt32(&recv0, 1)
+				e.Done()
+			case e := <-s.qos1msg.Chan():
+				atomic.AddInt32(&recv1, 1)
+				e.Done()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return &recv0, &recv1, func() {
+		close(quit)
+		wg.Wait()
+	}
+}
+
+// BenchmarkSyncMapChurn stores, loads and deletes the clients of different ids by parallel connections,
+// the sharded map is compared with the one of a single lock
+func BenchmarkSyncMapChurn(b *testing.B) {
+	for _, shards := range []int{1, syncMapShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			m := newShardedSyncMap(shards)
+			var seq int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				id := "client" + strconv.FormatInt(atomic.AddInt64(&seq, 1), 10)
+				for pb.Next() {
+					m.store(id, id)
+					m.load(id)
+					m.delete(id)
+				}
+			})
+		})
+	}
+}
+
+func newBenchManager(b *testing.B) (*Manager, func()) {
+	log.Init(log.Config{Level: "fatal"})
+
+	var cfg Config
+	err := utils.UnmarshalYAML([]byte(testConfLockStats), &cfg)
+	assert.NoError(b, err)
+	cfg.MaxInflightQOS0Messages = 1000
+	cfg.MaxInflightQOS1Messages = 1000
+	os.RemoveAll("var")
+	m, err := NewManager(cfg)
+	assert.NoError(b, err)
+	return m, func() {
+		m.Close()
+		os.RemoveAll("var")
+	}
+}
+
+func reportLockStats(b *testing.B, s *Session) {
+	stats := s.Stats().Lock
+	if stats.Samples > 0 {
+		b.ReportMetric(float64(stats.WaitTotal.Nanoseconds())/float64(stats.Samples), "wait-ns/lock")
+	}
+	if stats.Holds > 0 {
+		b.ReportMetric(float64(stats.HoldTotal.Nanoseconds())/float64(stats.Holds), "hold-ns/lock")
+	}
+}
+
+// BenchmarkSessionPushQOS0Fanout pushes qos0 messages from parallel publishers to several sessions,
+// the qos0 path only takes the read lock so the publishers of a session are not serialized
+func BenchmarkSessionPushQOS0Fanout(b *testing.B) {
+	m, clean := newBenchManager(b)
+	defer clean()
+
+	var ss []*Session
+	for i := 0; i < 8; i++ {
+		s, err := newSession(Info{ID: "bench" + strconv.Itoa(i), Subscriptions: map[string]mqtt.QOS{"bench/#": 0}}, m)
+		assert.NoError(b, err)
+		defer s.close()
+		_, _, stop := drainSession(s)
+		defer stop()
+		ss = append(ss, s)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		msg := &mqtt.Message{}
+		msg.Context.Topic = "bench/a"
+		msg.Content = []byte("bench")
+		for pb.Next() {
+			e := common.NewEvent(msg, int32(len(ss)), nil)
+			for _, s := range ss {
+				s.Push(e)
+			}
+		}
+	})
+	b.StopTimer()
+	reportLockStats(b, ss[0])
+}
+
+// BenchmarkSessionPushParallel pushes qos1 messages to a session with many wildcard subscriptions,
+// the subscriptions are matched under read lock so that matching does not serialize the publishers
+func BenchmarkSessionPushParallel(b *testing.B) {
+	m, clean := newBenchManager(b)
+	defer clean()
+
+	subs := map[string]mqtt.QOS{}
+	for i := 0; i < 100; i++ {
+		subs["bench/"+strconv.Itoa(i)+"/+/#"] = 1
+	}
+	s, err := newSession(Info{ID: "bench", Subscriptions: subs}, m)
+	assert.NoError(b, err)
+	defer s.close()
+	_, _, stop := drainSession(s)
+	defer stop()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		msg := &mqtt.Message{}
+		msg.Context.Topic = "bench/1/a/b"
+		msg.Context.QOS = 1
+		msg.Content = []byte("bench")
+		for pb.Next() {
+			s.Push(common.NewEvent(msg, 1, nil))
+		}
+	})
+	b.StopTimer()
+	reportLockStats(b, s)
+}
+
+// BenchmarkSessionWriteCoalescing delivers qos0 messages to a subscriber over tcp with and without write coalescing,
+// the count of write syscalls of the process is reported on linux
+func BenchmarkSessionWriteCoalescing(b *testing.B) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		b.Run("delay="+delay.String(), func(b *testing.B) {
+			m, clean := newBenchManager(b)
+			defer clean()
+			m.cfg.MaxWriteDelay = delay
+
+			svr, err := mqtt.NewLauncher(nil).Launch("tcp://127.0.0.1:0")
+			assert.NoError(b, err)
+			defer svr.Close()
+			go func() {
+				for {
+					conn, err := svr.Accept()
+					if err != nil {
+						return
+					}
+					m.Handle(conn, true)
+				}
+			}()
+
+			conn, err := net.Dial("tcp", svr.Addr().String())
+			assert.NoError(b, err)
+			defer conn.Close()
+			handshake := []mqtt.Packet{
+				&mqtt.Connect{ClientID: "bench", CleanSession: true, Version: 3},
+				&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "bench"}}},
+			}
+			for _, pkt := range handshake {
+				buf := make([]byte, pkt.Len())
+				_, err = pkt.Encode(buf)
+				assert.NoError(b, err)
+				_, err = conn.Write(buf)
+				assert.NoError(b, err)
+			}
+			connack, suback := mqtt.NewConnack(), mqtt.NewSuback()
+			suback.ReturnCodes = []mqtt.QOS{0}
+			buf := make([]byte, 64*1024)
+			_, err = io.ReadFull(conn, buf[:connack.Len()+suback.Len()])
+			assert.NoError(b, err)
+
+			msg := &mqtt.Message{}
+			msg.Context.Topic = "bench"
+			msg.Content = []byte("bench")
+			pkt := mqtt.NewPublish()
+			pkt.Message.Topic = "bench"
+			pkt.Message.Payload = msg.Content
+			writes := countWriteSyscalls()
+
+			// publishes in bursts less than the max inflight qos0 messages so that no message is dropped
+			b.ResetTimer()
+			for i := 0; i < b.N; i += 100 {
+				burst := 100
+				if b.N-i < burst {
+					burst = b.N - i
+				}
+				for j := 0; j < burst; j++ {
+					m.exch.Route(msg, nil)
+				}
+				for n := 0; n < pkt.Len()*burst; {
+					c, err := conn.Read(buf)
+					if !assert.NoError(b, err) {
+						return
+					}
+					n += c
+				}
+			}
+			b.StopTimer()
+			if writes >= 0 {
+				b.ReportMetric(float64(countWriteSyscalls()-writes)/float64(b.N), "syscw/msg")
+			}
+		})
+	}
+}
+
+// countWriteSyscalls returns the count of write syscalls of the process, or -1 if not supported
+func countWriteSyscalls() int64 {
+	data, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscw:") {
+			n, err := strconv.ParseInt(strings.TrimSpace(line[len("syscw:"):]), 10, 64)
+			if err != nil {
+				return -1
+			}
+			return n
+		}
+	}
+	return -1
+}
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+	"github.com/baetyl/baetyl-broker/v2/store"
+)
+
+// the header of state archive
+const stateMagic = "baetyl-broker-state/1\n"
+
+// ExportState writes the durable state of sessions, queues and retained messages as a gzip archive,
+// the state is read from a consistent point-in-time view of the store
+func (m *Manager) ExportState(w io.Writer) error {
+	if err := m.checkQuitState(); err != nil {
+		return errors.Trace(err)
+	}
+	exp, ok := m.store.(store.Exporter)
+	// the queues in the other shards are not exported
+	if !ok || len(m.stores) > 1 {
+		return ErrSessionSnapshotNotSupported
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := io.WriteString(zw, stateMagic); err != nil {
+		return errors.Trace(err)
+	}
+	if err := exp.Export(zw); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(zw.Close())
+}
+
+// RestoreState replaces the durable state in the store by the archive written by ExportState,
+// it should be called before the manager using the store is created
+func RestoreState(cfg Config, r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Trace(ErrSessionSnapshotInvalid)
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+	header := make([]byte, len(stateMagic))
+	if _, err = io.ReadFull(br, header); err != nil || string(header) != stateMagic {
+		return errors.Trace(ErrSessionSnapshotInvalid)
+	}
+
+	db, err := store.New(cfg.Persistence.Store)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+	imp, ok := db.(store.Exporter)
+	if !ok {
+		return ErrSessionSnapshotNotSupported
+	}
+	return errors.Trace(imp.Import(br))
+}
+
+// Snapshot writes the durable state into a timestamped archive in the snapshot directory,
+// and removes the oldest archives beyond the retained count, returns the path of the archive
+func (m *Manager) Snapshot() (string, error) {
+	cfg := m.cfg.Persistence.Snapshot
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return "", errors.Trace(err)
+	}
+	name := filepath.Join(cfg.Dir, "snapshot-"+common.Now().UTC().Format("20060102T150405.000000000")+".gz")
+	// writes to a temporary file first so that an incomplete archive is never restored
+	f, err := ioutil.TempFile(cfg.Dir, ".snapshot-")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	err = m.ExportState(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if _err := f.Close(); err == nil {
+		err = _err
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Trace(err)
+	}
+
+	snaps, err := ListSnapshots(cfg.Dir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	for i := 0; i < len(snaps)-cfg.Retain; i++ {
+		if err = os.Remove(snaps[i]); err != nil {
+			m.log.Error("failed to remove old snapshot", log.Any("path", snaps[i]), log.Error(err))
+		}
+	}
+	return name, nil
+}
+
+// ListSnapshots lists the snapshot archives in the directory from the oldest to the latest
+func ListSnapshots(dir string) ([]string, error) {
+	snaps, err := filepath.Glob(filepath.Join(dir, "snapshot-*.gz"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(snaps)
+	return snaps, nil
+}
+
+func (m *Manager) snapshotting() error {
+	interval := m.cfg.Persistence.Snapshot.Interval
+	m.log.Info("manager starts to take snapshots", log.Any("interval", interval))
+	defer m.log.Info("manager has stopped taking snapshots")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			name, err := m.Snapshot()
+			if err != nil {
+				m.log.Error("failed to take snapshot", log.Error(err))
+				continue
+			}
+			m.log.Debug("manager has taken a snapshot", log.Any("path", name))
+		case <-m.tomb.Dying():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/log"
+)
+
+// tokenBucket throttles the publishes of a session or the echoes, the tokens are refilled at the rate per second up to
+// the burst, so that a burst within the capacity passes at once but a sustained flow is slowed down to the rate
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mut    sync.Mutex
+}
+
+func newTokenBucket(cfg PublishRate) *tokenBucket {
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = cfg.Rate
+	}
+	return &tokenBucket{
+		rate:   float64(cfg.Rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if available, the tokens never go negative
+func (b *tokenBucket) allow() bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token, and returns the duration to wait until the token is refilled, 0 if available,
+// the tokens go negative when reserved in advance, so the waiting publishes are served in turn
+func (b *tokenBucket) reserve() time.Duration {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.refill()
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// level returns the tokens left, negative if reserved in advance
+func (b *tokenBucket) level() float64 {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// throttle waits until the publish is allowed by the rate of session, the connection is not read during waiting
+func (c *Client) throttle() error {
+	if c.session.limiter == nil {
+		return nil
+	}
+	d := c.session.limiter.reserve()
+	if d <= 0 {
+		return nil
+	}
+	c.log.Debug("client pauses receiving since publishes exceed the rate", log.Any("wait", d))
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.tomb.Dying():
+		return ErrSessionClientAlreadyClosed
+	}
+}
@@ -3,10 +3,12 @@ package store
 import (
 	"errors"
 	"io"
+	"time"
 )
 
 var (
 	ErrDataNotFound = errors.New("no data found for this key")
+	ErrDBClosed     = errors.New("database is closed")
 )
 
 // Factories of database
@@ -16,6 +18,11 @@ var Factories = map[string]func(conf Conf) (DB, error){}
 type Conf struct {
 	Driver string `yaml:"driver" json:"driver" default:"pebble"`
 	Path   string `yaml:"path" json:"path" default:"var/lib/baetyl/db"`
+	// flush policy, the writes are synced to disk before return if true
+	Sync bool `yaml:"sync" json:"sync"`
+	// the writes of batch buckets within the window are coalesced into one transaction, 0 means disabled
+	BatchWindow  time.Duration `yaml:"batchWindow" json:"batchWindow"`
+	BatchMaxSize int           `yaml:"batchMaxSize" json:"batchMaxSize" default:"256" validate:"min=1"`
 }
 
 type DB interface {
@@ -25,6 +32,14 @@ type DB interface {
 	io.Closer
 }
 
+// Exporter the database supporting to export and import all data
+type Exporter interface {
+	// Export writes all data in a consistent point-in-time view to the writer
+	Export(w io.Writer) error
+	// Import replaces all data by the data read from the reader, which is written by Export
+	Import(r io.Reader) error
+}
+
 // BatchBucket the backend database
 type BatchBucket interface {
 	Set(offset uint64, value []byte) error
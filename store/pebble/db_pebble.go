@@ -1,7 +1,11 @@
 package pebble
 
 import (
+	"bufio"
+	"encoding/binary"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
@@ -17,7 +21,12 @@ func init() {
 // pebbleDB the backend PebbleDB to persist values
 type pebbleDB struct {
 	*pebble.DB
-	conf store.Conf
+	conf      store.Conf
+	writeOpts *pebble.WriteOptions
+	writes    chan *writeRequest // the writes to coalesce, nil if disabled
+	quit      chan struct{}
+	once      sync.Once
+	wg        sync.WaitGroup
 }
 
 // pebbleBucket the bucket to save data
@@ -26,6 +35,14 @@ type pebbleBucket struct {
 	name           []byte
 	prefixIterOpts *pebble.IterOptions
 	writeOpts      *pebble.WriteOptions
+	writes         chan *writeRequest
+	quit           chan struct{}
+}
+
+type writeRequest struct {
+	key   []byte
+	value []byte
+	done  chan error
 }
 
 // New creates a new pebble database
@@ -40,10 +57,153 @@ func newPebbleDB(conf store.Conf) (store.DB, error) {
 		return nil, errors.Trace(err)
 	}
 
-	return &pebbleDB{
-		DB:   db,
-		conf: conf,
-	}, nil
+	d := &pebbleDB{
+		DB:        db,
+		conf:      conf,
+		writeOpts: pebble.NoSync,
+		quit:      make(chan struct{}),
+	}
+	if conf.Sync {
+		d.writeOpts = pebble.Sync
+	}
+	if conf.BatchWindow > 0 {
+		// unbuffered, a request is accepted only if the coalescing routine is running
+		d.writes = make(chan *writeRequest)
+		d.wg.Add(1)
+		go d.coalescing()
+	}
+	return d, nil
+}
+
+// coalescing writes the requests received within the batch window in one batch with the same flush policy,
+// so that many small writes of batch buckets share one commit
+func (d *pebbleDB) coalescing() {
+	defer d.wg.Done()
+
+	max := d.conf.BatchMaxSize
+	if max <= 0 {
+		max = 1
+	}
+	reqs := make([]*writeRequest, 0, max)
+	timer := time.NewTimer(d.conf.BatchWindow)
+	defer timer.Stop()
+	for {
+		select {
+		case req := <-d.writes:
+			reqs = append(reqs, req)
+		case <-d.quit:
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d.conf.BatchWindow)
+	loop:
+		for len(reqs) < max {
+			select {
+			case req := <-d.writes:
+				reqs = append(reqs, req)
+			case <-timer.C:
+				break loop
+			case <-d.quit:
+				break loop
+			}
+		}
+
+		batch := d.NewBatch()
+		for _, req := range reqs {
+			batch.Set(req.key, req.value, nil)
+		}
+		err := batch.Commit(d.writeOpts)
+		batch.Close()
+		for _, req := range reqs {
+			req.done <- err
+		}
+		reqs = reqs[:0]
+	}
+}
+
+// Close closes the database after the pending writes are committed
+func (d *pebbleDB) Close() (err error) {
+	d.once.Do(func() {
+		close(d.quit)
+		d.wg.Wait()
+		err = d.DB.Close()
+	})
+	return
+}
+
+// Export writes all data in a snapshot to the writer, each key and value is prefixed by its length in uvarint
+func (d *pebbleDB) Export(w io.Writer) error {
+	snap := d.NewSnapshot()
+	defer snap.Close()
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	write := func(data []byte) error {
+		n := binary.PutUvarint(buf, uint64(len(data)))
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	}
+	iter := snap.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := write(iter.Key()); err != nil {
+			iter.Close()
+			return errors.Trace(err)
+		}
+		if err := write(iter.Value()); err != nil {
+			iter.Close()
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(iter.Close())
+}
+
+// Import replaces all data by the data written by Export in one batch
+func (d *pebbleDB) Import(r io.Reader) error {
+	batch := d.NewBatch()
+	defer batch.Close()
+
+	iter := d.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		batch.Delete(iter.Key(), nil)
+	}
+	if err := iter.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	br := bufio.NewReader(r)
+	read := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, n)
+		if _, err = io.ReadFull(br, data); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return data, err
+	}
+	for {
+		key, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		value, err := read()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		batch.Set(key, value, nil)
+	}
+	return errors.Trace(batch.Commit(pebble.Sync))
 }
 
 // NewBucket creates a bucket
@@ -53,7 +213,9 @@ func (d *pebbleDB) NewBatchBucket(name string) (store.BatchBucket, error) {
 		db:             d.DB,
 		name:           bn,
 		prefixIterOpts: getPrefixIterOptions(bn),
-		writeOpts:      pebble.NoSync,
+		writeOpts:      d.writeOpts,
+		writes:         d.writes,
+		quit:           d.quit,
 	}, nil
 }
 
@@ -64,7 +226,7 @@ func (d *pebbleDB) NewKVBucket(name string) (store.KVBucket, error) {
 		db:             d.DB,
 		name:           bn,
 		prefixIterOpts: getPrefixIterOptions(bn),
-		writeOpts:      pebble.NoSync,
+		writeOpts:      d.writeOpts,
 	}, nil
 }
 
@@ -74,12 +236,22 @@ func (b *pebbleBucket) Set(offset uint64, value []byte) error {
 	}
 
 	key := encodeBatchKey(b.name, offset)
-	return errors.Trace(b.db.Set(key, value, b.writeOpts))
+	if b.writes == nil {
+		return errors.Trace(b.db.Set(key, value, b.writeOpts))
+	}
+	// returns after the coalesced batch is committed
+	req := &writeRequest{key: key, value: value, done: make(chan error, 1)}
+	select {
+	case b.writes <- req:
+	case <-b.quit:
+		return errors.Trace(store.ErrDBClosed)
+	}
+	return errors.Trace(<-req.done)
 }
 
 func (b *pebbleBucket) Get(offset uint64, length int, op func([]byte, uint64) error) error {
 	iter := b.db.NewIter(b.prefixIterOpts)
-	key, count := append(b.name, store.U64ToByte(offset)...), 0
+	key, count := concatKey(b.name, store.U64ToByte(offset)), 0
 	for iter.SeekGE(key); iter.Valid() && count < length; iter.Next() {
 		offset, _ := decodeBatchKey(iter.Key(), b.name)
 		err := op(iter.Value(), offset)
@@ -106,26 +278,30 @@ func (b *pebbleBucket) MaxOffset() (uint64, error) {
 // DelBeforeID deletes values whose keys are not greater than the given id from DB
 func (b *pebbleBucket) DelBeforeID(id uint64) error {
 	start := b.name
-	end := keyUpperBound(append(start, store.U64ToByte(id)...))
+	end := keyUpperBound(concatKey(start, store.U64ToByte(id)))
 	return errors.Trace(b.db.DeleteRange(start, end, pebble.NoSync))
 }
 
-// DelBeforeTS deletes expired messages from DB
+// DelBeforeTS deletes expired messages from DB, the messages are deleted up to the last expired one iterated
+// instead of the end of bucket, so that the messages set concurrently after iterating are never deleted
 func (b *pebbleBucket) DelBeforeTS(ts uint64) error {
-	start, end := b.name, keyUpperBound(b.name)
+	var last []byte
 	iter := b.db.NewIter(b.prefixIterOpts)
 	for iter.First(); iter.Valid(); iter.Next() {
 		_, kts := decodeBatchKey(iter.Key(), b.name)
 		if kts > ts {
-			end = iter.Key()
 			break
 		}
+		last = append(last[:0], iter.Key()...)
 	}
 
 	if err := iter.Close(); err != nil {
 		return errors.Trace(err)
 	}
-	return errors.Trace(b.db.DeleteRange(start, end, b.writeOpts))
+	if last == nil {
+		return nil
+	}
+	return errors.Trace(b.db.DeleteRange(b.name, keyUpperBound(last), b.writeOpts))
 }
 
 // Close close
@@ -196,7 +372,10 @@ func getPrefixIterOptions(prefix []byte) *pebble.IterOptions {
 func encodeBatchKey(name []byte, offset uint64) []byte {
 	// key = name + sid + ts (16 bytes)
 	ts := uint64(time.Now().Unix())
-	return append(name, store.U64U64ToByte(offset, ts)...)
+	// allocates a new key since the key may be kept in batch
+	key := make([]byte, 0, len(name)+16)
+	key = append(key, name...)
+	return append(key, store.U64U64ToByte(offset, ts)...)
 }
 
 func decodeBatchKey(key, name []byte) (uint64, uint64) {
@@ -206,7 +385,15 @@ func decodeBatchKey(key, name []byte) (uint64, uint64) {
 
 func encodeKVKey(name, key []byte) []byte {
 	// key = name + kvkey (8 bytes)
-	return append(name, key...)
+	return concatKey(name, key)
+}
+
+// concatKey allocates a new key of the name and the suffix, the name shared by the concurrent operations of bucket
+// must not be appended in place, whose spare capacity would be overwritten by each other
+func concatKey(name, suffix []byte) []byte {
+	key := make([]byte, 0, len(name)+len(suffix))
+	key = append(key, name...)
+	return append(key, suffix...)
 }
 
 func decodeKVKey(key, name []byte) []byte {
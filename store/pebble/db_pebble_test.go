@@ -1,13 +1,17 @@
 package pebble
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/baetyl/baetyl-broker/v2/store"
@@ -798,6 +802,103 @@ func TestDatabasePebbleDeleteBucket(t *testing.T) {
 	assert.Len(t, values3, 0)
 }
 
+func TestDatabasePebbleBatchWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name()), BatchWindow: time.Millisecond, BatchMaxSize: 16}
+	db, err := store.New(conf)
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	// concurrent writes of many buckets are coalesced
+	buckets, count := 10, 100
+	var wg sync.WaitGroup
+	for i := 0; i < buckets; i++ {
+		bucket, err := db.NewBatchBucket(t.Name() + strconv.Itoa(i))
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func(bucket store.BatchBucket) {
+			defer wg.Done()
+			for j := 1; j <= count; j++ {
+				assert.NoError(t, bucket.Set(uint64(j), []byte(strconv.Itoa(j))))
+			}
+		}(bucket)
+	}
+	wg.Wait()
+	assert.NoError(t, db.Close())
+
+	// all writes are persisted
+	db, err = store.New(conf)
+	assert.NoError(t, err)
+	for i := 0; i < buckets; i++ {
+		bucket, err := db.NewBatchBucket(t.Name() + strconv.Itoa(i))
+		assert.NoError(t, err)
+		offset, err := bucket.MaxOffset()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(count), offset)
+		var values []string
+		err = bucket.Get(1, count, func(data []byte, offset uint64) error {
+			assert.Equal(t, strconv.Itoa(int(offset)), string(data))
+			values = append(values, string(data))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, values, count)
+	}
+
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+	err = bucket.Set(1, []byte("1"))
+	assert.Equal(t, store.ErrDBClosed, errors.Cause(err))
+
+	// closing again is a no-op
+	assert.NoError(t, db.Close())
+}
+
+// BenchmarkDatabasePebbleConcurrent writes from many buckets concurrently like the qos1 queues of sessions,
+// the coalesced writes share one commit, which pays off especially if the writes are synced
+func BenchmarkDatabasePebbleConcurrent(b *testing.B) {
+	for _, synced := range []bool{false, true} {
+		for _, window := range []time.Duration{0, 100 * time.Microsecond, time.Millisecond} {
+			b.Run("sync="+strconv.FormatBool(synced)+"/window="+window.String(), func(b *testing.B) {
+				benchmarkDatabasePebbleConcurrent(b, store.Conf{Driver: "pebble", Sync: synced, BatchWindow: window, BatchMaxSize: 256})
+			})
+		}
+	}
+}
+
+func benchmarkDatabasePebbleConcurrent(b *testing.B, conf store.Conf) {
+	dir, err := ioutil.TempDir("", "bench")
+	assert.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	conf.Path = path.Join(dir, "bench")
+	db, err := store.New(conf)
+	assert.NoError(b, err)
+	defer db.Close()
+
+	var n int64
+	var mut sync.Mutex
+	data := make([]byte, 256)
+	b.SetParallelism(256)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mut.Lock()
+		n++
+		bucket, err := db.NewBatchBucket("bench" + strconv.FormatInt(n, 10))
+		mut.Unlock()
+		assert.NoError(b, err)
+		var offset uint64
+		for pb.Next() {
+			offset++
+			bucket.Set(offset, data)
+		}
+	})
+}
+
 func BenchmarkDatabasePebble(b *testing.B) {
 	dir, err := ioutil.TempDir("", b.Name())
 	assert.NoError(b, err)
@@ -852,3 +953,52 @@ func BenchmarkDatabasePebble(b *testing.B) {
 		}
 	})
 }
+
+func TestDatabasePebbleExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	bb, err := db.NewBatchBucket("batch")
+	assert.NoError(t, err)
+	kv, err := db.NewKVBucket("kv")
+	assert.NoError(t, err)
+	assert.NoError(t, bb.Set(1, []byte("v1")))
+	assert.NoError(t, bb.Set(2, []byte("v2")))
+	assert.NoError(t, kv.SetKV([]byte("k1"), []byte("kv1")))
+
+	var buf bytes.Buffer
+	assert.NoError(t, db.(store.Exporter).Export(&buf))
+	data := buf.Bytes()
+
+	// mutates after export
+	assert.NoError(t, bb.DelBeforeID(1))
+	assert.NoError(t, bb.Set(3, []byte("v3")))
+	assert.NoError(t, kv.DelKV([]byte("k1")))
+	assert.NoError(t, kv.SetKV([]byte("k2"), []byte("kv2")))
+
+	assert.NoError(t, db.(store.Exporter).Import(bytes.NewReader(data)))
+	var values []string
+	assert.NoError(t, bb.Get(1, 10, func(v []byte, _ uint64) error {
+		values = append(values, string(v))
+		return nil
+	}))
+	assert.Equal(t, []string{"v1", "v2"}, values)
+	values = nil
+	assert.NoError(t, kv.ListKV(func(v []byte) error {
+		values = append(values, string(v))
+		return nil
+	}))
+	assert.Equal(t, []string{"kv1"}, values)
+	offset, err := bb.MaxOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), offset)
+
+	// the truncated data is rejected
+	err = db.(store.Exporter).Import(bytes.NewReader(data[:len(data)-1]))
+	assert.Error(t, err)
+}